@@ -8,9 +8,9 @@ import (
 )
 
 func main() {
-	cli := cli.NewCLI()
-	if err := cli.Run(); err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
+	command := cli.NewCLI()
+	if err := command.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(cli.ExitCode(err))
 	}
 }
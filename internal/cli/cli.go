@@ -1,10 +1,25 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 
+	"github.com/KD0S-02/KDTransfer/internal/clipboard"
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
 	"github.com/KD0S-02/KDTransfer/internal/transfer"
 )
 
@@ -13,16 +28,39 @@ type CLI struct {
 	Passphrase string
 	File       string
 	Peer       string
+	Room       string
+	Mailbox    string
+	To         string
+	Name       string
+	Team       string
+	Visible    bool
+	LAN        bool
+	PortMap    bool
+	Streams    int
+	Limit      string
+	Compress   string
+	Preserve   string
+	Progress   string
+	Quiet      bool
+	JSON       bool
+	Stdout     bool
+	Text       string
+	Clipboard  bool
+
+	// out takes human-readable messages; with --json or --stdout it is
+	// stderr so stdout carries nothing but events or file data.
+	out    io.Writer
+	events *eventWriter
 }
 
 func NewCLI() *CLI {
-	return &CLI{}
+	return &CLI{out: os.Stdout}
 }
 
 func (c *CLI) Parse(args []string) error {
 
 	if len(args) < 2 {
-		return fmt.Errorf("usage: kdtransfer <send|recv> [options]")
+		return usageError(fmt.Errorf("usage: kdtransfer <send|recv|peers> [options]"))
 	}
 
 	c.Command = args[1]
@@ -30,50 +68,460 @@ func (c *CLI) Parse(args []string) error {
 
 	flags.StringVar(&c.Passphrase, "passphrase", "",
 		"Encryption passphrase to be used in E2EE")
+	flags.StringVar(&c.Room, "room", "", "Room name to join or broadcast to")
+	flags.StringVar(&c.Name, "name", "", "Display name shown in peer listings")
+	flags.StringVar(&c.Team, "team", "", "Team whose peer directory to join")
+	flags.BoolVar(&c.Visible, "visible", false, "List this client in the peer directory")
+	flags.BoolVar(&c.LAN, "lan", false,
+		"Discover peers on the local network via mDNS instead of the signalling server")
+	flags.StringVar(&c.Progress, "progress", "bar",
+		"Transfer progress output: bar, json (one object per line on stdout) or off")
+	flags.BoolVar(&c.Quiet, "quiet", false, "Hide transfer progress")
+	flags.BoolVar(&c.JSON, "json", false,
+		"Print registration, lookup, connection, progress, completion and errors "+
+			"as JSON lines on stdout")
+	flags.StringVar(&c.Preserve, "preserve", "",
+		"File attributes to send (send) or apply (recv): mode, times, xattrs, acls, "+
+			"a list like mode,times, all or none (default PRESERVE or mode,times)")
+
+	if c.Command == "recv" {
+		flags.BoolVar(&c.PortMap, "portmap", false,
+			"Forward the receive port on the router via PCP, NAT-PMP or UPnP")
+		flags.BoolVar(&c.Stdout, "stdout", false,
+			"Write the first received file to stdout and exit; messages go to stderr")
+		flags.BoolVar(&c.Clipboard, "clipboard", false,
+			"Copy received text messages to the clipboard instead of printing them")
+	}
 
 	if c.Command == "send" {
-		flags.StringVar(&c.File, "file", "", "Path of file to send")
+		flags.StringVar(&c.File, "file", "", "Path of file to send, or - for stdin")
 		flags.StringVar(&c.Peer, "peer", "", "Peer ID")
+		flags.StringVar(&c.To, "to", "", "Display name of a visible peer")
+		flags.StringVar(&c.Mailbox, "mailbox", "",
+			"Recipient identity for store-and-forward delivery if the peer is offline")
+		flags.IntVar(&c.Streams, "streams", 0,
+			"Parallel data connections per transfer (default STREAMS or 1)")
+		flags.StringVar(&c.Limit, "limit", "",
+			"Outgoing bandwidth cap, e.g. 20MB/s (default RATE_LIMIT or unlimited)")
+		flags.StringVar(&c.Compress, "compress", "",
+			"Compression to offer: zstd, s2 (fast, LZ4-class but not LZ4), a list like zstd,s2, "+
+				"or off (default COMPRESSION)")
+		flags.StringVar(&c.Text, "text", "", "Send this text as a message instead of a file")
+		flags.BoolVar(&c.Clipboard, "clipboard", false,
+			"Send the clipboard's text as a message instead of a file")
 	}
 
-	if c.Command != "send" && c.Command != "recv" {
-		return fmt.Errorf("unknown command: %s", c.Command)
+	if c.Command != "send" && c.Command != "recv" && c.Command != "peers" {
+		return usageError(fmt.Errorf("unknown command: %s", c.Command))
 	}
 
-	return flags.Parse(args[2:])
+	if err := flags.Parse(args[2:]); err != nil {
+		return usageError(err)
+	}
+	// "kdtransfer send - --peer X" names the file positionally.
+	if c.Command == "send" && c.File == "" && flags.NArg() > 0 {
+		c.File = flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return usageError(err)
+		}
+	}
+	if flags.NArg() > 0 {
+		return usageError(fmt.Errorf("unexpected argument %q", flags.Arg(0)))
+	}
+
+	if c.File == "-" && (c.Room != "" || c.Mailbox != "") {
+		return usageError(fmt.Errorf("stdin can only be sent to a single peer"))
+	}
+	if c.sendsMessage() {
+		if c.File != "" || (c.Text != "" && c.Clipboard) {
+			return usageError(fmt.Errorf("send one of a file, --text or --clipboard"))
+		}
+		if c.Room != "" || c.Mailbox != "" {
+			return usageError(fmt.Errorf("messages can only be sent to a single peer"))
+		}
+	}
+	if c.Stdout && (c.JSON || c.Progress == "json") {
+		return usageError(fmt.Errorf("--stdout cannot be combined with JSON output"))
+	}
+	if c.JSON || c.Stdout {
+		c.out = os.Stderr
+	}
+	return nil
 }
 
+// Run executes the command line. With --json a failure is also reported
+// as an error event carrying the exit code; see ExitCode. Ctrl-C or
+// SIGTERM cancels it: sends are cancelled on both sides and a receiver
+// stops, removing partial files.
 func (c *CLI) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := c.run(ctx)
+	if err != nil && c.JSON {
+		c.eventWriter().write(transfer.Event{
+			Type:     transfer.EventError,
+			Error:    err.Error(),
+			ExitCode: ExitCode(err),
+		})
+	}
+	return err
+}
+
+func (c *CLI) run(ctx context.Context) error {
 	err := c.Parse(os.Args)
 	if err != nil {
 		return err
 	}
 
-	client, err := transfer.NewClient()
+	if c.LAN {
+		return c.runLAN(ctx, transfer.NewLANClient())
+	}
+
+	client, err := transfer.NewClient(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Signalling server unreachable (%v), using the local network\n", err)
+		return c.runLAN(ctx, transfer.NewLANClient())
+	}
+
+	if err := c.applyOverrides(client); err != nil {
+		return err
+	}
+	stopWatching := client.WatchRateLimit()
+	defer stopWatching()
+
+	if c.Passphrase != "" {
+		fmt.Fprintln(c.out, "---Using provided passphrase for E2EE---")
+	}
+
+	if c.Command == "recv" && (c.PortMap || client.Config.PortMapping) {
+		if err := client.MapPort(); err != nil {
+			fmt.Fprintf(c.out, "Port mapping unavailable: %v\n", err)
+		}
+		defer client.UnmapPort()
+	}
+
+	peerID, err := client.RegisterWithServer(ctx, c.Passphrase)
+	if err != nil {
+		return serverError(err)
+	}
+	fmt.Fprintf(c.out, "Current ID: %s\n", peerID)
+	if client.Identity != "" {
+		fmt.Fprintf(c.out, "Identity: %s\n", client.Identity)
+	}
+
+	switch c.Command {
+	case "send":
+		if (c.File == "" && !c.sendsMessage()) ||
+			(c.Peer == "" && c.To == "" && c.Room == "" && c.Mailbox == "") {
+			return usageError(fmt.Errorf(
+				"--file and one of --peer, --to, --room or --mailbox required"))
+		}
+		if c.To != "" {
+			c.Peer, err = client.ResolvePeerName(ctx, c.To)
+			if err != nil {
+				return err
+			}
+		}
+		if c.sendsMessage() {
+			return c.sendMessage(ctx, client)
+		}
+		if c.File != "-" {
+			go c.readCommands(client)
+		}
+		if c.Room != "" {
+			return client.HandleBroadcastCommand(ctx, c.Room, c.File, c.Passphrase)
+		}
+		if c.Peer == "" {
+			return client.HandleMailboxSendCommand(ctx, c.Mailbox, c.File, c.Passphrase)
+		}
+		err := client.HandleSendCommand(ctx, c.Peer, c.File, c.Passphrase)
+		if err != nil && c.Mailbox != "" {
+			fmt.Fprintf(c.out, "Direct send failed (%v), falling back to mailbox\n", err)
+			return client.HandleMailboxSendCommand(ctx, c.Mailbox, c.File, c.Passphrase)
+		}
+		return err
+	case "recv":
+		return c.receive(ctx, client)
+	case "peers":
+		return c.printPeers(ctx, client)
+	default:
+		return usageError(fmt.Errorf("unknown command: %s", c.Command))
+	}
+
+}
+
+func (c *CLI) printPeers(ctx context.Context, client *transfer.Client) error {
+	entries, err := client.ListPeers(ctx, c.Room)
+	if err != nil {
+		return serverError(err)
+	}
+
+	if c.JSON {
+		for _, entry := range entries {
+			c.eventWriter().write(transfer.Event{
+				Type:   transfer.EventPeer,
+				PeerID: entry.PeerID,
+				Name:   entry.DisplayName,
+				Device: entry.DeviceType,
+			})
+		}
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No visible peers")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tDEVICE\tTYPE")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.DisplayName, entry.PeerID,
+			entry.DeviceType, entry.Type)
+	}
+	return w.Flush()
+}
+
+func (c *CLI) applyOverrides(client *transfer.Client) error {
+	onProgress, err := c.progressPrinter()
 	if err != nil {
+		return usageError(err)
+	}
+	client.OnProgress = onProgress
+	if c.JSON {
+		client.OnEvent = c.eventWriter().write
+	}
+
+	if c.Compress != "" {
+		codecs, err := codec.ParseList(c.Compress)
+		if err != nil {
+			return usageError(err)
+		}
+		client.Config.Compression = codecs
+	}
+	if c.Preserve != "" {
+		set, err := fileattr.Parse(c.Preserve)
+		if err != nil {
+			return usageError(err)
+		}
+		client.Config.Preserve = set
+	}
+	if c.Limit != "" {
+		rate, err := ratelimit.ParseRate(c.Limit)
+		if err != nil {
+			return usageError(err)
+		}
+		client.SetRateLimit(rate)
+	}
+	if c.Streams > 0 {
+		client.Config.Streams = c.Streams
+	}
+	if c.Name != "" {
+		client.Config.DisplayName = c.Name
+	}
+	if c.Team != "" {
+		client.Config.Team = c.Team
+	}
+	if c.Visible {
+		client.Config.Visible = true
+	}
+	return nil
+}
+
+// runLAN serves the commands that work without the signalling server,
+// finding receivers on the local network over mDNS.
+func (c *CLI) runLAN(ctx context.Context, client *transfer.Client) error {
+	if err := c.applyOverrides(client); err != nil {
 		return err
 	}
+	stopWatching := client.WatchRateLimit()
+	defer stopWatching()
+
+	if c.Room != "" || c.Mailbox != "" {
+		return usageError(fmt.Errorf("--room and --mailbox need the signalling server"))
+	}
+	if c.sendsMessage() {
+		return usageError(fmt.Errorf("--text and --clipboard need the signalling server"))
+	}
 
 	if c.Passphrase != "" {
-		fmt.Println("---Using provided passphrase for E2EE---")
+		fmt.Fprintln(c.out, "---Using provided passphrase for E2EE---")
 	}
 
-	peerID, err := client.RegisterWithServer(c.Passphrase)
+	peerID, err := client.StartLocal(c.Passphrase)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Current ID: %s\n", peerID)
+	fmt.Fprintf(c.out, "Current ID: %s (local network)\n", peerID)
 
 	switch c.Command {
 	case "send":
-		if c.File == "" || c.Peer == "" {
-			return fmt.Errorf("--file and --peer required")
+		if c.File == "" || (c.Peer == "" && c.To == "") {
+			return usageError(fmt.Errorf("--file and one of --peer or --to required"))
+		}
+		if c.File != "-" {
+			go c.readCommands(client)
 		}
-		return client.HandleSendCommand(c.Peer, c.File, c.Passphrase)
+		return client.HandleLANSendCommand(ctx, c.Peer, c.To, c.File, c.Passphrase)
 	case "recv":
-		return client.Receiver(c.Passphrase)
+		return c.receive(ctx, client)
+	case "peers":
+		return c.printLANPeers(ctx, client)
 	default:
-		return fmt.Errorf("unknown command: %s", c.Command)
+		return usageError(fmt.Errorf("unknown command: %s", c.Command))
+	}
+}
+
+// sendsMessage reports whether send has a message rather than a file.
+func (c *CLI) sendsMessage() bool {
+	return c.Command == "send" && (c.Text != "" || c.Clipboard)
+}
+
+// sendMessage sends --text, or the clipboard's text with --clipboard.
+func (c *CLI) sendMessage(ctx context.Context, client *transfer.Client) error {
+	text := []byte(c.Text)
+	if c.Clipboard {
+		var err error
+		text, err = clipboard.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read the clipboard: %w", err)
+		}
+		if len(text) == 0 {
+			return fmt.Errorf("the clipboard is empty")
+		}
+	}
+	return client.SendMessage(ctx, c.Peer, protocol.ContentTypeText, text, c.Passphrase)
+}
+
+// showMessage prints a received text message, or copies it to the
+// clipboard with --clipboard when one is available. With --stdout it goes
+// to stderr so it cannot end up in the piped file, and with --json the
+// completed event carries the text instead.
+func (c *CLI) showMessage(m transfer.Message) {
+	if c.Clipboard {
+		err := clipboard.Write(m.Data)
+		if err == nil {
+			fmt.Fprintf(c.out, "Copied a %d byte message to the clipboard\n", len(m.Data))
+			return
+		}
+		fmt.Fprintf(c.out, "Cannot copy the message (%v), printing it instead\n", err)
+	}
+	if c.JSON {
+		return
+	}
+
+	fmt.Fprintf(c.out, "%s", m.Data)
+	if !bytes.HasSuffix(m.Data, []byte("\n")) {
+		fmt.Fprintln(c.out)
+	}
+}
+
+// errReceived stops a --stdout receiver once its file is complete.
+var errReceived = errors.New("file received")
+
+// receive runs the receiver. With --stdout the first file is written to
+// stdout and the receiver stops once it has arrived, failing if it did
+// not arrive whole.
+func (c *CLI) receive(ctx context.Context, client *transfer.Client) error {
+	client.OnMessage = c.showMessage
+	if !c.Stdout {
+		return c.serve(ctx, client)
 	}
 
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	client.Sink = storage.NewWriterSink(os.Stdout)
+	onEvent := client.OnEvent
+	client.OnEvent = func(e transfer.Event) {
+		if onEvent != nil {
+			onEvent(e)
+		}
+		// Messages are shown on stderr and do not end the wait for the
+		// file.
+		if e.Direction != transfer.Receiving || e.ContentType != "" {
+			return
+		}
+		switch e.Type {
+		case transfer.EventCompleted:
+			stop(errReceived)
+		case transfer.EventFailed:
+			stop(fmt.Errorf("%w: %s", transfer.ErrTransferFailed, e.Error))
+		}
+	}
+
+	// A file fetched from the mailbox cancels the rest of serve, which is
+	// still a success.
+	err := c.serve(ctx, client)
+	cause := context.Cause(ctx)
+	if errors.Is(cause, errReceived) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cause
+}
+
+// serve fetches waiting mailbox entries, joins --room and runs the
+// receiver. The client's sink and handlers must already be set, so
+// mailbox entries are delivered the same way as live transfers.
+func (c *CLI) serve(ctx context.Context, client *transfer.Client) error {
+	if err := client.CheckMailbox(ctx, c.Passphrase); err != nil {
+		return serverError(err)
+	}
+	if c.Room != "" {
+		if err := client.JoinRoom(ctx, c.Room); err != nil {
+			return serverError(err)
+		}
+	}
+	return client.Receiver(ctx, c.Passphrase)
+}
+
+// readCommands lets the user pause, resume or cancel a running send from
+// the terminal. It is not started when the file itself comes from stdin.
+func (c *CLI) readCommands(client *transfer.Client) {
+	fmt.Fprintln(c.out, "Type 'pause', 'resume' or 'cancel' to control the transfer")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if err := client.RunCommand(strings.TrimSpace(scanner.Text())); err != nil {
+			fmt.Fprintln(c.out, err)
+		}
+	}
+}
+
+func (c *CLI) printLANPeers(ctx context.Context, client *transfer.Client) error {
+	services, err := client.ListLANPeers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		for _, service := range services {
+			c.eventWriter().write(transfer.Event{
+				Type:      transfer.EventPeer,
+				PeerID:    service.ID,
+				Name:      service.Text["name"],
+				Addresses: service.Addresses(),
+			})
+		}
+		return nil
+	}
+
+	if len(services) == 0 {
+		fmt.Println("No peers found on the local network")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tADDRESSES")
+	for _, service := range services {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", service.Text["name"], service.ID,
+			strings.Join(service.Addresses(), ","))
+	}
+	return w.Flush()
 }
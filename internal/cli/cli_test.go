@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/transfer"
+)
+
+func TestParseStreamArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{"kdtransfer", "send", "-", "--peer", "abc"},
+		{"kdtransfer", "send", "--peer", "abc", "-"},
+	} {
+		c := NewCLI()
+		if err := c.Parse(args); err != nil {
+			t.Fatalf("%v: parse failed: %v", args, err)
+		}
+		if c.File != "-" || c.Peer != "abc" {
+			t.Fatalf("%v: parsed file %q peer %q, want - and abc", args, c.File, c.Peer)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"kdtransfer", "send", "-", "--room", "team"},
+		{"kdtransfer", "recv", "--stdout", "--json"},
+		{"kdtransfer", "send", "a.bin", "b.bin", "--peer", "abc"},
+		{"kdtransfer", "send", "a.bin", "--text", "hi", "--peer", "abc"},
+		{"kdtransfer", "send", "--text", "hi", "--clipboard", "--peer", "abc"},
+		{"kdtransfer", "send", "--text", "hi", "--room", "team"},
+	} {
+		if err := NewCLI().Parse(args); ExitCode(err) != ExitUsage {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+		}
+	}
+}
+
+func TestStdoutReceiverPrintsMessagesToStderr(t *testing.T) {
+	c := NewCLI()
+	if err := c.Parse([]string{"kdtransfer", "recv", "--stdout"}); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if c.out != os.Stderr {
+		t.Fatalf("--stdout receiver writes messages to %v, want stderr", c.out)
+	}
+
+	var out bytes.Buffer
+	c.out = &out
+	c.showMessage(transfer.Message{ContentType: protocol.ContentTypeText, Data: []byte("hi")})
+	if out.String() != "hi\n" {
+		t.Fatalf("message printed as %q, want %q", out.String(), "hi\n")
+	}
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"context"
+	"errors"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/transfer"
+)
+
+// Exit codes, one per failure class, so scripts can react without parsing
+// messages. They are part of the CLI's interface: do not renumber them.
+const (
+	ExitOK           = 0
+	ExitFailure      = 1
+	ExitUsage        = 2
+	ExitServer       = 3
+	ExitPeerNotFound = 4
+	ExitConnect      = 5
+	ExitIncompatible = 6
+	ExitTransfer     = 7
+	ExitCancelled    = 8
+	ExitSuspended    = 9
+)
+
+var (
+	errUsage  = errors.New("usage")
+	errServer = errors.New("signalling server")
+)
+
+// ExitCode maps an error returned by Run to the process exit code. The
+// most specific class wins: a cancelled transfer is reported as cancelled
+// rather than as a failed transfer.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, errUsage):
+		return ExitUsage
+	case errors.Is(err, protocol.ErrIncompatible):
+		return ExitIncompatible
+	case errors.Is(err, protocol.ErrCancelled), errors.Is(err, context.Canceled):
+		return ExitCancelled
+	case errors.Is(err, protocol.ErrSuspended):
+		return ExitSuspended
+	case errors.Is(err, transfer.ErrPeerNotFound):
+		return ExitPeerNotFound
+	case errors.Is(err, transfer.ErrUnreachable):
+		return ExitConnect
+	case errors.Is(err, transfer.ErrTransferFailed):
+		return ExitTransfer
+	case errors.Is(err, errServer):
+		return ExitServer
+	default:
+		return ExitFailure
+	}
+}
+
+// usageError marks err as a problem with the command line.
+func usageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{class: errUsage, err: err}
+}
+
+// serverError marks err as a failure talking to the signalling server.
+func serverError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{class: errServer, err: err}
+}
+
+// classified tags an error with a class while keeping its message as is.
+type classified struct {
+	class error
+	err   error
+}
+
+func (e *classified) Error() string   { return e.err.Error() }
+func (e *classified) Unwrap() []error { return []error{e.class, e.err} }
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/transfer"
+)
+
+func TestExitCodeClassifiesFailures(t *testing.T) {
+	cancelled := &protocol.TransferError{Code: protocol.CodeCancelled, Message: "stop"}
+	suspended := &protocol.TransferError{Code: protocol.CodeSuspended, Message: "idle"}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, ExitOK},
+		{"plain", errors.New("boom"), ExitFailure},
+		{"usage", NewCLI().Parse([]string{"kdtransfer"}), ExitUsage},
+		{"bad flag", NewCLI().Parse([]string{"kdtransfer", "send", "--bogus"}), ExitUsage},
+		{"server", serverError(errors.New("refused")), ExitServer},
+		{"peer", fmt.Errorf("%w: server error: peer not found", transfer.ErrPeerNotFound),
+			ExitPeerNotFound},
+		{"connect", fmt.Errorf("%w: timeout", transfer.ErrUnreachable), ExitConnect},
+		{"incompatible", fmt.Errorf("%w: %w", transfer.ErrTransferFailed,
+			protocol.ErrIncompatible), ExitIncompatible},
+		{"transfer", fmt.Errorf("%w: disk full", transfer.ErrTransferFailed), ExitTransfer},
+		{"cancelled", fmt.Errorf("%w: receiver stopped the transfer: %w",
+			transfer.ErrTransferFailed, cancelled), ExitCancelled},
+		{"interrupted", serverError(fmt.Errorf("%w: read: closed", context.Canceled)),
+			ExitCancelled},
+		{"suspended", fmt.Errorf("%w: send the file again to resume: %w",
+			transfer.ErrTransferFailed, suspended), ExitSuspended},
+	}
+
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("%s: ExitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/transfer"
+)
+
+const barWidth = 24
+
+// progressPrinter returns the OnProgress callback for the chosen mode, or
+// nil when progress is switched off. With --json, ticks are progress
+// events unless --quiet or --progress off asks for none.
+func (c *CLI) progressPrinter() (func(transfer.ProgressEvent), error) {
+	mode := c.Progress
+	if c.JSON && mode == "bar" {
+		mode = "json"
+	}
+	if c.Quiet {
+		mode = "off"
+	}
+
+	switch mode {
+	case "", "bar":
+		bar := &progressBar{out: os.Stderr}
+		return bar.render, nil
+	case "json":
+		events := c.eventWriter()
+		return func(e transfer.ProgressEvent) { events.write(e.AsEvent()) }, nil
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q (bar, json or off)", mode)
+	}
+}
+
+// progressBar redraws one terminal line per update, ending it when the
+// transfer finishes.
+type progressBar struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (b *progressBar) render(e transfer.ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	filled := int(e.Percent() / 100 * barWidth)
+	filled = max(0, min(filled, barWidth))
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+
+	status := "ETA " + formatETA(e.ETA)
+	switch e.State {
+	case transfer.ProgressPaused:
+		status = "paused"
+	case transfer.ProgressCompleted:
+		status = "done in " + e.Elapsed.Round(time.Second).String()
+	case transfer.ProgressFailed, transfer.ProgressSuspended:
+		status = string(e.State)
+	}
+
+	rate := e.Rate
+	if e.State == transfer.ProgressCompleted {
+		rate = e.AverageRate
+	}
+
+	// Streams of unknown size have no percentage until they end.
+	percent := fmt.Sprintf("%5.1f%%", e.Percent())
+	if e.Streaming {
+		percent = "    --"
+	}
+
+	fmt.Fprintf(b.out, "\r%s %-20.20s [%s] %s %10s %10s/s %-16s",
+		arrow(e.Direction), e.Filename, bar, percent, formatBytes(float64(e.Bytes)),
+		formatBytes(rate), status)
+
+	if e.State != transfer.ProgressRunning && e.State != transfer.ProgressPaused {
+		fmt.Fprintln(b.out)
+	}
+}
+
+// eventWriter writes one JSON object per line to stdout. Events arrive
+// from transfer goroutines, so writes are serialised.
+type eventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (c *CLI) eventWriter() *eventWriter {
+	if c.events == nil {
+		c.events = &eventWriter{enc: json.NewEncoder(os.Stdout)}
+	}
+	return c.events
+}
+
+func (w *eventWriter) write(e transfer.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	w.enc.Encode(e)
+}
+
+func arrow(direction transfer.Direction) string {
+	if direction == transfer.Receiving {
+		return "<-"
+	}
+	return "->"
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for n >= 1000 && unit < len(units)-1 {
+		n /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
+
+func formatETA(eta time.Duration) string {
+	if eta <= 0 {
+		return "--"
+	}
+	return eta.Round(time.Second).String()
+}
@@ -0,0 +1,64 @@
+// Package clipboard reads and writes the system clipboard through the
+// command-line tools each platform ships or commonly has installed.
+package clipboard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// ErrUnavailable means none of the platform's clipboard tools is installed.
+var ErrUnavailable = errors.New("no clipboard tool found")
+
+// tool is a command that copies stdin to the clipboard or pastes it to
+// stdout.
+type tool struct {
+	name string
+	args []string
+}
+
+// Read returns the clipboard's text.
+func Read() ([]byte, error) {
+	paste, err := find(pasteTools())
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(paste.name, paste.args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w %s", paste.name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// Write replaces the clipboard's content with data.
+func Write(data []byte) error {
+	copier, err := find(copyTools())
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(copier.name, copier.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w %s", copier.name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// find returns the first of tools that is installed.
+func find(tools []tool) (tool, error) {
+	for _, t := range tools {
+		if _, err := exec.LookPath(t.name); err == nil {
+			return t, nil
+		}
+	}
+	return tool{}, ErrUnavailable
+}
@@ -0,0 +1,6 @@
+//go:build darwin
+
+package clipboard
+
+func copyTools() []tool  { return []tool{{name: "pbcopy"}} }
+func pasteTools() []tool { return []tool{{name: "pbpaste"}} }
@@ -0,0 +1,28 @@
+//go:build !darwin && !windows
+
+package clipboard
+
+import "os"
+
+// Wayland sessions use wl-clipboard; X11 sessions xclip or xsel.
+func copyTools() []tool {
+	tools := []tool{
+		{name: "xclip", args: []string{"-selection", "clipboard"}},
+		{name: "xsel", args: []string{"--clipboard", "--input"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([]tool{{name: "wl-copy"}}, tools...)
+	}
+	return tools
+}
+
+func pasteTools() []tool {
+	tools := []tool{
+		{name: "xclip", args: []string{"-selection", "clipboard", "-out"}},
+		{name: "xsel", args: []string{"--clipboard", "--output"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([]tool{{name: "wl-paste", args: []string{"--no-newline"}}}, tools...)
+	}
+	return tools
+}
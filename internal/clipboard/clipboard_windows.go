@@ -0,0 +1,9 @@
+//go:build windows
+
+package clipboard
+
+// clip.exe cannot paste, so reading goes through PowerShell.
+func copyTools() []tool { return []tool{{name: "clip"}} }
+func pasteTools() []tool {
+	return []tool{{name: "powershell", args: []string{"-NoProfile", "-Command", "Get-Clipboard -Raw"}}}
+}
@@ -0,0 +1,180 @@
+// Package codec compresses transfer chunks. A chunk is compressed on its
+// own so striped streams and offset writes keep working, and chunks that
+// do not shrink are sent as they are.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec byte
+
+const (
+	None Codec = iota
+	Zstd
+	// S2 (klauspost/compress, a Snappy extension) is the fast option: it
+	// trades ratio for speed much as LZ4 does, but is not LZ4 on the wire.
+	S2
+)
+
+const (
+	// Chunk flags, written before the chunk body when a codec is in use.
+	flagRaw        = 0
+	flagCompressed = 1
+
+	// minEstimate is the compress.Estimate score below which a chunk is
+	// treated as incompressible (media, archives) without trying.
+	minEstimate = 0.05
+	// minSavings is the fraction a compressed chunk must save to be sent
+	// compressed; smaller gains are not worth the receiver's CPU.
+	minSavings = 0.05
+
+	// maxDecoderMemory backstops Decode's maxSize check, which only runs
+	// after zstd has finished decoding.
+	maxDecoderMemory = 4 << 20
+)
+
+var ErrCorruptChunk = errors.New("corrupt compressed chunk")
+
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Zstd:
+		return "zstd"
+	case S2:
+		return "s2"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// All lists the codecs this build can decode, fastest-ratio first.
+var All = []Codec{Zstd, S2}
+
+// Names returns the wire names of codecs, as used in the peer handshake.
+func Names(codecs []Codec) []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.String()
+	}
+	return names
+}
+
+// Supported reports whether this build can decode c.
+func Supported(c Codec) bool {
+	return c == Zstd || c == S2
+}
+
+// ParseList parses a comma separated preference list such as "zstd,s2".
+// "off" and "none" yield an empty list.
+func ParseList(value string) ([]Codec, error) {
+	var codecs []Codec
+	for _, name := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "off", "none":
+		case "zstd":
+			codecs = append(codecs, Zstd)
+		case "s2":
+			codecs = append(codecs, S2)
+		case "lz4":
+			return nil, fmt.Errorf("lz4 is not supported; use s2 for fast compression")
+		default:
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+	}
+	return codecs, nil
+}
+
+// Choose picks the first codec in the sender's offer that we can decode.
+func Choose(offer []Codec) Codec {
+	for _, c := range offer {
+		if Supported(c) {
+			return c
+		}
+	}
+	return None
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1))
+		return encoder
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(maxDecoderMemory))
+		return decoder
+	})
+)
+
+// Encode frames src for the wire: a flag byte, then either the compressed
+// body or src unchanged when compression would not pay off.
+func Encode(c Codec, dst, src []byte) []byte {
+	dst = dst[:0]
+
+	if c != None && compress.Estimate(src) >= minEstimate {
+		var body []byte
+		switch c {
+		case Zstd:
+			body = zstdEncoder().EncodeAll(src, append(dst, flagCompressed))
+		case S2:
+			body = append(dst, flagCompressed)
+			body = append(body, s2.Encode(nil, src)...)
+		}
+		if body != nil && float64(len(body)) <= float64(len(src))*(1-minSavings) {
+			return body
+		}
+	}
+
+	return append(append(dst[:0], flagRaw), src...)
+}
+
+// Decode reverses Encode. maxSize bounds the decoded chunk so a hostile
+// sender cannot make us allocate without limit.
+func Decode(c Codec, chunk []byte, maxSize int) ([]byte, error) {
+	if len(chunk) == 0 {
+		return nil, ErrCorruptChunk
+	}
+
+	flag, body := chunk[0], chunk[1:]
+	switch flag {
+	case flagRaw:
+		return body, nil
+	case flagCompressed:
+	default:
+		return nil, ErrCorruptChunk
+	}
+
+	switch c {
+	case Zstd:
+		decoded, err := zstdDecoder().DecodeAll(body, make([]byte, 0, maxSize))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptChunk, err)
+		}
+		if len(decoded) > maxSize {
+			return nil, ErrCorruptChunk
+		}
+		return decoded, nil
+	case S2:
+		size, err := s2.DecodedLen(body)
+		if err != nil || size > maxSize {
+			return nil, ErrCorruptChunk
+		}
+		decoded, err := s2.Decode(make([]byte, size), body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptChunk, err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", c)
+	}
+}
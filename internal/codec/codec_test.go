@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestRoundTripShrinksText(t *testing.T) {
+	src := []byte(strings.Repeat("2026-10-19T12:00:00Z INFO request served path=/api/status\n", 2000))
+
+	for _, c := range []Codec{Zstd, S2} {
+		wire := Encode(c, nil, src)
+		if len(wire) >= len(src)/2 {
+			t.Errorf("%s: %d bytes compressed to %d", c, len(src), len(wire))
+		}
+
+		got, err := Decode(c, wire, len(src))
+		if err != nil {
+			t.Fatalf("%s: decode failed: %v", c, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%s: round trip changed the data", c)
+		}
+	}
+}
+
+func TestIncompressibleChunkSentRaw(t *testing.T) {
+	src := make([]byte, 64*1024)
+	rand.Read(src)
+
+	wire := Encode(Zstd, nil, src)
+	if wire[0] != flagRaw || len(wire) != len(src)+1 {
+		t.Fatalf("random data should be sent raw, got flag %d and %d bytes", wire[0], len(wire))
+	}
+
+	got, err := Decode(Zstd, wire, len(src))
+	if err != nil || !bytes.Equal(got, src) {
+		t.Errorf("raw round trip failed: %v", err)
+	}
+}
+
+func TestDecodeRejectsOversizedChunk(t *testing.T) {
+	src := bytes.Repeat([]byte{'a'}, 10000)
+	for _, c := range []Codec{Zstd, S2} {
+		if _, err := Decode(c, Encode(c, nil, src), 100); err == nil {
+			t.Errorf("%s: expected an error for a chunk above maxSize", c)
+		}
+	}
+}
+
+func TestChoosePrefersSenderOrder(t *testing.T) {
+	if got := Choose([]Codec{Codec(9), S2, Zstd}); got != S2 {
+		t.Errorf("Choose = %s, want s2", got)
+	}
+	if got := Choose(nil); got != None {
+		t.Errorf("Choose(nil) = %s, want none", got)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	codecs, err := ParseList("zstd, S2")
+	if err != nil || len(codecs) != 2 || codecs[0] != Zstd || codecs[1] != S2 {
+		t.Errorf("ParseList(zstd, S2) = %v, %v", codecs, err)
+	}
+	if codecs, err := ParseList("off"); err != nil || len(codecs) != 0 {
+		t.Errorf("ParseList(off) = %v, %v", codecs, err)
+	}
+	for _, value := range []string{"lz4", "zstd,brotli"} {
+		if _, err := ParseList(value); err == nil {
+			t.Errorf("ParseList(%q) accepted", value)
+		}
+	}
+}
@@ -3,27 +3,101 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
 	SignallingServerHost string
 	SignallingServerPort string
+	HTTPPort             string
 	TCPPort              string
 	UDPPort              string
+	WSPort               string
+	WebUIOrigins         []string
+	IdentityFile         string
+	CandidateHistory     string
+	MailboxDir           string
+	MailboxQuota         int64
+	MailboxTTL           time.Duration
+	ReceiveDir           string
+	DisplayName          string
+	Team                 string
+	Visible              bool
+	STUNServers          []string
+	PortMapping          bool
+	PortMapGateway       string
+	PortMapLifetime      time.Duration
+	Streams              int
+	RateLimit            int64
+	Compression          []codec.Codec
+	PauseTimeout         time.Duration
+	// Preserve is which file attributes senders include and receivers
+	// apply.
+	Preserve fileattr.Set
+}
+
+// Default returns the built-in configuration, ignoring .env and the
+// environment, for programs that configure the client themselves.
+func Default() *Config {
+	return &Config{
+		SignallingServerHost: "localhost",
+		SignallingServerPort: "8080",
+		HTTPPort:             "8081",
+		TCPPort:              "2502",
+		UDPPort:              "2503",
+		IdentityFile:         defaultIdentityFile(),
+		MailboxQuota:         1 << 30,
+		MailboxTTL:           72 * time.Hour,
+		DisplayName:          defaultDisplayName(),
+		STUNServers:          []string{"stun.l.google.com:19302", "stun1.l.google.com:19302"},
+		PortMapLifetime:      time.Hour,
+		Streams:              1,
+		Compression:          []codec.Codec{codec.Zstd, codec.S2},
+		PauseTimeout:         10 * time.Minute,
+		Preserve:             fileattr.Default,
+	}
 }
 
 func LoadConfig() *Config {
 	if err := godotenv.Load(); err != nil {
-		fmt.Println("No .env file found, using defaults")
+		fmt.Fprintln(os.Stderr, "No .env file found, using defaults")
 	}
 
+	d := Default()
 	config := &Config{
-		SignallingServerHost: getEnvOrDefault("SIGNALLING_SERVER_HOST", "localhost"),
-		SignallingServerPort: getEnvOrDefault("SIGNALLING_SERVER_PORT", "8080"),
-		TCPPort:              getEnvOrDefault("TCP_PORT", "2502"),
-		UDPPort:              getEnvOrDefault("UDP_PORT", "2503"),
+		SignallingServerHost: getEnvOrDefault("SIGNALLING_SERVER_HOST", d.SignallingServerHost),
+		SignallingServerPort: getEnvOrDefault("SIGNALLING_SERVER_PORT", d.SignallingServerPort),
+		HTTPPort:             getEnvOrDefault("HTTP_PORT", d.HTTPPort),
+		TCPPort:              getEnvOrDefault("TCP_PORT", d.TCPPort),
+		UDPPort:              getEnvOrDefault("UDP_PORT", d.UDPPort),
+		WSPort:               getEnvOrDefault("WS_PORT", d.WSPort),
+		WebUIOrigins:         getEnvListOrDefault("WEBUI_ORIGINS", d.WebUIOrigins),
+		IdentityFile:         getEnvOrDefault("IDENTITY_FILE", d.IdentityFile),
+		CandidateHistory:     getEnvOrDefault("CANDIDATE_HISTORY", d.CandidateHistory),
+		MailboxDir:           getEnvOrDefault("MAILBOX_DIR", d.MailboxDir),
+		MailboxQuota:         getEnvInt64OrDefault("MAILBOX_QUOTA", d.MailboxQuota),
+		MailboxTTL:           getEnvDurationOrDefault("MAILBOX_TTL", d.MailboxTTL),
+		ReceiveDir:           getEnvOrDefault("RECEIVE_DIR", d.ReceiveDir),
+		DisplayName:          getEnvOrDefault("DISPLAY_NAME", d.DisplayName),
+		Team:                 getEnvOrDefault("TEAM", d.Team),
+		Visible:              getEnvOrDefault("VISIBLE", "false") == "true",
+		STUNServers:          getEnvListOrDefault("STUN_SERVERS", d.STUNServers),
+		PortMapping:          getEnvOrDefault("PORT_MAPPING", "false") == "true",
+		PortMapGateway:       getEnvOrDefault("PORTMAP_GATEWAY", d.PortMapGateway),
+		PortMapLifetime:      getEnvDurationOrDefault("PORTMAP_LIFETIME", d.PortMapLifetime),
+		Streams:              int(getEnvInt64OrDefault("STREAMS", int64(d.Streams))),
+		RateLimit:            getEnvRateOrDefault("RATE_LIMIT", d.RateLimit),
+		Compression:          getEnvCodecsOrDefault("COMPRESSION", d.Compression),
+		PauseTimeout:         getEnvDurationOrDefault("PAUSE_TIMEOUT", d.PauseTimeout),
+		Preserve:             getEnvAttrsOrDefault("PRESERVE", d.Preserve),
 	}
 
 	return config
@@ -35,3 +109,116 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvListOrDefault reads a comma separated list; "none" yields an empty
+// list so a feature can be switched off explicitly.
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if value == "none" {
+		return nil
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt64OrDefault(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s %q, using default\n", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvRateOrDefault(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := ratelimit.ParseRate(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s %q, using default\n", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvCodecsOrDefault(key string, defaultValue []codec.Codec) []codec.Codec {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := codec.ParseList(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s %q, using default\n", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvAttrsOrDefault(key string, defaultValue fileattr.Set) fileattr.Set {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := fileattr.Parse(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s %q, using default\n", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+// ReadRateLimit re-reads RATE_LIMIT for a running process, preferring the
+// current .env file so an edited limit can be picked up without a restart.
+func ReadRateLimit() (int64, error) {
+	value := os.Getenv("RATE_LIMIT")
+	if env, err := godotenv.Read(); err == nil {
+		if fileValue, ok := env["RATE_LIMIT"]; ok {
+			value = fileValue
+		}
+	}
+	return ratelimit.ParseRate(value)
+}
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s %q, using default\n", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+func defaultIdentityFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".kdtransfer_identity"
+	}
+	return filepath.Join(home, ".kdtransfer", "identity")
+}
+
+func defaultDisplayName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
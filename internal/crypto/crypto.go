@@ -3,8 +3,11 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/pbkdf2"
+	crand "crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -32,6 +35,36 @@ func GenerateRandSalt() string {
 	return code + timestamp
 }
 
+// GenerateIdentitySecret returns a random secret that a client keeps on
+// disk as its persistent identity.
+func GenerateIdentitySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// IdentityKey derives the Ed25519 key whose signatures prove ownership of
+// the identity belonging to secret.
+func IdentityKey(secret string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("kdtransfer identity key\x00" + secret))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// IdentityFromPublicKey derives the public identity that peers address and
+// the server stores from an identity key's public half.
+func IdentityFromPublicKey(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+// IdentityFromSecret derives the public identity of secret. Only the
+// holder of the secret can prove ownership, by signing with IdentityKey.
+func IdentityFromSecret(secret string) string {
+	return IdentityFromPublicKey(IdentityKey(secret).Public().(ed25519.PublicKey))
+}
+
 func GenerateKey(passphrase string,
 	saltData string) (key []byte, err error) {
 	saltArr := sha256.Sum256([]byte(saltData))
@@ -0,0 +1,398 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// ServiceType is the DNS-SD service receivers advertise.
+	ServiceType = "_kdtransfer._tcp.local."
+
+	recordTTL     = 120
+	maxPacketSize = 9000
+)
+
+// ErrNotFound is returned by Lookup when no receiver answers for the ID.
+var ErrNotFound = errors.New("peer not found on the local network")
+
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+// Bus carries mDNS packets. Real deployments use UDP multicast on the LAN;
+// anything that fans a packet out to every member (including the sender)
+// behaves the same, which is how the tests run without a network.
+type Bus interface {
+	Send(packet []byte) error
+	// Receive returns the next packet and, where the bus knows it, the
+	// address it came from.
+	Receive(buf []byte) (n int, from net.Addr, err error)
+	Close() error
+}
+
+type multicastBus struct {
+	listener *net.UDPConn
+	sender   *net.UDPConn
+}
+
+// NewMulticastBus joins the mDNS IPv4 multicast group.
+func NewMulticastBus() (Bus, error) {
+	listener, err := net.ListenMulticastUDP("udp4", nil, mdnsGroupIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join mdns group: %w", err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, mdnsGroupIPv4)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to open mdns sender: %w", err)
+	}
+
+	return &multicastBus{listener: listener, sender: sender}, nil
+}
+
+func (b *multicastBus) Send(packet []byte) error {
+	_, err := b.sender.Write(packet)
+	return err
+}
+
+func (b *multicastBus) Receive(buf []byte) (int, net.Addr, error) {
+	n, from, err := b.listener.ReadFromUDP(buf)
+	return n, from, err
+}
+
+func (b *multicastBus) Close() error {
+	b.sender.Close()
+	return b.listener.Close()
+}
+
+// Service describes one advertised receiver.
+type Service struct {
+	ID   string
+	Port uint16
+	IPs  []net.IP
+	Text map[string]string
+}
+
+func (s Service) instanceName() string {
+	return s.ID + "." + ServiceType
+}
+
+func (s Service) hostName() string {
+	return s.ID + ".local."
+}
+
+// Addresses returns dialable host:port strings for every advertised IP.
+// DNS records cannot carry an IPv6 zone, so link-local addresses are
+// returned once for each local interface they may be reachable through.
+func (s Service) Addresses() []string {
+	addrs := make([]string, 0, len(s.IPs))
+	for _, ip := range s.IPs {
+		addrs = append(addrs, net.JoinHostPort(ip.String(),
+			fmt.Sprint(s.Port)))
+	}
+	return network.ExpandLinkLocal(addrs)
+}
+
+func (s Service) records(ttl uint32) ([]dnsmessage.Resource, error) {
+	serviceName, err := dnsmessage.NewName(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(s.instanceName())
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(s.hostName())
+	if err != nil {
+		return nil, err
+	}
+
+	header := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ,
+			Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	txt := make([]string, 0, len(s.Text))
+	for key, value := range s.Text {
+		txt = append(txt, key+"="+value)
+	}
+
+	records := []dnsmessage.Resource{
+		{Header: header(serviceName, dnsmessage.TypePTR),
+			Body: &dnsmessage.PTRResource{PTR: instance}},
+		{Header: header(instance, dnsmessage.TypeSRV),
+			Body: &dnsmessage.SRVResource{Port: s.Port, Target: host}},
+		{Header: header(instance, dnsmessage.TypeTXT),
+			Body: &dnsmessage.TXTResource{TXT: txt}},
+	}
+
+	for _, ip := range s.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			var a [4]byte
+			copy(a[:], ip4)
+			records = append(records, dnsmessage.Resource{
+				Header: header(host, dnsmessage.TypeA),
+				Body:   &dnsmessage.AResource{A: a}})
+			continue
+		}
+		var aaaa [16]byte
+		copy(aaaa[:], ip.To16())
+		records = append(records, dnsmessage.Resource{
+			Header: header(host, dnsmessage.TypeAAAA),
+			Body:   &dnsmessage.AAAAResource{AAAA: aaaa}})
+	}
+
+	return records, nil
+}
+
+func (s Service) response(ttl uint32) ([]byte, error) {
+	records, err := s.records(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: records,
+	}
+	return msg.Pack()
+}
+
+// Advertiser answers mDNS queries for one service until closed.
+type Advertiser struct {
+	bus     Bus
+	service Service
+}
+
+func NewAdvertiser(bus Bus, service Service) *Advertiser {
+	return &Advertiser{bus: bus, service: service}
+}
+
+// Run announces the service and then answers matching queries. It returns
+// when the bus is closed.
+func (a *Advertiser) Run() error {
+	if err := a.announce(recordTTL); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := a.bus.Receive(buf)
+		if err != nil {
+			return nil
+		}
+
+		if a.matches(buf[:n]) {
+			if err := a.announce(recordTTL); err != nil {
+				log.Printf("mDNS response failed: %v", err)
+			}
+		}
+	}
+}
+
+func (a *Advertiser) announce(ttl uint32) error {
+	packet, err := a.service.response(ttl)
+	if err != nil {
+		return fmt.Errorf("failed to build mdns response: %w", err)
+	}
+	return a.bus.Send(packet)
+}
+
+func (a *Advertiser) matches(packet []byte) bool {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || msg.Header.Response {
+		return false
+	}
+
+	for _, q := range msg.Questions {
+		name := strings.ToLower(q.Name.String())
+		if name == ServiceType || name == strings.ToLower(a.service.instanceName()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close sends a goodbye (TTL 0) so browsers drop the service, then stops
+// the advertiser.
+func (a *Advertiser) Close() error {
+	a.announce(0)
+	return a.bus.Close()
+}
+
+func query() ([]byte, error) {
+	name, err := dnsmessage.NewName(ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		},
+	}
+	return msg.Pack()
+}
+
+// Browse queries for receivers and collects answers until timeout, or
+// until stop reports that the wanted service has been found.
+func Browse(bus Bus, timeout time.Duration,
+	stop func(Service) bool) ([]Service, error) {
+	packet, err := query()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build mdns query: %w", err)
+	}
+
+	type received struct {
+		data []byte
+		from net.Addr
+	}
+	packets := make(chan received, 16)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(packets)
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, from, err := bus.Receive(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- received{append([]byte(nil), buf[:n]...), from}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := bus.Send(packet); err != nil {
+		return nil, fmt.Errorf("failed to send mdns query: %w", err)
+	}
+
+	found := make(map[string]Service)
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return collect(found), nil
+			}
+			for _, service := range parseResponse(packet.data, packet.from) {
+				found[service.ID] = service
+				if stop != nil && stop(service) {
+					return collect(found), nil
+				}
+			}
+		case <-deadline:
+			return collect(found), nil
+		}
+	}
+}
+
+// Lookup finds the receiver advertising id.
+func Lookup(bus Bus, id string, timeout time.Duration) (Service, error) {
+	services, err := Browse(bus, timeout, func(s Service) bool {
+		return s.ID == id
+	})
+	if err != nil {
+		return Service{}, err
+	}
+
+	for _, service := range services {
+		if service.ID == id {
+			return service, nil
+		}
+	}
+	return Service{}, fmt.Errorf("peer %s: %w", id, ErrNotFound)
+}
+
+func collect(found map[string]Service) []Service {
+	services := make([]Service, 0, len(found))
+	for _, service := range found {
+		services = append(services, service)
+	}
+	return services
+}
+
+// parseResponse reads the services answered in packet. A service that
+// withholds its addresses, as passphrase-protected receivers do, is
+// reachable at the address the answer came from.
+func parseResponse(packet []byte, from net.Addr) []Service {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Header.Response {
+		return nil
+	}
+
+	records := append(msg.Answers, msg.Additionals...)
+	services := make(map[string]*Service)
+	hosts := make(map[string][]net.IP)
+	targets := make(map[string]string)
+
+	for _, record := range records {
+		name := strings.ToLower(record.Header.Name.String())
+
+		switch body := record.Body.(type) {
+		case *dnsmessage.SRVResource:
+			id, ok := instanceID(name)
+			if !ok || record.Header.TTL == 0 {
+				continue
+			}
+			svc := serviceFor(services, id)
+			svc.Port = body.Port
+			targets[id] = strings.ToLower(body.Target.String())
+		case *dnsmessage.TXTResource:
+			id, ok := instanceID(name)
+			if !ok {
+				continue
+			}
+			svc := serviceFor(services, id)
+			for _, entry := range body.TXT {
+				if key, value, ok := strings.Cut(entry, "="); ok {
+					svc.Text[key] = value
+				}
+			}
+		case *dnsmessage.AResource:
+			hosts[name] = append(hosts[name], net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			hosts[name] = append(hosts[name], net.IP(body.AAAA[:]))
+		}
+	}
+
+	var result []Service
+	for id, svc := range services {
+		if svc.Port == 0 {
+			continue
+		}
+		svc.IPs = hosts[targets[id]]
+		if udp, ok := from.(*net.UDPAddr); ok && len(svc.IPs) == 0 {
+			svc.IPs = []net.IP{udp.IP}
+		}
+		result = append(result, *svc)
+	}
+	return result
+}
+
+func instanceID(name string) (string, bool) {
+	id, ok := strings.CutSuffix(name, "."+ServiceType)
+	return id, ok && id != ""
+}
+
+func serviceFor(services map[string]*Service, id string) *Service {
+	svc, ok := services[id]
+	if !ok {
+		svc = &Service{ID: id, Text: make(map[string]string)}
+		services[id] = svc
+	}
+	return svc
+}
@@ -0,0 +1,240 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryGroup is an in-process stand-in for a multicast group: every packet
+// sent by a member is delivered to all members, including the sender, just
+// like IP_MULTICAST_LOOP on a real interface. Each member has its own
+// source address. TestMulticastBusLoopback covers the real socket.
+type memoryGroup struct {
+	mu      sync.Mutex
+	members map[*memoryBus]struct{}
+}
+
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+type memoryBus struct {
+	group   *memoryGroup
+	addr    *net.UDPAddr
+	packets chan packet
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newMemoryGroup() *memoryGroup {
+	return &memoryGroup{members: make(map[*memoryBus]struct{})}
+}
+
+func (g *memoryGroup) join() *memoryBus {
+	bus := &memoryBus{
+		group:   g,
+		addr:    &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(len(g.members)+1)), Port: 5353},
+		packets: make(chan packet, 64),
+		closed:  make(chan struct{}),
+	}
+	g.mu.Lock()
+	g.members[bus] = struct{}{}
+	g.mu.Unlock()
+	return bus
+}
+
+func (b *memoryBus) Send(data []byte) error {
+	b.group.mu.Lock()
+	defer b.group.mu.Unlock()
+	for member := range b.group.members {
+		select {
+		case member.packets <- packet{append([]byte(nil), data...), b.addr}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *memoryBus) Receive(buf []byte) (int, net.Addr, error) {
+	select {
+	case p := <-b.packets:
+		return copy(buf, p.data), p.from, nil
+	case <-b.closed:
+		return 0, nil, errors.New("bus closed")
+	}
+}
+
+func (b *memoryBus) Close() error {
+	b.once.Do(func() {
+		b.group.mu.Lock()
+		delete(b.group.members, b)
+		b.group.mu.Unlock()
+		close(b.closed)
+	})
+	return nil
+}
+
+func TestLookupFindsAdvertisedReceiver(t *testing.T) {
+	group := newMemoryGroup()
+
+	receiver := Service{
+		ID:   "abc12345",
+		Port: 2502,
+		IPs:  []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("fd00::20")},
+		Text: map[string]string{"name": "build-07", "ws": "2504"},
+	}
+
+	advertiser := NewAdvertiser(group.join(), receiver)
+	go advertiser.Run()
+	defer advertiser.Close()
+
+	other := NewAdvertiser(group.join(), Service{ID: "zzz99999", Port: 2502,
+		IPs: []net.IP{net.ParseIP("192.168.1.30")}})
+	go other.Run()
+	defer other.Close()
+
+	sender := group.join()
+	defer sender.Close()
+
+	found, err := Lookup(sender, "abc12345", time.Second)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	addrs := found.Addresses()
+	want := map[string]bool{"192.168.1.20:2502": true, "[fd00::20]:2502": true}
+	if len(addrs) != len(want) {
+		t.Fatalf("addresses = %v, want %v", addrs, want)
+	}
+	for _, addr := range addrs {
+		if !want[addr] {
+			t.Errorf("unexpected address %s", addr)
+		}
+	}
+
+	if found.Text["name"] != "build-07" || found.Text["ws"] != "2504" {
+		t.Errorf("txt = %v, want name and ws entries", found.Text)
+	}
+}
+
+func TestBrowseIgnoresGoodbye(t *testing.T) {
+	group := newMemoryGroup()
+
+	advertiser := NewAdvertiser(group.join(), Service{ID: "gone0000", Port: 2502,
+		IPs: []net.IP{net.ParseIP("10.0.0.5")}})
+	packet, err := advertiser.service.response(0)
+	if err != nil {
+		t.Fatalf("failed to build goodbye: %v", err)
+	}
+
+	if services := parseResponse(packet, nil); len(services) != 0 {
+		t.Errorf("goodbye parsed as live services: %+v", services)
+	}
+}
+
+func TestLookupMissingPeer(t *testing.T) {
+	group := newMemoryGroup()
+	sender := group.join()
+	defer sender.Close()
+
+	if _, err := Lookup(sender, "nobody00", 50*time.Millisecond); err == nil {
+		t.Error("expected lookup of unadvertised peer to fail")
+	}
+}
+
+func TestLookupUsesSourceOfAddresslessAnswer(t *testing.T) {
+	group := newMemoryGroup()
+
+	bus := group.join()
+	advertiser := NewAdvertiser(bus, Service{ID: "e2ee0000", Port: 2502,
+		Text: map[string]string{"e2ee": "1"}})
+	go advertiser.Run()
+	defer advertiser.Close()
+
+	sender := group.join()
+	defer sender.Close()
+
+	found, err := Lookup(sender, "e2ee0000", time.Second)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	want := net.JoinHostPort(bus.addr.IP.String(), "2502")
+	if addrs := found.Addresses(); len(addrs) != 1 || addrs[0] != want {
+		t.Errorf("addresses = %v, want [%s]", addrs, want)
+	}
+}
+
+// TestMulticastBusLoopback runs discovery over the real mDNS group,
+// relying on multicast loopback to hear its own advertisement. It is
+// skipped where the host cannot join the group or loop packets back.
+func TestMulticastBusLoopback(t *testing.T) {
+	advertiserBus, err := NewMulticastBus()
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	senderBus, err := NewMulticastBus()
+	if err != nil {
+		advertiserBus.Close()
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer senderBus.Close()
+
+	probe, err := query()
+	if err != nil {
+		t.Fatalf("failed to build probe: %v", err)
+	}
+	if !hears(t, senderBus, probe) {
+		advertiserBus.Close()
+		t.Skip("multicast packets are not looped back on this host")
+	}
+
+	id := fmt.Sprintf("t%07d", time.Now().UnixNano()%10000000)
+	advertiser := NewAdvertiser(advertiserBus, Service{ID: id, Port: 2502,
+		IPs: []net.IP{net.ParseIP("192.0.2.7")}})
+	go advertiser.Run()
+	defer advertiser.Close()
+
+	found, err := Lookup(senderBus, id, 2*time.Second)
+	if err != nil {
+		t.Fatalf("lookup over multicast failed: %v", err)
+	}
+	if addrs := found.Addresses(); len(addrs) != 1 || addrs[0] != "192.0.2.7:2502" {
+		t.Errorf("addresses = %v, want [192.0.2.7:2502]", addrs)
+	}
+}
+
+// hears sends packet on bus and reports whether it comes back.
+func hears(t *testing.T, bus Bus, packet []byte) bool {
+	t.Helper()
+	heard := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := bus.Receive(buf)
+			if err != nil {
+				heard <- false
+				return
+			}
+			if bytes.Equal(buf[:n], packet) {
+				heard <- true
+				return
+			}
+		}
+	}()
+
+	if err := bus.Send(packet); err != nil {
+		return false
+	}
+	select {
+	case ok := <-heard:
+		return ok
+	case <-time.After(time.Second):
+		return false
+	}
+}
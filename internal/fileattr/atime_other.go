@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package fileattr
+
+import (
+	"io/fs"
+	"time"
+)
+
+// accessTime is unknown here, so only the modification time is sent.
+func accessTime(fs.FileInfo) time.Time {
+	return time.Time{}
+}
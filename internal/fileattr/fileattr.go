@@ -0,0 +1,181 @@
+// Package fileattr reads and applies the attributes a transfer can carry
+// besides a file's content: permission bits, timestamps, extended
+// attributes and POSIX ACLs.
+package fileattr
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// Set selects which attributes a sender includes and a receiver applies.
+type Set uint8
+
+const (
+	// Mode is the permission bits; setuid, setgid and sticky are never
+	// carried.
+	Mode Set = 1 << iota
+	// Times is the modification and access times.
+	Times
+	// Xattrs is extended attributes in the user namespace.
+	Xattrs
+	// ACLs is the POSIX access ACL.
+	ACLs
+
+	Default = Mode | Times
+	All     = Mode | Times | Xattrs | ACLs
+)
+
+var names = []struct {
+	set  Set
+	name string
+}{{Mode, "mode"}, {Times, "times"}, {Xattrs, "xattrs"}, {ACLs, "acls"}}
+
+// Parse reads a comma separated list such as "mode,times", "all" or
+// "none".
+func Parse(value string) (Set, error) {
+	var set Set
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", "off", "none":
+			continue
+		case "all":
+			set |= All
+			continue
+		}
+
+		found := false
+		for _, n := range names {
+			if n.name == name {
+				set |= n.set
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown attribute %q", name)
+		}
+	}
+	return set, nil
+}
+
+func (s Set) String() string {
+	var list []string
+	for _, n := range names {
+		if s&n.set != 0 {
+			list = append(list, n.name)
+		}
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ",")
+}
+
+// Attrs are a file's attributes, as far as they were read. Zero fields
+// were not read and are not applied.
+type Attrs struct {
+	Mode       fs.FileMode
+	ModTime    time.Time
+	AccessTime time.Time
+	// Xattrs maps names in the user namespace to values.
+	Xattrs map[string][]byte
+	// ACL is the access ACL in Linux's system.posix_acl_access encoding.
+	ACL []byte
+}
+
+// aclAttr is where Linux keeps a file's POSIX access ACL.
+const aclAttr = "system.posix_acl_access"
+
+// Read returns the attributes of the file at path that set selects. When
+// some cannot be read, the error says which and Attrs holds the rest.
+func Read(path string, set Set) (Attrs, error) {
+	var attrs Attrs
+	info, err := os.Stat(path)
+	if err != nil {
+		return attrs, err
+	}
+
+	if set&Mode != 0 {
+		attrs.Mode = info.Mode().Perm()
+	}
+	if set&Times != 0 {
+		attrs.ModTime = info.ModTime()
+		attrs.AccessTime = accessTime(info)
+	}
+	if set&(Xattrs|ACLs) == 0 {
+		return attrs, nil
+	}
+
+	names, err := listXattrs(path)
+	if err != nil {
+		return attrs, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	var errs []error
+	for _, name := range names {
+		wanted := (set&Xattrs != 0 && strings.HasPrefix(name, "user.")) ||
+			(set&ACLs != 0 && name == aclAttr)
+		if !wanted {
+			continue
+		}
+
+		value, err := getXattr(path, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", name, err))
+			continue
+		}
+		if name == aclAttr {
+			attrs.ACL = value
+			continue
+		}
+		if attrs.Xattrs == nil {
+			attrs.Xattrs = make(map[string][]byte)
+		}
+		attrs.Xattrs[name] = value
+	}
+	return attrs, errors.Join(errs...)
+}
+
+// Apply sets the attributes in attrs that set selects on the file at
+// path. It applies as many as it can and reports the rest. Times go last,
+// since changing the others does not move them.
+func Apply(path string, attrs Attrs, set Set) error {
+	var errs []error
+
+	if set&Xattrs != 0 {
+		for name, value := range attrs.Xattrs {
+			if !strings.HasPrefix(name, "user.") {
+				errs = append(errs, fmt.Errorf("refusing extended attribute %s", name))
+				continue
+			}
+			if err := setXattr(path, name, value); err != nil {
+				errs = append(errs, fmt.Errorf("failed to set %s: %w", name, err))
+			}
+		}
+	}
+	if set&ACLs != 0 && attrs.ACL != nil {
+		if err := setXattr(path, aclAttr, attrs.ACL); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set the ACL: %w", err))
+		}
+	}
+	if set&Mode != 0 && attrs.Mode != 0 {
+		if err := os.Chmod(path, attrs.Mode.Perm()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if set&Times != 0 && !attrs.ModTime.IsZero() {
+		atime := attrs.AccessTime
+		if atime.IsZero() {
+			atime = attrs.ModTime
+		}
+		if err := os.Chtimes(path, atime, attrs.ModTime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,98 @@
+package fileattr
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseSet(t *testing.T) {
+	for value, want := range map[string]Set{
+		"mode,times":     Default,
+		"all":            All,
+		" XATTRS , acls": Xattrs | ACLs,
+		"none":           0,
+	} {
+		got, err := Parse(value)
+		if err != nil || got != want {
+			t.Errorf("Parse(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	if _, err := Parse("mode,owner"); err == nil {
+		t.Error("unknown attribute accepted")
+	}
+	if got := (Mode | ACLs).String(); got != "mode,acls" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestApplyCopiesModeAndTimes(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "build.sh"), filepath.Join(dir, "received.sh")
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0o600); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	atime := mtime.Add(time.Hour)
+	os.Chmod(src, 0o755)
+	os.Chtimes(src, atime, mtime)
+
+	attrs, err := Read(src, Default)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if err := Apply(dst, attrs, Default); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o755 {
+		t.Errorf("mode = %v, want 0755", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+	if got := accessTime(info); !got.IsZero() && !got.Equal(atime) {
+		t.Errorf("atime = %v, want %v", got, atime)
+	}
+
+	if err := Apply(dst, Attrs{Mode: 0o600}, Times); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if info, _ := os.Stat(dst); runtime.GOOS != "windows" && info.Mode().Perm() != 0o755 {
+		t.Error("mode applied although only times were selected")
+	}
+}
+
+func TestXattrsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.WriteFile(src, nil, 0o644)
+	os.WriteFile(dst, nil, 0o644)
+	if err := setXattr(src, "user.origin", []byte("ci")); err != nil {
+		t.Skipf("no extended attributes here: %v", err)
+	}
+
+	attrs, err := Read(src, Xattrs)
+	if err != nil || string(attrs.Xattrs["user.origin"]) != "ci" {
+		t.Fatalf("read %v, %v", attrs.Xattrs, err)
+	}
+	if err := Apply(dst, attrs, Xattrs); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if value, err := getXattr(dst, "user.origin"); err != nil || string(value) != "ci" {
+		t.Fatalf("received attribute = %q, %v", value, err)
+	}
+
+	attrs.Xattrs = map[string][]byte{"security.selinux": []byte("x")}
+	if err := Apply(dst, attrs, Xattrs); err == nil {
+		t.Fatal("attribute outside the user namespace applied")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fileattr
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errNoXattrs = errors.New("extended attributes and ACLs are not supported on " + runtime.GOOS)
+
+func listXattrs(string) ([]string, error)     { return nil, errNoXattrs }
+func getXattr(string, string) ([]byte, error) { return nil, errNoXattrs }
+func setXattr(string, string, []byte) error   { return errNoXattrs }
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// maxHistoryEntries bounds the saved history; the addresses with the
+// weakest track record are forgotten first.
+const maxHistoryEntries = 512
+
+// candidateHistory remembers which peer addresses connected before, so a
+// later race tries the known-good path first.
+type candidateHistory struct {
+	mu     sync.Mutex
+	scores map[string]int
+	// path is where the scores are saved after every race; empty keeps
+	// them for this process only.
+	path string
+}
+
+var history = &candidateHistory{scores: make(map[string]int)}
+
+// LoadCandidateHistory keeps candidate scores in path, starting from those
+// saved by earlier runs, so a CLI that runs once per transfer still
+// prefers the addresses that worked last time. A missing file starts an
+// empty history.
+func LoadCandidateHistory(path string) error {
+	scores := make(map[string]int)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read candidate history: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &scores); err != nil {
+			return fmt.Errorf("failed to parse candidate history %s: %w", path, err)
+		}
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	history.scores, history.path = scores, path
+	return nil
+}
+
+func (h *candidateHistory) score(addr string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.scores[addr]
+}
+
+func (h *candidateHistory) record(addr string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ok {
+		h.scores[addr] += 2
+	} else {
+		h.scores[addr]--
+	}
+
+	if h.path != "" {
+		if err := h.save(); err != nil {
+			log.Printf("Failed to save candidate history: %v", err)
+		}
+	}
+}
+
+// save writes the scores to h.path, replacing the file atomically so a
+// concurrent run never reads half of it. h.mu must be held.
+func (h *candidateHistory) save() error {
+	if len(h.scores) > maxHistoryEntries {
+		addrs := make([]string, 0, len(h.scores))
+		for addr := range h.scores {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return abs(h.scores[addrs[i]]) < abs(h.scores[addrs[j]])
+		})
+		for _, addr := range addrs[:len(addrs)-maxHistoryEntries] {
+			delete(h.scores, addr)
+		}
+	}
+
+	data, err := json.Marshal(h.scores)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o700); err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// linkLocalZones lists the interfaces an IPv6 link-local address can be
+// reached through. A peer's zone names its own interface, which means
+// nothing here, so link-local candidates are retried on every local zone.
+var linkLocalZones = defaultLinkLocalZones
+
+func defaultLinkLocalZones() []string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var zones []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 ||
+			isVirtualInterface(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				zones = append(zones, iface.Name)
+				break
+			}
+		}
+	}
+	return zones
+}
+
+// ExpandLinkLocal qualifies each IPv6 link-local address with every local
+// interface zone, replacing any zone it came with, so the result can be
+// dialed. Other addresses are passed through.
+func ExpandLinkLocal(addrs []string) []string {
+	var zones []string
+	var expanded []string
+	seen := make(map[string]bool)
+
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			expanded = append(expanded, addr)
+		}
+	}
+
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(host)
+		if err != nil || !ip.Is6() || !ip.IsLinkLocalUnicast() {
+			add(addr)
+			continue
+		}
+
+		if zones == nil {
+			zones = linkLocalZones()
+		}
+		for _, zone := range zones {
+			add(net.JoinHostPort(ip.WithZone(zone).String(), port))
+		}
+	}
+
+	return expanded
+}
+
+func isIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Is6() && !ip.Is4In6()
+}
+
+// orderCandidates sorts addresses for staggered dialing as in RFC 8305:
+// each family is ordered by past success, then the families are
+// interleaved starting with IPv6 unless IPv4 has the better track record.
+func orderCandidates(addrs []string) []string {
+	var v6, v4 []string
+	for _, addr := range ExpandLinkLocal(addrs) {
+		if isIPv6(addr) {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+
+	byScore := func(list []string) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return history.score(list[i]) > history.score(list[j])
+		})
+	}
+	byScore(v6)
+	byScore(v4)
+
+	first, second := v6, v4
+	if len(v6) == 0 || (len(v4) > 0 && history.score(v4[0]) > history.score(v6[0])) {
+		first, second = v4, v6
+	}
+
+	ordered := make([]string, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
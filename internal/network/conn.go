@@ -0,0 +1,74 @@
+package network
+
+import (
+	"net"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+// MessageConn is a connection carrying framed protocol messages. The
+// transfer engine and the signalling server only read and write whole
+// messages, so a transport that frames messages itself (a WebSocket, a
+// QUIC stream, a data channel) implements this rather than pretending to
+// be a byte stream.
+type MessageConn interface {
+	// ReadMessage reads the next message, copying its payload into buf.
+	ReadMessage(buf []byte) (opCode byte, n int, err error)
+	// WriteMessage sends one message built by protocol.MakeMessage. It is
+	// safe to call from several goroutines; messages are not interleaved.
+	WriteMessage(msg []byte) error
+
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// MessageListener accepts the MessageConns of one transport.
+type MessageListener interface {
+	Accept() (MessageConn, error)
+	Addr() net.Addr
+	Close() error
+}
+
+// streamConn frames messages over a byte stream such as TCP.
+type streamConn struct {
+	net.Conn
+}
+
+// NewStreamConn carries messages over conn using the protocol's
+// [op][len][payload] framing.
+func NewStreamConn(conn net.Conn) MessageConn {
+	return streamConn{conn}
+}
+
+func (c streamConn) ReadMessage(buf []byte) (byte, int, error) {
+	return protocol.ReadMessage(c.Conn, buf)
+}
+
+func (c streamConn) WriteMessage(msg []byte) error {
+	_, err := c.Conn.Write(msg)
+	return err
+}
+
+type streamListener struct {
+	net.Listener
+}
+
+// NewStreamListener accepts byte stream connections from listener as
+// MessageConns.
+func NewStreamListener(listener net.Listener) MessageListener {
+	return streamListener{listener}
+}
+
+func (l streamListener) Accept() (MessageConn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(conn), nil
+}
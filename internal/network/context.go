@@ -0,0 +1,33 @@
+package network
+
+import (
+	"context"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, which makes blocked I/O return
+// at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// deadlineConn is the part of net.Conn and net.PacketConn that
+// WatchContext needs.
+type deadlineConn interface {
+	SetDeadline(t time.Time) error
+}
+
+// WatchContext maps ctx onto conn: ctx's deadline becomes the connection
+// deadline, and cancelling ctx makes blocked reads and writes return. The
+// returned stop clears the deadline again unless ctx already fired.
+func WatchContext(ctx context.Context, conn deadlineConn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopAfter := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	return func() {
+		if stopAfter() {
+			conn.SetDeadline(time.Time{})
+		}
+	}
+}
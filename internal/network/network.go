@@ -1,85 +1,120 @@
 package network
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/pion/stun"
 )
 
-type ConnType string
-
 const (
-	TCPConn     ConnType = "tcp"
-	WEBRTCConn  ConnType = "webrtc"
-	dialTimeout          = 2 * time.Second
-	raceTimeout          = 3 * time.Second
-)
-
-func PublicAddr() (string, error) {
-	u, err := stun.ParseURI("stun:stun.l.google.com:19302")
-	if err != nil {
-		return "", err
-	}
-
-	c, err := stun.DialURI(u, &stun.DialConfig{})
-	if err != nil {
-		return "", err
-	}
+	dialTimeout = 2 * time.Second
+	raceTimeout = 3 * time.Second
 
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-	ip := ""
-	if err := c.Do(message, func(res stun.Event) {
-		if res.Error != nil {
-			panic(res.Error)
-		}
+	// connectionAttemptDelay is the stagger between dial attempts
+	// recommended by RFC 8305.
+	connectionAttemptDelay = 250 * time.Millisecond
+)
 
-		var xorAddr stun.XORMappedAddress
-		if err := xorAddr.GetFrom(res.Message); err != nil {
-			panic(err)
+// RaceConnections dials the candidates Happy Eyeballs style over every
+// registered transport: attempts start connectionAttemptDelay apart (sooner
+// if the previous one fails) in the order chosen by orderCandidates, each
+// address trying the transports in registration order, and the first to
+// connect wins. The race gives up after raceTimeout or when parent is done.
+func RaceConnections(parent context.Context,
+	localAddrs []string) (peerConn MessageConn, transport Transport, err error) {
+	var candidates []candidate
+	registered := Transports()
+	for _, addr := range orderCandidates(localAddrs) {
+		for _, t := range registered {
+			candidates = append(candidates, candidate{addr: addr, transport: t})
 		}
-		ip = net.JoinHostPort(xorAddr.IP.String(), strconv.Itoa(xorAddr.Port))
-
-	}); err != nil {
-		return ip, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no addresses to try")
 	}
 
-	return ip, nil
-}
+	ctx, cancel := context.WithTimeout(parent, raceTimeout)
+	defer cancel()
 
-func RaceConnections(localAddrs []string) (peerConn net.Conn, connType ConnType, err error) {
+	results := make(chan dialAttempt, len(candidates))
+	next, inFlight := 0, 0
 
-	if len(localAddrs) == 0 {
-		return nil, "", fmt.Errorf("no addresses to try")
+	start := func() {
+		cand := candidates[next]
+		next++
+		inFlight++
+		go func() {
+			conn, err := cand.transport.Dial(ctx, cand.addr)
+			results <- dialAttempt{conn: conn, candidate: cand, err: err}
+		}()
 	}
 
-	connChan := make(chan net.Conn, 1)
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	for inFlight > 0 {
+		select {
+		case result := <-results:
+			inFlight--
+			if result.err != nil {
+				if ctx.Err() == nil {
+					history.record(result.addr, false)
+				}
+				if next < len(candidates) {
+					start()
+					timer.Reset(connectionAttemptDelay)
+				}
+				continue
+			}
 
-	for _, addr := range localAddrs {
-		go func(address string) {
-			conn, err := net.DialTimeout("tcp", address,
-				dialTimeout)
-			if err != nil {
-				return
+			history.record(result.addr, true)
+			cancel()
+			go closeLosers(results, inFlight)
+
+			log.Printf("Connected to %s over %s (attempt %d of %d candidates)",
+				result.addr, result.transport.Name(), next, len(candidates))
+			return result.conn, result.transport, nil
+		case <-timer.C:
+			if next < len(candidates) {
+				start()
+				timer.Reset(connectionAttemptDelay)
 			}
-			select {
-			case connChan <- conn:
-			default:
-				conn.Close()
+		case <-ctx.Done():
+			go closeLosers(results, inFlight)
+			if err := parent.Err(); err != nil {
+				return nil, nil, err
 			}
-		}(addr)
+			return nil, nil, fmt.Errorf("connection timeout: peer not reachable")
+		}
 	}
 
-	select {
-	case peerConn = <-connChan:
-	case <-time.After(raceTimeout):
-		return nil, "", fmt.Errorf("connection timeout: peer not reachable")
-	}
+	return nil, nil, fmt.Errorf("peer not reachable on any of %d addresses", len(candidates))
+}
+
+// candidate is one address to dial over one transport.
+type candidate struct {
+	addr      string
+	transport Transport
+}
 
-	return peerConn, TCPConn, nil
+type dialAttempt struct {
+	candidate
+	conn MessageConn
+	err  error
+}
+
+// closeLosers waits for the attempts still in flight when the race ended and
+// closes any that connected late.
+func closeLosers(results chan dialAttempt, inFlight int) {
+	for range inFlight {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
 }
 
 func LocalAddresses(port string) (localAddrs []string,
@@ -115,13 +150,21 @@ func LocalAddresses(port string) (localAddrs []string,
 
 			ip := ipNet.IP
 
-			if ip.IsLoopback() || ip.IsMulticast() ||
-				ip.IsLinkLocalUnicast() {
+			if ip.IsLoopback() || ip.IsMulticast() {
 				continue
 			}
 
-			localAddrs = append(localAddrs, net.JoinHostPort(ip.String(),
-				port))
+			host := ip.String()
+			if ip.IsLinkLocalUnicast() {
+				// IPv4 link-local is rarely routable, but IPv6 link-local
+				// always exists on a LAN and needs its zone to be dialed.
+				if ip.To4() != nil {
+					continue
+				}
+				host += "%" + iface.Name
+			}
+
+			localAddrs = append(localAddrs, net.JoinHostPort(host, port))
 		}
 	}
 
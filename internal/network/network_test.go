@@ -1,14 +1,284 @@
 package network
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/pion/stun"
 )
 
-func TestPublicIp(t *testing.T) {
-	ip, err := PublicAddr()
+// fakeSTUNServer answers binding requests on localhost with the sender's
+// address, shifted by portOffset to imitate the per-destination mappings of
+// a symmetric NAT.
+func fakeSTUNServer(t *testing.T, portOffset int) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			request := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if err := request.Decode(); err != nil {
+				continue
+			}
+
+			response, err := stun.Build(
+				stun.NewTransactionIDSetter(request.TransactionID),
+				stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port + portOffset},
+			)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(response.Raw, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestPublicAddrEndpointIndependent(t *testing.T) {
+	servers := []string{fakeSTUNServer(t, 0), "stun:" + fakeSTUNServer(t, 0)}
+
+	addr, natType, err := PublicAddr(context.Background(), servers)
+	if err != nil {
+		t.Fatalf("PublicAddr failed: %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Errorf("public addr = %s, want a 127.0.0.1 mapping", addr)
+	}
+	if natType != NATEndpointIndependent {
+		t.Errorf("nat type = %s, want %s", natType, NATEndpointIndependent)
+	}
+}
+
+func TestPublicAddrSymmetric(t *testing.T) {
+	servers := []string{fakeSTUNServer(t, 0), fakeSTUNServer(t, 1)}
+
+	_, natType, err := PublicAddr(context.Background(), servers)
+	if err != nil {
+		t.Fatalf("PublicAddr failed: %v", err)
+	}
+	if natType != NATSymmetric {
+		t.Errorf("nat type = %s, want %s", natType, NATSymmetric)
+	}
+}
+
+func TestPublicAddrUnreachable(t *testing.T) {
+	stunTimeout = 100 * time.Millisecond
+	defer func() { stunTimeout = 2 * time.Second }()
+
+	// Nothing listens here, so the query must time out instead of hanging
+	// or panicking.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
 	if err != nil {
-		t.Fatalf("Failed to get public IP: %v", err)
+		t.Fatalf("failed to listen: %v", err)
+	}
+	silent := conn.LocalAddr().String()
+	conn.Close()
+
+	if _, _, err := PublicAddr(context.Background(), []string{silent}); err == nil {
+		t.Error("expected an error when no STUN server answers")
+	}
+	if _, _, err := PublicAddr(context.Background(), nil); err != ErrNoSTUNServers {
+		t.Errorf("err = %v, want ErrNoSTUNServers", err)
+	}
+}
+
+func TestOrderCandidatesPrefersIPv6AndHistory(t *testing.T) {
+	defer func() { history = &candidateHistory{scores: make(map[string]int)} }()
+
+	addrs := []string{"10.0.0.1:2502", "10.0.0.2:2502", "[2001:db8::1]:2502"}
+
+	got := orderCandidates(addrs)
+	want := []string{"[2001:db8::1]:2502", "10.0.0.1:2502", "10.0.0.2:2502"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+
+	history.record("10.0.0.2:2502", true)
+	got = orderCandidates(addrs)
+	want = []string{"10.0.0.2:2502", "[2001:db8::1]:2502", "10.0.0.1:2502"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("order after success = %v, want %v", got, want)
+	}
+}
+
+func TestCandidateHistoryPersists(t *testing.T) {
+	defer func() { history = &candidateHistory{scores: make(map[string]int)} }()
+	path := filepath.Join(t.TempDir(), "kd", "candidates.json")
+
+	if err := LoadCandidateHistory(path); err != nil {
+		t.Fatalf("failed to start history: %v", err)
+	}
+	history.record("10.0.0.2:2502", true)
+	history.record("10.0.0.3:2502", false)
+
+	// A later run starts from what this one learned.
+	history = &candidateHistory{scores: make(map[string]int)}
+	if err := LoadCandidateHistory(path); err != nil {
+		t.Fatalf("failed to reload history: %v", err)
+	}
+	if got := history.score("10.0.0.2:2502"); got != 2 {
+		t.Errorf("reloaded score = %d, want 2", got)
+	}
+	if got := history.score("10.0.0.3:2502"); got != -1 {
+		t.Errorf("reloaded score = %d, want -1", got)
+	}
+}
+
+func TestLinkLocalCandidatesUseLocalZones(t *testing.T) {
+	linkLocalZones = func() []string { return []string{"eth0", "wlan0"} }
+	defer func() { linkLocalZones = defaultLinkLocalZones }()
+
+	got := ExpandLinkLocal([]string{"[fe80::1%en5]:2502", "[fe80::1]:2502"})
+	want := []string{"[fe80::1%eth0]:2502", "[fe80::1%wlan0]:2502"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expanded = %v, want %v", got, want)
+	}
+}
+
+func TestRaceConnectionsSkipsDeadCandidate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	conn, _, err := RaceConnections(context.Background(), []string{deadAddr, listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("race failed: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Errorf("connected to %s, want %s", conn.RemoteAddr(), listener.Addr())
+	}
+	if history.score(deadAddr) >= 0 {
+		t.Errorf("dead candidate score = %d, want negative", history.score(deadAddr))
+	}
+}
+
+// brokenTransport fails every dial, standing in for a transport the peer
+// does not speak.
+type brokenTransport struct{ tcpTransport }
+
+func (brokenTransport) Name() string { return "broken" }
+
+func (brokenTransport) Dial(ctx context.Context, addr string) (MessageConn, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestRaceConnectionsFallsBackAcrossTransports(t *testing.T) {
+	saved := Transports()
+	transports.list = nil
+	t.Cleanup(func() { transports.list = saved })
+	RegisterTransport(brokenTransport{})
+	RegisterTransport(TCP)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, transport, err := RaceConnections(context.Background(),
+		[]string{listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("race failed: %v", err)
+	}
+	defer conn.Close()
+
+	if transport.Name() != "tcp" {
+		t.Errorf("won over %s, want tcp", transport.Name())
+	}
+}
+
+func TestTCPTransportCarriesMessages(t *testing.T) {
+	listener, err := TCP.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		opCode, n, err := conn.ReadMessage(buf)
+		if err != nil {
+			return
+		}
+		msg := make([]byte, protocol.MessageHeaderSize+n)
+		if size, err := protocol.MakeMessage(opCode, buf[:n], msg); err == nil {
+			conn.WriteMessage(msg[:size])
+		}
+	}()
+
+	conn, err := TCP.Dial(context.Background(), listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := make([]byte, 64)
+	n, err := protocol.MakeMessage(protocol.TransferPause, []byte("ping"), msg)
+	if err != nil {
+		t.Fatalf("failed to build message: %v", err)
+	}
+	if err := conn.WriteMessage(msg[:n]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, 64)
+	opCode, n, err := conn.ReadMessage(buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if opCode != protocol.TransferPause || string(buf[:n]) != "ping" {
+		t.Fatalf("echo = %d %q, want %d %q", opCode, buf[:n], protocol.TransferPause, "ping")
 	}
-	fmt.Println(ip)
 }
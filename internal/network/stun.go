@@ -0,0 +1,167 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// NATType describes how the local NAT maps outgoing UDP flows, which
+// decides whether hole punching towards a peer can work.
+type NATType string
+
+const (
+	NATUnknown NATType = "unknown"
+	// NATEndpointIndependent keeps the same public mapping whatever the
+	// destination, so the address learned from STUN is usable by peers.
+	NATEndpointIndependent NATType = "endpoint-independent"
+	// NATSymmetric picks a new public mapping per destination.
+	NATSymmetric NATType = "symmetric"
+)
+
+var ErrNoSTUNServers = errors.New("no STUN servers configured")
+
+var stunTimeout = 2 * time.Second
+
+// PublicAddr asks every STUN server for this host's mapped address from a
+// single local socket. The servers are queried in parallel; comparing the
+// mappings they report tells an endpoint-independent NAT from a symmetric
+// one. The returned address is the one seen by the first server in the list
+// that answered.
+func PublicAddr(ctx context.Context, servers []string) (string, NATType, error) {
+	if len(servers) == 0 {
+		return "", NATUnknown, ErrNoSTUNServers
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", NATUnknown, fmt.Errorf("failed to listen: %w", err)
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(map[[stun.TransactionIDSize]byte]int)
+
+	for i, server := range servers {
+		wg.Add(1)
+		go func(index int, server string) {
+			defer wg.Done()
+
+			addr, err := resolveUDP(ctx, strings.TrimPrefix(server, "stun:"))
+			if err != nil {
+				return
+			}
+
+			message, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			pending[message.TransactionID] = index
+			mu.Unlock()
+
+			if _, err := conn.WriteToUDP(message.Raw, addr); err != nil {
+				mu.Lock()
+				delete(pending, message.TransactionID)
+				mu.Unlock()
+			}
+		}(i, server)
+	}
+	wg.Wait()
+
+	if len(pending) == 0 {
+		return "", NATUnknown, fmt.Errorf("no STUN server could be resolved")
+	}
+
+	mapped := make(map[int]string)
+	ctx, cancel := context.WithTimeout(ctx, stunTimeout)
+	defer cancel()
+	defer WatchContext(ctx, conn)()
+	buf := make([]byte, 1500)
+
+	for len(mapped) < len(pending) {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		message := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := message.Decode(); err != nil {
+			continue
+		}
+
+		index, ok := pending[message.TransactionID]
+		if !ok || message.Type != stun.BindingSuccess {
+			continue
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(message); err != nil {
+			continue
+		}
+		mapped[index] = net.JoinHostPort(xorAddr.IP.String(), strconv.Itoa(xorAddr.Port))
+	}
+
+	if len(mapped) == 0 {
+		if err := context.Cause(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return "", NATUnknown, err
+		}
+		return "", NATUnknown, fmt.Errorf("no STUN server answered within %s", stunTimeout)
+	}
+
+	publicAddr := ""
+	for i := range servers {
+		if addr, ok := mapped[i]; ok {
+			publicAddr = addr
+			break
+		}
+	}
+
+	return publicAddr, classifyNAT(mapped), nil
+}
+
+// resolveUDP is net.ResolveUDPAddr for IPv4 that gives up when ctx is done.
+func resolveUDP(ctx context.Context, hostport string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(port))), nil
+}
+
+func classifyNAT(mapped map[int]string) NATType {
+	if len(mapped) < 2 {
+		return NATUnknown
+	}
+
+	var first string
+	for _, addr := range mapped {
+		if first == "" {
+			first = addr
+			continue
+		}
+		if addr != first {
+			return NATSymmetric
+		}
+	}
+	return NATEndpointIndependent
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+// Transport is one way of reaching a peer. Everything above it works with
+// the MessageConns it dials and accepts, and sizes chunks from
+// MaxMessageSize rather than from the transport's name.
+type Transport interface {
+	// Name identifies the transport in logs and events, e.g. "tcp".
+	Name() string
+
+	Dial(ctx context.Context, addr string) (MessageConn, error)
+	Listen(addr string) (MessageListener, error)
+
+	// MTU is the largest write the transport sends as one packet, and
+	// MaxMessageSize the largest framed message a peer is expected to
+	// buffer, header included.
+	MTU() int
+	MaxMessageSize() int
+
+	// Reliable transports deliver every byte in order, so a transfer can
+	// be striped over several of their connections.
+	Reliable() bool
+}
+
+// TCP is the default transport, registered first.
+var TCP Transport = tcpTransport{}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Name() string { return "tcp" }
+
+func (tcpTransport) Dial(ctx context.Context, addr string) (MessageConn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(conn), nil
+}
+
+func (tcpTransport) Listen(addr string) (MessageListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamListener(listener), nil
+}
+
+// The kernel segments TCP itself; 1500 is the Ethernet MTU it usually
+// ends up using.
+func (tcpTransport) MTU() int            { return 1500 }
+func (tcpTransport) MaxMessageSize() int { return protocol.TotalTCPSize }
+func (tcpTransport) Reliable() bool      { return true }
+
+var transports = struct {
+	mu   sync.RWMutex
+	list []Transport
+}{list: []Transport{TCP}}
+
+// RegisterTransport adds t to the transports RaceConnections tries, after
+// the ones already registered. Registering a name again replaces it.
+func RegisterTransport(t Transport) {
+	transports.mu.Lock()
+	defer transports.mu.Unlock()
+
+	for i, existing := range transports.list {
+		if existing.Name() == t.Name() {
+			transports.list[i] = t
+			return
+		}
+	}
+	transports.list = append(transports.list, t)
+}
+
+// Transports returns the registered transports in the order they are tried.
+func Transports() []Transport {
+	transports.mu.RLock()
+	defer transports.mu.RUnlock()
+	return append([]Transport(nil), transports.list...)
+}
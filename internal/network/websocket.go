@@ -0,0 +1,146 @@
+package network
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn exposes a WebSocket as a net.Conn by treating the binary frames as
+// one continuous byte stream, so NewStreamConn's framing works on it even
+// when a browser splits or merges messages across frames.
+//
+// The transfer engine writes acks and control messages from more than one
+// goroutine, but gorilla allows only one writer at a time, so writes are
+// serialized by writeMu. The write deadline is kept here and handed to
+// gorilla by the writer holding the lock, which lets a canceller move it
+// without waiting for a stuck write.
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+
+	writeMu       sync.Mutex
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+}
+
+func NewWebSocketConn(ws *websocket.Conn) net.Conn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure,
+					websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.deadlineMu.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+	if err := c.ws.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	// Also move the socket's deadline so a write already under way sees it.
+	return c.ws.UnderlyingConn().SetWriteDeadline(t)
+}
+
+// AllowOrigins admits browsers only when the page opening the WebSocket
+// was served from one of origins, such as "http://host:8081". Requests
+// without an Origin header come from programs rather than web pages and
+// are admitted.
+func AllowOrigins(origins ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WebSocketHandler upgrades incoming requests and hands each connection to
+// accept, which owns it until it returns. checkOrigin decides which web
+// pages may connect; nil admits only pages served from the same host.
+func WebSocketHandler(checkOrigin func(r *http.Request) bool,
+	accept func(conn MessageConn)) http.Handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  16 * 1024,
+		WriteBufferSize: 16 * 1024,
+		CheckOrigin:     checkOrigin,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed for %s: %v", r.RemoteAddr, err)
+			return
+		}
+		accept(NewStreamConn(NewWebSocketConn(ws)))
+	})
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketConnCarriesFramedMessages(t *testing.T) {
+	received := make(chan []byte, 2)
+
+	srv := httptest.NewServer(WebSocketHandler(nil, func(conn MessageConn) {
+		defer conn.Close()
+		buf := make([]byte, protocol.TotalTCPSize)
+		for {
+			_, n, err := conn.ReadMessage(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	for _, payload := range []string{"first", "second"} {
+		n, err := protocol.MakeMessage(protocol.FileTransferData, []byte(payload), buf)
+		if err != nil {
+			t.Fatalf("failed to make message: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	ws.Close()
+
+	for _, want := range []string{"first", "second"} {
+		got, ok := <-received
+		if !ok {
+			t.Fatalf("connection closed before %q arrived", want)
+		}
+		if string(got) != want {
+			t.Errorf("payload = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWebSocketHandlerChecksOrigin(t *testing.T) {
+	srv := httptest.NewServer(WebSocketHandler(AllowOrigins("http://ui.example:8081"),
+		func(conn MessageConn) { conn.Close() }))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for origin, want := range map[string]bool{
+		"":                       true,
+		"http://ui.example:8081": true,
+		"https://evil.example":   false,
+		"http://ui.example:9999": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, _, err := websocket.DefaultDialer.Dial(url, header)
+		if got := err == nil; got != want {
+			t.Errorf("origin %q: connected = %v, want %v (%v)", origin, got, want, err)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
+
+func TestWebSocketConnSerializesWriters(t *testing.T) {
+	const writers, perWriter = 8, 50
+
+	srv := httptest.NewServer(WebSocketHandler(nil, func(conn MessageConn) {
+		defer conn.Close()
+		var wg sync.WaitGroup
+		for w := range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 64)
+				for range perWriter {
+					n, _ := protocol.MakeMessage(protocol.ChunkAck,
+						[]byte(fmt.Sprintf("writer-%d", w)), buf)
+					if err := conn.WriteMessage(buf[:n]); err != nil {
+						t.Errorf("writer %d: %v", w, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	conn := NewStreamConn(NewWebSocketConn(ws))
+	defer conn.Close()
+
+	counts := map[string]int{}
+	buf := make([]byte, 64)
+	for range writers * perWriter {
+		opCode, n, err := conn.ReadMessage(buf)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if opCode != protocol.ChunkAck {
+			t.Fatalf("opcode = %d, want ChunkAck", opCode)
+		}
+		counts[string(buf[:n])]++
+	}
+	for w := range writers {
+		if got := counts[fmt.Sprintf("writer-%d", w)]; got != perWriter {
+			t.Errorf("writer %d: got %d messages, want %d", w, got, perWriter)
+		}
+	}
+}
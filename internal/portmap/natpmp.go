@@ -0,0 +1,232 @@
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pmpPort = 5351
+
+	pmpVersion         = 0
+	pmpOpExternalAddr  = 0
+	pmpOpMapTCP        = 2
+	pmpResponseFlag    = 0x80
+	pcpVersion         = 2
+	pcpOpMap           = 1
+	pcpProtocolTCP     = 6
+	pcpRequestSize     = 60
+	pcpNonceSize       = 12
+	resultSuccess      = 0
+	initialRetryDelay  = 250 * time.Millisecond
+	maxRequestAttempts = 3
+)
+
+var errUnsupportedVersion = errors.New("gateway does not support this protocol version")
+
+func dialGateway(gateway string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", gateway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway %q: %w", gateway, err)
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach gateway: %w", err)
+	}
+	return conn, nil
+}
+
+// exchange sends request until a reply accepted by match arrives, doubling
+// the wait between attempts as RFC 6886 and RFC 6887 recommend.
+func exchange(conn *net.UDPConn, request []byte, match func([]byte) bool) ([]byte, error) {
+	buf := make([]byte, 1100)
+	wait := initialRetryDelay
+
+	for range maxRequestAttempts {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("failed to read response: %w", err)
+			}
+			if match(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+		wait *= 2
+	}
+
+	return nil, fmt.Errorf("gateway did not answer")
+}
+
+// natPMP speaks NAT-PMP (RFC 6886).
+type natPMP struct {
+	gateway string
+}
+
+func NewNATPMP(gateway string) Mapper {
+	return &natPMP{gateway: gateway}
+}
+
+func (p *natPMP) Name() string {
+	return "NAT-PMP"
+}
+
+func (p *natPMP) externalIP(conn *net.UDPConn) (net.IP, error) {
+	response, err := exchange(conn, []byte{pmpVersion, pmpOpExternalAddr},
+		func(b []byte) bool {
+			return len(b) >= 12 && b[0] == pmpVersion &&
+				b[1] == pmpResponseFlag|pmpOpExternalAddr
+		})
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != resultSuccess {
+		return nil, fmt.Errorf("external address request failed with result %d", result)
+	}
+	return net.IP(response[8:12]), nil
+}
+
+func (p *natPMP) mapPort(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	conn, err := dialGateway(p.gateway)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer conn.Close()
+
+	request := make([]byte, 12)
+	request[0] = pmpVersion
+	request[1] = pmpOpMapTCP
+	binary.BigEndian.PutUint16(request[4:6], internalPort)
+	binary.BigEndian.PutUint16(request[6:8], externalPort)
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+
+	response, err := exchange(conn, request, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == pmpVersion &&
+			b[1] == pmpResponseFlag|pmpOpMapTCP &&
+			binary.BigEndian.Uint16(b[8:10]) == internalPort
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != resultSuccess {
+		return Lease{}, fmt.Errorf("mapping request failed with result %d", result)
+	}
+
+	lease := Lease{
+		ExternalPort: binary.BigEndian.Uint16(response[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second,
+	}
+	if lifetime == 0 {
+		return lease, nil
+	}
+
+	lease.ExternalIP, err = p.externalIP(conn)
+	if err != nil {
+		return Lease{}, err
+	}
+	return lease, nil
+}
+
+func (p *natPMP) AddMapping(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	return p.mapPort(internalPort, externalPort, lifetime)
+}
+
+func (p *natPMP) DeleteMapping(internalPort, externalPort uint16) error {
+	// RFC 6886 deletes with a zero lifetime and zero external port.
+	_, err := p.mapPort(internalPort, 0, 0)
+	return err
+}
+
+// pcp speaks the Port Control Protocol (RFC 6887). Renewals and the delete
+// reuse the nonce of the original request, as the gateway requires.
+type pcp struct {
+	gateway string
+	nonce   [pcpNonceSize]byte
+}
+
+func NewPCP(gateway string) Mapper {
+	p := &pcp{gateway: gateway}
+	rand.Read(p.nonce[:])
+	return p
+}
+
+func (p *pcp) Name() string {
+	return "PCP"
+}
+
+func (p *pcp) mapPort(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	conn, err := dialGateway(p.gateway)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer conn.Close()
+
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP.To16()
+
+	request := make([]byte, pcpRequestSize)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:8], uint32(lifetime/time.Second))
+	copy(request[8:24], clientIP)
+	copy(request[24:36], p.nonce[:])
+	request[36] = pcpProtocolTCP
+	binary.BigEndian.PutUint16(request[40:42], internalPort)
+	binary.BigEndian.PutUint16(request[42:44], externalPort)
+	copy(request[44:60], net.IPv4zero.To16())
+
+	response, err := exchange(conn, request, func(b []byte) bool {
+		if len(b) >= 4 && b[0] == pmpVersion {
+			return true // a NAT-PMP-only gateway rejecting the version
+		}
+		return len(b) >= pcpRequestSize && b[0] == pcpVersion &&
+			b[1] == pmpResponseFlag|pcpOpMap && bytes.Equal(b[24:36], p.nonce[:])
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	if response[0] != pcpVersion {
+		return Lease{}, errUnsupportedVersion
+	}
+	if result := response[3]; result != resultSuccess {
+		return Lease{}, fmt.Errorf("mapping request failed with result %d", result)
+	}
+
+	externalIP := net.IP(response[44:60])
+	if ip4 := externalIP.To4(); ip4 != nil {
+		externalIP = ip4
+	}
+
+	return Lease{
+		ExternalIP:   externalIP,
+		ExternalPort: binary.BigEndian.Uint16(response[42:44]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second,
+	}, nil
+}
+
+func (p *pcp) AddMapping(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	return p.mapPort(internalPort, externalPort, lifetime)
+}
+
+func (p *pcp) DeleteMapping(internalPort, externalPort uint16) error {
+	_, err := p.mapPort(internalPort, externalPort, 0)
+	return err
+}
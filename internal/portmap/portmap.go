@@ -0,0 +1,162 @@
+// Package portmap asks the local gateway to forward a TCP port to this host
+// using PCP, NAT-PMP or UPnP-IGD, and keeps the mapping alive.
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrNoGateway = errors.New("no gateway supports port mapping")
+
+// Lease is a mapping granted by a gateway.
+type Lease struct {
+	ExternalIP   net.IP
+	ExternalPort uint16
+	Lifetime     time.Duration
+}
+
+// Addr returns the external host:port peers can dial.
+func (l Lease) Addr() string {
+	return net.JoinHostPort(l.ExternalIP.String(), strconv.Itoa(int(l.ExternalPort)))
+}
+
+// Mapper is one port mapping protocol spoken to one gateway.
+type Mapper interface {
+	Name() string
+	// AddMapping creates or renews the TCP mapping for internalPort,
+	// asking for externalPort (0 lets the gateway choose).
+	AddMapping(internalPort, externalPort uint16, lifetime time.Duration) (Lease, error)
+	DeleteMapping(internalPort, externalPort uint16) error
+}
+
+// DefaultMappers returns the protocols to try, most capable first. PCP and
+// NAT-PMP talk to gateway (the default route when empty); UPnP finds the
+// gateway itself over SSDP.
+func DefaultMappers(gateway string) []Mapper {
+	var mappers []Mapper
+
+	if gateway == "" {
+		ip, err := DefaultGateway()
+		if err != nil {
+			log.Printf("Default gateway unknown, skipping PCP and NAT-PMP: %v", err)
+		} else {
+			gateway = ip.String()
+		}
+	}
+
+	if gateway != "" {
+		addr := net.JoinHostPort(gateway, strconv.Itoa(pmpPort))
+		mappers = append(mappers, NewPCP(addr), NewNATPMP(addr))
+	}
+
+	return append(mappers, &ssdpMapper{})
+}
+
+// Mapping is an active port mapping, renewed in the background until Close.
+type Mapping struct {
+	mapper       Mapper
+	internalPort uint16
+
+	mu    sync.Mutex
+	lease Lease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Map requests a mapping for port from the first mapper that grants one.
+func Map(mappers []Mapper, port uint16, lifetime time.Duration) (*Mapping, error) {
+	var errs []error
+
+	for _, mapper := range mappers {
+		lease, err := mapper.AddMapping(port, port, lifetime)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mapper.Name(), err))
+			continue
+		}
+
+		m := &Mapping{
+			mapper:       mapper,
+			internalPort: port,
+			lease:        lease,
+			stop:         make(chan struct{}),
+			done:         make(chan struct{}),
+		}
+		go m.renew(lifetime)
+
+		log.Printf("Mapped port %d to %s via %s", port, lease.Addr(), mapper.Name())
+		return m, nil
+	}
+
+	return nil, errors.Join(append([]error{ErrNoGateway}, errs...)...)
+}
+
+// ExternalAddr returns the address the gateway forwards to this host.
+func (m *Mapping) ExternalAddr() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lease.Addr()
+}
+
+// renew refreshes the lease at half its lifetime, retrying sooner after a
+// failure so a briefly unreachable gateway does not drop the mapping.
+func (m *Mapping) renew(lifetime time.Duration) {
+	defer close(m.done)
+
+	for {
+		m.mu.Lock()
+		wait := m.lease.Lifetime / 2
+		m.mu.Unlock()
+		if wait <= 0 {
+			wait = lifetime / 2
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-m.stop:
+			return
+		}
+
+		m.mu.Lock()
+		externalPort := m.lease.ExternalPort
+		m.mu.Unlock()
+
+		lease, err := m.mapper.AddMapping(m.internalPort, externalPort, lifetime)
+		if err != nil {
+			log.Printf("Failed to renew port mapping via %s: %v", m.mapper.Name(), err)
+			m.mu.Lock()
+			m.lease.Lifetime /= 2
+			m.mu.Unlock()
+			continue
+		}
+
+		m.mu.Lock()
+		if lease.Addr() != m.lease.Addr() {
+			log.Printf("Gateway moved port mapping from %s to %s", m.lease.Addr(), lease.Addr())
+		}
+		m.lease = lease
+		m.mu.Unlock()
+	}
+}
+
+// Close stops renewing and removes the mapping from the gateway.
+func (m *Mapping) Close() error {
+	close(m.stop)
+	<-m.done
+
+	m.mu.Lock()
+	externalPort := m.lease.ExternalPort
+	m.mu.Unlock()
+
+	if err := m.mapper.DeleteMapping(m.internalPort, externalPort); err != nil {
+		return fmt.Errorf("failed to remove port mapping: %w", err)
+	}
+	log.Printf("Removed port mapping for port %d", m.internalPort)
+	return nil
+}
@@ -0,0 +1,234 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeExternalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// fakePMPGateway answers NAT-PMP on localhost, and PCP too when pcp is set;
+// otherwise it rejects PCP with a version error like older routers.
+type fakePMPGateway struct {
+	conn *net.UDPConn
+	pcp  bool
+
+	mu       sync.Mutex
+	mappings map[uint16]uint32
+	requests int
+}
+
+func newFakePMPGateway(t *testing.T, pcp bool) *fakePMPGateway {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	g := &fakePMPGateway{conn: conn, pcp: pcp, mappings: make(map[uint16]uint32)}
+	go g.serve()
+	return g
+}
+
+func (g *fakePMPGateway) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *fakePMPGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if response := g.handle(buf[:n]); response != nil {
+			g.conn.WriteToUDP(response, from)
+		}
+	}
+}
+
+func (g *fakePMPGateway) handle(request []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case request[0] == pcpVersion && !g.pcp:
+		response := make([]byte, 8)
+		response[1] = pmpResponseFlag | request[1]
+		binary.BigEndian.PutUint16(response[2:4], 1)
+		return response
+
+	case request[0] == pcpVersion:
+		g.requests++
+		lifetime := binary.BigEndian.Uint32(request[4:8])
+		internal := binary.BigEndian.Uint16(request[40:42])
+		g.record(internal, lifetime)
+
+		response := make([]byte, pcpRequestSize)
+		response[0] = pcpVersion
+		response[1] = pmpResponseFlag | pcpOpMap
+		binary.BigEndian.PutUint32(response[4:8], lifetime)
+		copy(response[24:44], request[24:44])
+		binary.BigEndian.PutUint16(response[42:44], internal+10000)
+		copy(response[44:60], fakeExternalIP.To16())
+		return response
+
+	case request[1] == pmpOpExternalAddr:
+		response := make([]byte, 12)
+		response[1] = pmpResponseFlag | pmpOpExternalAddr
+		copy(response[8:12], fakeExternalIP)
+		return response
+
+	case request[1] == pmpOpMapTCP:
+		g.requests++
+		internal := binary.BigEndian.Uint16(request[4:6])
+		lifetime := binary.BigEndian.Uint32(request[8:12])
+		g.record(internal, lifetime)
+
+		response := make([]byte, 16)
+		response[1] = pmpResponseFlag | pmpOpMapTCP
+		binary.BigEndian.PutUint16(response[8:10], internal)
+		binary.BigEndian.PutUint16(response[10:12], internal+10000)
+		binary.BigEndian.PutUint32(response[12:16], lifetime)
+		return response
+	}
+	return nil
+}
+
+func (g *fakePMPGateway) record(port uint16, lifetime uint32) {
+	if lifetime == 0 {
+		delete(g.mappings, port)
+		return
+	}
+	g.mappings[port] = lifetime
+}
+
+func (g *fakePMPGateway) mapped(port uint16) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.mappings[port]
+	return ok
+}
+
+func TestMapFallsBackFromPCPToNATPMP(t *testing.T) {
+	gateway := newFakePMPGateway(t, false)
+
+	mapping, err := Map([]Mapper{NewPCP(gateway.addr()), NewNATPMP(gateway.addr())},
+		2502, time.Hour)
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+
+	if got := mapping.ExternalAddr(); got != "203.0.113.7:12502" {
+		t.Errorf("external addr = %s, want 203.0.113.7:12502", got)
+	}
+	if !gateway.mapped(2502) {
+		t.Fatal("gateway has no mapping for 2502")
+	}
+
+	if err := mapping.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if gateway.mapped(2502) {
+		t.Error("mapping still present after Close")
+	}
+}
+
+func TestPCPMappingRenews(t *testing.T) {
+	gateway := newFakePMPGateway(t, true)
+
+	mapping, err := Map([]Mapper{NewPCP(gateway.addr())}, 2502, time.Second)
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	defer mapping.Close()
+
+	if got := mapping.ExternalAddr(); got != "203.0.113.7:12502" {
+		t.Errorf("external addr = %s, want 203.0.113.7:12502", got)
+	}
+
+	time.Sleep(800 * time.Millisecond)
+
+	gateway.mu.Lock()
+	requests := gateway.requests
+	gateway.mu.Unlock()
+	if requests < 2 {
+		t.Errorf("gateway saw %d map requests, want a renewal", requests)
+	}
+}
+
+func TestUPnPMapping(t *testing.T) {
+	var mu sync.Mutex
+	actions := map[string]string{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceList><device>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList></device></deviceList>
+</device></root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		action := r.Header.Get("SOAPAction")
+		action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		actions[action] = string(body)
+		mu.Unlock()
+
+		if action == "GetExternalIPAddress" {
+			io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mapper, err := NewUPnP(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("NewUPnP failed: %v", err)
+	}
+
+	mapping, err := Map([]Mapper{mapper}, 2502, time.Hour)
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	if got := mapping.ExternalAddr(); got != "203.0.113.7:2502" {
+		t.Errorf("external addr = %s, want 203.0.113.7:2502", got)
+	}
+
+	if err := mapping.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	add := actions["AddPortMapping"]
+	if !strings.Contains(add, "<NewInternalPort>2502</NewInternalPort>") ||
+		!strings.Contains(add, "<NewInternalClient>127.0.0.1</NewInternalClient>") {
+		t.Errorf("unexpected AddPortMapping request: %s", add)
+	}
+	if _, ok := actions["DeletePortMapping"]; !ok {
+		t.Error("mapping was not deleted on Close")
+	}
+}
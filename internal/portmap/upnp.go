@@ -0,0 +1,350 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ssdpTimeout     = 2 * time.Second
+	upnpHTTPTimeout = 5 * time.Second
+	upnpDescription = "KDTransfer"
+
+	// errOnlyPermanentLeases is returned by IGDs that refuse timed leases.
+	errOnlyPermanentLeases = 725
+)
+
+var (
+	ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+	wanServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+// upnp drives the WAN connection service of an Internet Gateway Device.
+type upnp struct {
+	client      *http.Client
+	serviceType string
+	controlURL  string
+	internalIP  string
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpRoot struct {
+	Device upnpDevice `xml:"device"`
+}
+
+func (d upnpDevice) findService(serviceType string) (upnpService, bool) {
+	for _, service := range d.Services {
+		if service.ServiceType == serviceType {
+			return service, true
+		}
+	}
+	for _, child := range d.Devices {
+		if service, ok := child.findService(serviceType); ok {
+			return service, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// NewUPnP reads the device description at location and binds to its WAN
+// connection service.
+func NewUPnP(location string) (Mapper, error) {
+	client := &http.Client{Timeout: upnpHTTPTimeout}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device location: %w", err)
+	}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device description: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, fmt.Errorf("failed to parse device description: %w", err)
+	}
+
+	for _, serviceType := range wanServiceTypes {
+		service, ok := root.Device.findService(serviceType)
+		if !ok {
+			continue
+		}
+
+		control, err := base.Parse(service.ControlURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid control url: %w", err)
+		}
+
+		internalIP, err := localIPFor(base.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		return &upnp{
+			client:      client,
+			serviceType: serviceType,
+			controlURL:  control.String(),
+			internalIP:  internalIP,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("device has no WAN connection service")
+}
+
+// localIPFor returns the local address the kernel would use to reach host,
+// which is what the gateway must forward to.
+func localIPFor(host string) (string, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to find route to gateway: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func (u *upnp) Name() string {
+	return "UPnP-IGD"
+}
+
+type soapError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *soapError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+// call invokes a SOAP action and returns the named output arguments.
+func (u *upnp) call(action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", action, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fault := &soapError{}
+		if xml.Unmarshal(data, fault) == nil && fault.Code != 0 {
+			return nil, fault
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+
+	return soapOutputs(data)
+}
+
+// soapOutputs collects the leaf elements of a SOAP response by local name.
+func soapOutputs(data []byte) (map[string]string, error) {
+	outputs := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var current string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return outputs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse soap response: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+		case xml.CharData:
+			if current != "" {
+				outputs[current] += string(t)
+			}
+		case xml.EndElement:
+			current = ""
+		}
+	}
+}
+
+func (u *upnp) AddMapping(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+
+	add := func(lease time.Duration) error {
+		_, err := u.call("AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(externalPort))},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(int(internalPort))},
+			{"NewInternalClient", u.internalIP},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+
+	// Permanent leases are still renewed on the same schedule, which is
+	// harmless, and removed on exit like timed ones.
+	err := add(lifetime)
+	if fault, ok := err.(*soapError); ok && fault.Code == errOnlyPermanentLeases {
+		err = add(0)
+	}
+	if err != nil {
+		return Lease{}, err
+	}
+
+	outputs, err := u.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return Lease{}, err
+	}
+	externalIP := net.ParseIP(strings.TrimSpace(outputs["NewExternalIPAddress"]))
+	if externalIP == nil {
+		return Lease{}, fmt.Errorf("gateway reported no external address")
+	}
+
+	return Lease{ExternalIP: externalIP, ExternalPort: externalPort, Lifetime: lifetime}, nil
+}
+
+func (u *upnp) DeleteMapping(internalPort, externalPort uint16) error {
+	_, err := u.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// DiscoverUPnP searches the LAN for an Internet Gateway Device over SSDP.
+func DiscoverUPnP() (Mapper, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssdp socket: %w", err)
+	}
+	defer conn.Close()
+
+	for _, serviceType := range wanServiceTypes {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 1\r\n" +
+			"ST: " + serviceType + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(search), ssdpGroup); err != nil {
+			return nil, fmt.Errorf("failed to send ssdp search: %w", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway found")
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		mapper, err := NewUPnP(location)
+		if err != nil {
+			continue
+		}
+		return mapper, nil
+	}
+}
+
+// ssdpMapper defers SSDP discovery until a mapping is first requested, so
+// gateways that answer PCP or NAT-PMP never wait on it.
+type ssdpMapper struct {
+	once   sync.Once
+	mapper Mapper
+	err    error
+}
+
+func (s *ssdpMapper) Name() string {
+	return "UPnP-IGD"
+}
+
+func (s *ssdpMapper) discover() (Mapper, error) {
+	s.once.Do(func() {
+		s.mapper, s.err = DiscoverUPnP()
+	})
+	return s.mapper, s.err
+}
+
+func (s *ssdpMapper) AddMapping(internalPort, externalPort uint16,
+	lifetime time.Duration) (Lease, error) {
+	mapper, err := s.discover()
+	if err != nil {
+		return Lease{}, err
+	}
+	return mapper.AddMapping(internalPort, externalPort, lifetime)
+}
+
+func (s *ssdpMapper) DeleteMapping(internalPort, externalPort uint16) error {
+	mapper, err := s.discover()
+	if err != nil {
+		return err
+	}
+	return mapper.DeleteMapping(internalPort, externalPort)
+}
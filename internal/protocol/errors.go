@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode says why a peer sent Error, TransferCancel or TransferAbort.
+type ErrorCode uint16
+
+const (
+	CodeUnknown ErrorCode = iota
+	CodeBadRequest
+	CodeIncompatible
+	CodeUnknownTransfer
+	CodeDecrypt
+	CodeCorrupt
+	CodeIO
+	CodeCancelled
+	CodeInternal
+	// CodeSuspended ends a transfer paused for too long; the receiver keeps
+	// the partial file so the same file can be resumed later.
+	CodeSuspended
+)
+
+// errorHeaderSize is the 2 byte code plus the 4 byte transfer ID.
+const errorHeaderSize = 6
+
+var (
+	ErrCancelled = errors.New("transfer cancelled")
+	ErrSuspended = errors.New("transfer suspended")
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "unknown"
+	case CodeBadRequest:
+		return "bad request"
+	case CodeIncompatible:
+		return "incompatible"
+	case CodeUnknownTransfer:
+		return "unknown transfer"
+	case CodeDecrypt:
+		return "decryption failed"
+	case CodeCorrupt:
+		return "corrupt data"
+	case CodeIO:
+		return "i/o error"
+	case CodeCancelled:
+		return "cancelled"
+	case CodeInternal:
+		return "internal error"
+	case CodeSuspended:
+		return "suspended"
+	default:
+		return fmt.Sprintf("code(%d)", uint16(c))
+	}
+}
+
+// TransferError is the payload of peer-to-peer Error, TransferCancel and
+// TransferAbort messages. TransferID is zero when no transfer is involved.
+type TransferError struct {
+	Code       ErrorCode
+	TransferID uint32
+	Message    string
+}
+
+func (e *TransferError) Error() string {
+	if e.TransferID == 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("transfer %d: %s: %s", e.TransferID, e.Code, e.Message)
+}
+
+// Is lets callers match codes against the package's sentinel errors.
+func (e *TransferError) Is(target error) bool {
+	switch target {
+	case ErrIncompatible:
+		return e.Code == CodeIncompatible
+	case ErrCancelled:
+		return e.Code == CodeCancelled
+	case ErrSuspended:
+		return e.Code == CodeSuspended
+	}
+	return false
+}
+
+// CreateErrorPayload encodes e as [code 2][transferID 4][message].
+func CreateErrorPayload(e *TransferError) []byte {
+	payload := make([]byte, errorHeaderSize+len(e.Message))
+	binary.BigEndian.PutUint16(payload[0:2], uint16(e.Code))
+	binary.BigEndian.PutUint32(payload[2:6], e.TransferID)
+	copy(payload[errorHeaderSize:], e.Message)
+	return payload
+}
+
+// ParseErrorPayload decodes an error payload. Anything too short to carry
+// the header is kept whole as the message.
+func ParseErrorPayload(payload []byte) *TransferError {
+	if len(payload) < errorHeaderSize {
+		return &TransferError{Code: CodeUnknown, Message: string(payload)}
+	}
+	return &TransferError{
+		Code:       ErrorCode(binary.BigEndian.Uint16(payload[0:2])),
+		TransferID: binary.BigEndian.Uint32(payload[2:6]),
+		Message:    string(payload[errorHeaderSize:]),
+	}
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorPayloadRoundTrip(t *testing.T) {
+	sent := &TransferError{Code: CodeDecrypt, TransferID: 42, Message: "bad tag"}
+	got := ParseErrorPayload(CreateErrorPayload(sent))
+	if *got != *sent {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+
+	if short := ParseErrorPayload([]byte("oops")); short.Code != CodeUnknown ||
+		short.Message != "oops" {
+		t.Fatalf("short payload parsed as %+v", short)
+	}
+}
+
+func TestTransferErrorMatchesSentinels(t *testing.T) {
+	var err error = &TransferError{Code: CodeCancelled, TransferID: 7}
+	if !errors.Is(err, ErrCancelled) || errors.Is(err, ErrIncompatible) {
+		t.Fatalf("cancelled error matched the wrong sentinel")
+	}
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Protocol versions spoken by this build. Bump Version when adding opcodes
+// or payload fields; raise MinVersion only when older peers can no longer
+// be served.
+const (
+	Version    = 6
+	MinVersion = 1
+)
+
+// StreamVersion is the first version that accepts transfers of UnknownSize.
+const StreamVersion = 2
+
+// Cipher names exchanged in Hello.
+const (
+	CipherNone      = "none"
+	CipherAES256GCM = "aes-256-gcm"
+)
+
+var ErrIncompatible = errors.New("incompatible peer")
+
+// Hello is exchanged at the start of every peer connection (PeerHello) and
+// included in registration (ServerHello) so each side knows what the other
+// understands before relying on it.
+type Hello struct {
+	Version      int
+	MinVersion   int
+	Transports   []string `json:",omitempty"`
+	Ciphers      []string `json:",omitempty"`
+	Compression  []string `json:",omitempty"`
+	MaxChunkSize int      `json:",omitempty"`
+	// Salt is sent by passphrase-protected receivers so senders that
+	// found them over mDNS, which does not carry it, can derive the key.
+	Salt string `json:",omitempty"`
+}
+
+// Negotiate returns what both sides support: the highest common version and
+// the intersection of each list, in local order of preference. It fails when
+// there is no common version or, if both sides list ciphers, no common
+// cipher.
+func Negotiate(local, remote Hello) (Hello, error) {
+	version := min(local.Version, remote.Version)
+	if version < local.MinVersion || version < remote.MinVersion {
+		return Hello{}, fmt.Errorf("%w: we speak protocol v%d-v%d, peer speaks v%d-v%d",
+			ErrIncompatible, local.MinVersion, local.Version, remote.MinVersion, remote.Version)
+	}
+
+	agreed := Hello{
+		Version:     version,
+		MinVersion:  max(local.MinVersion, remote.MinVersion),
+		Transports:  intersect(local.Transports, remote.Transports),
+		Ciphers:     intersect(local.Ciphers, remote.Ciphers),
+		Compression: intersect(local.Compression, remote.Compression),
+	}
+
+	if len(local.Ciphers) != 0 && len(remote.Ciphers) != 0 && len(agreed.Ciphers) == 0 {
+		return Hello{}, fmt.Errorf("%w: no common cipher (we offer %v, peer offers %v); "+
+			"both sides must use --passphrase or neither", ErrIncompatible,
+			local.Ciphers, remote.Ciphers)
+	}
+
+	switch {
+	case local.MaxChunkSize == 0:
+		agreed.MaxChunkSize = remote.MaxChunkSize
+	case remote.MaxChunkSize == 0:
+		agreed.MaxChunkSize = local.MaxChunkSize
+	default:
+		agreed.MaxChunkSize = min(local.MaxChunkSize, remote.MaxChunkSize)
+	}
+
+	return agreed, nil
+}
+
+func intersect(local, remote []string) []string {
+	var common []string
+	for _, item := range local {
+		if slices.Contains(remote, item) {
+			common = append(common, item)
+		}
+	}
+	return common
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNegotiateIntersectsCapabilities(t *testing.T) {
+	local := Hello{Version: 3, MinVersion: 1, Ciphers: []string{CipherAES256GCM},
+		Compression: []string{"zstd", "s2"}, MaxChunkSize: 1 << 18}
+	remote := Hello{Version: 2, MinVersion: 2, Ciphers: []string{CipherAES256GCM},
+		Compression: []string{"s2"}, MaxChunkSize: 1 << 14}
+
+	agreed, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Negotiate failed: %v", err)
+	}
+	if agreed.Version != 2 {
+		t.Errorf("version = %d, want 2", agreed.Version)
+	}
+	if !slices.Equal(agreed.Compression, []string{"s2"}) {
+		t.Errorf("compression = %v, want [s2]", agreed.Compression)
+	}
+	if agreed.MaxChunkSize != 1<<14 {
+		t.Errorf("max chunk size = %d, want %d", agreed.MaxChunkSize, 1<<14)
+	}
+}
+
+func TestNegotiateRejectsIncompatiblePeers(t *testing.T) {
+	cases := map[string]Hello{
+		"too old":   {Version: 1, MinVersion: 1, Ciphers: []string{CipherNone}},
+		"no cipher": {Version: 2, MinVersion: 1, Ciphers: []string{CipherAES256GCM}},
+	}
+	local := Hello{Version: 3, MinVersion: 2, Ciphers: []string{CipherNone}}
+
+	for name, remote := range cases {
+		if _, err := Negotiate(local, remote); !errors.Is(err, ErrIncompatible) {
+			t.Errorf("%s: err = %v, want ErrIncompatible", name, err)
+		}
+	}
+}
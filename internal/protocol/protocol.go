@@ -1,10 +1,12 @@
 package protocol
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
-	"net"
+	"math"
 )
 
 // Message operation codes for client-server and peer-to-peer communication
@@ -26,6 +28,44 @@ const (
 	PeerInfoForward // Forward peer info to target
 	Heartbeat       // Keep-alive ping
 	HeartbeatAck    // Keep-alive response
+	PeerSignal      // Relay WebRTC session descriptions and ICE candidates
+
+	// Rooms
+	RoomJoin      // Join a named room
+	RoomLeave     // Leave a named room
+	RoomAck       // Room join/leave acknowledgment
+	RoomLookup    // Request info for every member of a room
+	RoomLookupAck // Room members response
+
+	// Store-and-forward mailbox
+	MailboxPut     // Begin uploading a blob for an offline recipient
+	MailboxList    // List blobs waiting for the caller's identity
+	MailboxListAck // Mailbox listing response
+	MailboxFetch   // Download a stored blob
+	MailboxDelete  // Confirm delivery and delete a stored blob
+	MailboxAck     // Mailbox operation acknowledgment
+
+	// Presence
+	PresenceList    // List visible peers in the caller's team or a room
+	PresenceListAck // Presence listing response
+
+	// Multi-stream transfers
+	FileTransferReady // Receiver is ready for chunks on the extra streams
+
+	// Handshake
+	PeerHello // Protocol version and capabilities, sent by both peers
+
+	// Transfer control
+	TransferCancel // Either side stopped the transfer on purpose
+	TransferAbort  // Either side hit an error it cannot recover from
+
+	// Flow control
+	ChunkAck         // Receiver has written a stream's chunks so far
+	TransferComplete // Receiver has flushed the whole file to disk
+
+	// Pause and resume
+	TransferPause  // Either side asks the sender to stop sending for now
+	TransferResume // Either side lets a paused transfer continue
 )
 
 // Transport buffer sizes
@@ -34,14 +74,29 @@ const (
 	TotalTCPSize    = 256 * 1024 // 256KB - optimal for TCP
 	TotalWebRTCSize = 16 * 1024  // 16KB - WebRTC SCTP limit
 
+	// Mailbox uploads travel over the signalling connection, whose
+	// server-side buffer is 8KB
+	TotalMailboxSize = 8 * 1024
+
 	// Protocol overhead
-	TransferHeaderSize = 8 // 4 bytes transfer ID + 4 bytes chunk index
+	MessageHeaderSize  = 5  // 1 byte opcode + 4 bytes payload length
+	TransferHeaderSize = 8  // 4 bytes transfer ID + 4 bytes chunk index
+	EncryptionOverhead = 28 // AES-GCM nonce + tag
 
 	// Available payload space after headers
 	TCPChunkSize    = TotalTCPSize - TransferHeaderSize    // ~256KB
 	WebRTCChunkSize = TotalWebRTCSize - TransferHeaderSize // ~16KB
+
+	// Mailbox chunks are always encrypted
+	MailboxChunkSize = TotalMailboxSize - MessageHeaderSize -
+		TransferHeaderSize - EncryptionOverhead
 )
 
+// UnknownSize is announced as the file size of a stream whose length is
+// only known once it ends, such as a pipe. Such a transfer announces zero
+// chunks, uses a single stream and ends with a StreamSummary.
+const UnknownSize = math.MaxUint64
+
 type Message struct {
 	OpCode     byte
 	PayloadLen [4]byte
@@ -56,9 +111,17 @@ func PongMessage(buf []byte) (int, error) {
 	return MakeMessage(HeartbeatAck, nil, buf)
 }
 
-func ReadMessage(conn net.Conn, buf []byte) (opCode byte, n int, err error) {
+// ReadMessage reads one framed message from conn. Any reader will do, so
+// connections need not be a net.Conn to carry the protocol.
+func ReadMessage(conn io.Reader, buf []byte) (opCode byte, n int, err error) {
+	return DecodeMessage(conn, buf)
+}
+
+// DecodeMessage reads one framed message from any reader, so transports
+// that are not a net.Conn (e.g. WebSocket frames) can share the framing.
+func DecodeMessage(r io.Reader, buf []byte) (opCode byte, n int, err error) {
 	header := make([]byte, 5)
-	_, err = io.ReadFull(conn, header)
+	_, err = io.ReadFull(r, header)
 	if err != nil {
 		return Error, 0, err
 	}
@@ -71,7 +134,7 @@ func ReadMessage(conn net.Conn, buf []byte) (opCode byte, n int, err error) {
 	}
 
 	if payloadLen > 0 {
-		_, err = io.ReadFull(conn, buf[:payloadLen])
+		_, err = io.ReadFull(r, buf[:payloadLen])
 		if err != nil {
 			return opCode, 0, err
 		}
@@ -154,16 +217,131 @@ func ParseFileTransferDataPayload(payload []byte) (transferID uint32,
 	return transferID, chunkIndex, chunkData
 }
 
+// TransferLayout tells the receiver where each chunk lands in the file and
+// how many connections carry them. Senders that predate it leave it zero.
+type TransferLayout struct {
+	ChunkSize uint32
+	Streams   uint8
+	// Codecs offers compression codecs in the sender's order of
+	// preference; the receiver picks one in FileTransferReady.
+	Codecs []byte
+	// Window is how many chunks each stream may have unacknowledged. When
+	// set, the receiver sends ChunkAck and a final TransferComplete.
+	Window uint16
+}
+
+// ParseFileTransferLayout reads the layout that follows the fields decoded
+// by ParseFileTransferPayload.
+func ParseFileTransferLayout(payload []byte) TransferLayout {
+	if len(payload) < 6 {
+		return TransferLayout{}
+	}
+
+	layoutStart := 6 + int(binary.BigEndian.Uint16(payload[4:6])) + 8 + 4
+	if len(payload) < layoutStart+5 {
+		return TransferLayout{}
+	}
+
+	layout := TransferLayout{
+		ChunkSize: binary.BigEndian.Uint32(payload[layoutStart : layoutStart+4]),
+		Streams:   payload[layoutStart+4],
+	}
+
+	codecsStart := layoutStart + 6
+	if len(payload) >= codecsStart {
+		nCodecs := int(payload[layoutStart+5])
+		if len(payload) >= codecsStart+nCodecs {
+			layout.Codecs = payload[codecsStart : codecsStart+nCodecs]
+		}
+
+		windowStart := codecsStart + nCodecs
+		if len(payload) >= windowStart+2 {
+			layout.Window = binary.BigEndian.Uint16(payload[windowStart : windowStart+2])
+		}
+	}
+
+	return layout
+}
+
+// ContentTypeText marks a transfer as a text message.
+const ContentTypeText = "text/plain; charset=utf-8"
+
+// TransferMeta describes a transfer beyond its name, size and layout. It
+// travels as JSON after the layout, so fields can be added freely; senders
+// that predate it send none.
+type TransferMeta struct {
+	// ContentType is set for typed messages, which the receiver shows
+	// or copies instead of storing as a file.
+	ContentType string `json:",omitempty"`
+
+	// Mode holds the file's permission bits, zero when not sent.
+	Mode uint32 `json:",omitempty"`
+	// ModTime and AccessTime are Unix times in nanoseconds.
+	ModTime    int64 `json:",omitempty"`
+	AccessTime int64 `json:",omitempty"`
+	// Xattrs holds extended attributes in the user namespace, and ACL the
+	// POSIX access ACL in Linux's system.posix_acl_access encoding.
+	Xattrs map[string][]byte `json:",omitempty"`
+	ACL    []byte            `json:",omitempty"`
+
+	// Fingerprint identifies the contents of a file on disk, so a
+	// receiver only resumes a suspended transfer of the same file.
+	Fingerprint string `json:",omitempty"`
+}
+
+// ParseFileTransferMeta reads the metadata that follows the layout.
+func ParseFileTransferMeta(payload []byte) (TransferMeta, error) {
+	var meta TransferMeta
+	if len(payload) < 6 {
+		return meta, nil
+	}
+
+	codecsStart := 6 + int(binary.BigEndian.Uint16(payload[4:6])) + 8 + 4 + 6
+	if len(payload) < codecsStart {
+		return meta, nil
+	}
+	metaStart := codecsStart + int(payload[codecsStart-1]) + 2
+	if len(payload) < metaStart+4 {
+		return meta, nil
+	}
+
+	metaLength := int(binary.BigEndian.Uint32(payload[metaStart : metaStart+4]))
+	if metaLength == 0 {
+		return meta, nil
+	}
+	if len(payload) < metaStart+4+metaLength {
+		return meta, fmt.Errorf("transfer metadata truncated: %d of %d bytes",
+			len(payload)-metaStart-4, metaLength)
+	}
+	if err := json.Unmarshal(payload[metaStart+4:metaStart+4+metaLength], &meta); err != nil {
+		return meta, fmt.Errorf("invalid transfer metadata: %w", err)
+	}
+	return meta, nil
+}
+
 func CreateFileTransferStartPayload(transferID uint32,
-	fileName string, fileSize uint64, nChunks uint32, buf []byte) (int, error) {
+	fileName string, fileSize uint64, nChunks uint32, layout TransferLayout,
+	meta TransferMeta, buf []byte) (int, error) {
 	fileNameBytes := []byte(fileName)
 	fileNameLength := len(fileNameBytes)
 
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode transfer metadata: %w", err)
+	}
+	if string(metaBytes) == "{}" {
+		metaBytes = nil
+	}
+
 	// File transfer payload format:
 	// [transferID (4 bytes)][fileNameLength (2 bytes)]
 	// [fileName (variable length)]
 	// [fileSize (8 bytes)][nChunks (4 bytes)]
-	totalSize := 6 + fileNameLength + 8 + 4
+	// [chunkSize (4 bytes)][streams (1 byte)]
+	// [nCodecs (1 byte)][codecs (nCodecs bytes)][window (2 bytes)]
+	// [metaLength (4 bytes)][meta (JSON, metaLength bytes)]
+	windowEnd := 6 + fileNameLength + 8 + 4 + 5 + 1 + len(layout.Codecs) + 2
+	totalSize := windowEnd + 4 + len(metaBytes)
 
 	if len(buf) < totalSize {
 		return 0, fmt.Errorf("buffer too small for file transfer start payload")
@@ -178,7 +356,17 @@ func CreateFileTransferStartPayload(transferID uint32,
 	nChunksOffset := fileSizeOffset + 8
 
 	binary.BigEndian.PutUint64(buf[fileSizeOffset:nChunksOffset], fileSize)
-	binary.BigEndian.PutUint32(buf[nChunksOffset:totalSize], nChunks)
+	binary.BigEndian.PutUint32(buf[nChunksOffset:nChunksOffset+4], nChunks)
+
+	layoutOffset := nChunksOffset + 4
+	binary.BigEndian.PutUint32(buf[layoutOffset:layoutOffset+4], layout.ChunkSize)
+	buf[layoutOffset+4] = layout.Streams
+	buf[layoutOffset+5] = byte(len(layout.Codecs))
+	copy(buf[layoutOffset+6:windowEnd-2], layout.Codecs)
+	binary.BigEndian.PutUint16(buf[windowEnd-2:windowEnd], layout.Window)
+
+	binary.BigEndian.PutUint32(buf[windowEnd:windowEnd+4], uint32(len(metaBytes)))
+	copy(buf[windowEnd+4:totalSize], metaBytes)
 
 	return totalSize, nil
 }
@@ -199,3 +387,73 @@ func CreateFileTransferDataRequest(transferID uint32, chunkIndex uint32,
 
 	return totalSize, nil
 }
+
+// StreamSummary closes a transfer of UnknownSize: how many chunks and
+// bytes were sent, and the SHA-256 of the bytes in order.
+type StreamSummary struct {
+	Chunks uint32
+	Bytes  uint64
+	SHA256 [sha256.Size]byte
+}
+
+// CreateFileTransferEndPayload encodes the end of a stream:
+// [transferID (4 bytes)], followed for streams of unknown size by
+// [chunks (4 bytes)][bytes (8 bytes)][sha256 (32 bytes)]
+func CreateFileTransferEndPayload(transferID uint32, summary *StreamSummary) []byte {
+	if summary == nil {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, transferID)
+		return payload
+	}
+
+	payload := make([]byte, 16+sha256.Size)
+	binary.BigEndian.PutUint32(payload[0:4], transferID)
+	binary.BigEndian.PutUint32(payload[4:8], summary.Chunks)
+	binary.BigEndian.PutUint64(payload[8:16], summary.Bytes)
+	copy(payload[16:], summary.SHA256[:])
+	return payload
+}
+
+// ParseFileTransferEndPayload returns a nil summary when the sender sent
+// none.
+func ParseFileTransferEndPayload(payload []byte) (transferID uint32,
+	summary *StreamSummary, err error) {
+	if len(payload) < 4 {
+		return 0, nil, fmt.Errorf("transfer end payload too short: %d bytes", len(payload))
+	}
+	transferID = binary.BigEndian.Uint32(payload[0:4])
+	if len(payload) < 16+sha256.Size {
+		return transferID, nil, nil
+	}
+
+	summary = &StreamSummary{
+		Chunks: binary.BigEndian.Uint32(payload[4:8]),
+		Bytes:  binary.BigEndian.Uint64(payload[8:16]),
+	}
+	copy(summary.SHA256[:], payload[16:16+sha256.Size])
+	return transferID, summary, nil
+}
+
+// CreateChunkAckPayload encodes how many chunks, and how many file bytes,
+// the receiver has written from one stream so far:
+// [transferID (4 bytes)][chunks (4 bytes)][bytes (8 bytes)]
+func CreateChunkAckPayload(transferID uint32, chunks uint32, bytes uint64) []byte {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint32(payload[0:4], transferID)
+	binary.BigEndian.PutUint32(payload[4:8], chunks)
+	binary.BigEndian.PutUint64(payload[8:16], bytes)
+	return payload
+}
+
+func ParseChunkAckPayload(payload []byte) (transferID uint32, chunks uint32,
+	bytes uint64, err error) {
+	if len(payload) < 16 {
+		return 0, 0, 0, fmt.Errorf("chunk ack payload too short: %d bytes", len(payload))
+	}
+
+	transferID = binary.BigEndian.Uint32(payload[0:4])
+	chunks = binary.BigEndian.Uint32(payload[4:8])
+	bytes = binary.BigEndian.Uint64(payload[8:16])
+
+	return transferID, chunks, bytes, nil
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import "testing"
+
+func TestFileTransferEndPayloadRoundTrip(t *testing.T) {
+	id, summary, err := ParseFileTransferEndPayload(CreateFileTransferEndPayload(7, nil))
+	if err != nil || id != 7 || summary != nil {
+		t.Fatalf("plain end = %d, %+v, %v", id, summary, err)
+	}
+
+	sent := &StreamSummary{Chunks: 3, Bytes: 1 << 40}
+	sent.SHA256[31] = 0xab
+	id, summary, err = ParseFileTransferEndPayload(CreateFileTransferEndPayload(9, sent))
+	if err != nil || id != 9 || summary == nil || *summary != *sent {
+		t.Fatalf("stream end = %d, %+v, %v", id, summary, err)
+	}
+
+	if _, _, err := ParseFileTransferEndPayload([]byte{1, 2}); err == nil {
+		t.Fatal("truncated end payload accepted")
+	}
+}
+
+func TestFileTransferMetaRoundTrip(t *testing.T) {
+	buf := make([]byte, 512)
+	layout := TransferLayout{ChunkSize: 1024, Streams: 1, Codecs: []byte{1, 2}, Window: 32}
+
+	n, err := CreateFileTransferStartPayload(1, "note.txt", 5, 1, layout,
+		TransferMeta{ContentType: ContentTypeText}, buf)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	meta, err := ParseFileTransferMeta(buf[:n])
+	if err != nil || meta.ContentType != ContentTypeText {
+		t.Fatalf("meta = %+v, %v", meta, err)
+	}
+	if got := ParseFileTransferLayout(buf[:n]); got.Window != 32 || len(got.Codecs) != 2 {
+		t.Fatalf("layout = %+v", got)
+	}
+
+	// Senders that predate metadata stop after the window.
+	n, _ = CreateFileTransferStartPayload(1, "note.txt", 5, 1, layout, TransferMeta{}, buf)
+	if meta, err := ParseFileTransferMeta(buf[:n-4]); err != nil || meta.ContentType != "" {
+		t.Fatalf("meta without section = %+v, %v", meta, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package ratelimit caps outgoing transfer bandwidth with token buckets and
+// shares the cap evenly between concurrent transfers.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// burstWindow is how much traffic a bucket may send back to back after
+// being idle.
+const burstWindow = 100 * time.Millisecond
+
+var units = []struct {
+	suffix string
+	scale  float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+	{"b", 1},
+}
+
+// ParseRate parses a rate such as "20MB/s", "512KiB/s" or "1.5M" into bytes
+// per second. Units are bytes, case-insensitive; "", "0" and "off" mean
+// unlimited and return 0.
+func ParseRate(value string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "/s")
+	if s == "" || s == "0" || s == "off" {
+		return 0, nil
+	}
+
+	scale := 1.0
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, scale = strings.TrimSpace(number), unit.scale
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return int64(number * scale), nil
+}
+
+// FormatRate renders bytes per second the way ParseRate accepts them.
+func FormatRate(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate >= 1e9:
+		return strconv.FormatFloat(float64(rate)/1e9, 'f', -1, 64) + "GB/s"
+	case rate >= 1e6:
+		return strconv.FormatFloat(float64(rate)/1e6, 'f', -1, 64) + "MB/s"
+	case rate >= 1e3:
+		return strconv.FormatFloat(float64(rate)/1e3, 'f', -1, 64) + "KB/s"
+	default:
+		return strconv.FormatInt(rate, 10) + "B/s"
+	}
+}
+
+// bucket is a token bucket whose tokens may go negative: Wait reserves what
+// it needs and sleeps off the debt, so waiters are served in arrival order.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+}
+
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if burst := b.rate * burstWindow.Seconds(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+func (b *bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter holds the total cap for outgoing transfers. Each running transfer
+// opens a Flow and gets an equal slice of the cap, rebalanced whenever a
+// transfer starts or finishes or the cap changes. A nil Limiter never
+// throttles.
+type Limiter struct {
+	mu    sync.Mutex
+	rate  int64
+	flows map[*Flow]struct{}
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, flows: make(map[*Flow]struct{})}
+}
+
+// Rate returns the total cap in bytes per second, 0 when unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the cap for running and future transfers.
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.rebalance()
+}
+
+func (l *Limiter) rebalance() {
+	if len(l.flows) == 0 {
+		return
+	}
+	share := float64(l.rate) / float64(len(l.flows))
+	for flow := range l.flows {
+		flow.bucket.setRate(share)
+	}
+}
+
+// Open registers a transfer. All streams of one transfer share its Flow.
+func (l *Limiter) Open() *Flow {
+	if l == nil {
+		return nil
+	}
+	flow := &Flow{limiter: l}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flows[flow] = struct{}{}
+	l.rebalance()
+	return flow
+}
+
+// Flow is one transfer's share of a Limiter.
+type Flow struct {
+	limiter *Limiter
+	bucket  bucket
+}
+
+// Wait blocks until n more bytes may be sent.
+func (f *Flow) Wait(n int) {
+	if f == nil {
+		return
+	}
+	if delay := f.bucket.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Close returns the transfer's share to the others.
+func (f *Flow) Close() {
+	if f == nil {
+		return
+	}
+	l := f.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.flows, f)
+	l.rebalance()
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"20MB/s":   20_000_000,
+		"512KiB/s": 512 * 1024,
+		"1.5M":     1_500_000,
+		"100":      100,
+		"":         0,
+		"off":      0,
+	}
+	for in, want := range cases {
+		got, err := ParseRate(in)
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseRate(%q) = %d, want %d", in, got, want)
+		}
+	}
+
+	if _, err := ParseRate("fast"); err == nil {
+		t.Error("expected an error for an invalid rate")
+	}
+}
+
+// send pushes chunks through flow until stop closes and reports the total.
+func send(flow *Flow, chunk int, stop <-chan struct{}) int {
+	sent := 0
+	for {
+		select {
+		case <-stop:
+			return sent
+		default:
+		}
+		flow.Wait(chunk)
+		sent += chunk
+	}
+}
+
+func TestConcurrentFlowsShareTheCap(t *testing.T) {
+	const rate = 1 << 20
+	limiter := NewLimiter(rate)
+
+	stop := make(chan struct{})
+	totals := make([]int, 2)
+	var wg sync.WaitGroup
+
+	for i := range totals {
+		flow := limiter.Open()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer flow.Close()
+			totals[i] = send(flow, 16*1024, stop)
+		}()
+	}
+
+	elapsed := 500 * time.Millisecond
+	time.Sleep(elapsed)
+	close(stop)
+	wg.Wait()
+
+	sum := totals[0] + totals[1]
+	if limit := int(rate*elapsed.Seconds()) + 2*rate/10 + 2*16*1024; sum > limit {
+		t.Errorf("sent %d bytes, cap allows about %d", sum, limit)
+	}
+	if totals[0] < sum/3 || totals[1] < sum/3 {
+		t.Errorf("unfair split: %v", totals)
+	}
+}
+
+func TestSetRateAppliesToRunningFlow(t *testing.T) {
+	limiter := NewLimiter(1 << 10)
+	flow := limiter.Open()
+	defer flow.Close()
+
+	limiter.SetRate(0)
+
+	start := time.Now()
+	flow.Wait(1 << 20)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("unlimited flow should not wait")
+	}
+}
@@ -1,6 +1,7 @@
 package signallingserver
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,10 +10,11 @@ import (
 	"time"
 
 	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/network"
 	"github.com/KD0S-02/KDTransfer/internal/protocol"
 )
 
-func (ss *SignallingServer) handleRegister(conn net.Conn, payload []byte) (*Peer, string,
+func (ss *SignallingServer) handleRegister(conn network.MessageConn, payload []byte) (*Peer, string,
 	error) {
 	id := crypto.GenerateID()
 
@@ -21,14 +23,36 @@ func (ss *SignallingServer) handleRegister(conn net.Conn, payload []byte) (*Peer
 		return nil, "", fmt.Errorf("failed parsing register payload: %w", err)
 	}
 
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", fmt.Errorf("failed generating mailbox nonce: %w", err)
+	}
+
+	ack := []byte(id)
+	if peerInfo.Hello != nil {
+		if _, err := protocol.Negotiate(ss.hello(), *peerInfo.Hello); err != nil {
+			rejectConn(conn, err.Error())
+			return nil, "", err
+		}
+
+		ackPayload, err := json.Marshal(RegisterAck{PeerID: id, Hello: ss.hello(),
+			MailboxNonce: nonce})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed encoding register ack: %w", err)
+		}
+		ack = ackPayload
+	}
+
 	user := NewPeer(id, peerInfo)
+	user.mailboxNonce = nonce
 	ss.AddUser(id, user)
 
 	// Start writer goroutine for this peer
 	go func() {
+		defer close(user.writerDone)
 		for msg := range user.Outgoing {
 			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if _, err := conn.Write(msg); err != nil {
+			if err := conn.WriteMessage(msg); err != nil {
 				log.Printf("Write error for peer %s: %v", id, err)
 				return
 			}
@@ -37,7 +61,7 @@ func (ss *SignallingServer) handleRegister(conn net.Conn, payload []byte) (*Peer
 	}()
 
 	// Send registration acknowledgment
-	if err := ss.SendToPeer(user, protocol.ServerAck, []byte(id)); err != nil {
+	if err := ss.SendToPeer(user, protocol.ServerAck, ack); err != nil {
 		log.Printf("Failed sending SERVER_ACK to %s: %v", id, err)
 		ss.RemoveUser(id)
 		return nil, "", fmt.Errorf("failed sending register ack: %w", err)
@@ -47,6 +71,31 @@ func (ss *SignallingServer) handleRegister(conn net.Conn, payload []byte) (*Peer
 	return user, id, nil
 }
 
+// hello describes what this server speaks to registering clients.
+func (ss *SignallingServer) hello() protocol.Hello {
+	transports := []string{"tcp"}
+	if ss.HTTPListener != nil {
+		transports = append(transports, "websocket")
+	}
+	return protocol.Hello{
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Transports: transports,
+	}
+}
+
+// rejectConn tells a client why it is being turned away before any writer
+// goroutine exists for it.
+func rejectConn(conn network.MessageConn, reason string) {
+	buf := make([]byte, protocol.MessageHeaderSize+len(reason))
+	n, err := protocol.MakeMessage(protocol.Error, []byte(reason), buf)
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(buf[:n])
+}
+
 func (ss *SignallingServer) handlePeerLookup(user *Peer, payload []byte) error {
 	var peerLookUp PeerLookUp
 	if err := json.Unmarshal(payload, &peerLookUp); err != nil {
@@ -93,14 +142,54 @@ func (ss *SignallingServer) handlePeerLookup(user *Peer, payload []byte) error {
 	return nil
 }
 
+func (ss *SignallingServer) handlePeerSignal(user *Peer, payload []byte) error {
+	var signal PeerSignal
+	if err := json.Unmarshal(payload, &signal); err != nil {
+		if sendErr := ss.SendToPeer(user, protocol.Error, []byte("invalid request")); sendErr != nil {
+			log.Printf("Failed sending error to user %s: %v", user.ID, sendErr)
+		}
+		return nil
+	}
+
+	peer, found := ss.GetUser(signal.PeerID)
+	if !found {
+		if sendErr := ss.SendToPeer(user, protocol.Error, []byte("peer not found")); sendErr != nil {
+			log.Printf("Failed sending error to user %s: %v", user.ID, sendErr)
+		}
+		return nil
+	}
+
+	signal.PeerID = user.ID
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signal for %s: %w", peer.ID, err)
+	}
+
+	if err := ss.SendToPeer(peer, protocol.PeerSignal, data); err != nil {
+		log.Printf("Warning: failed forwarding signal to peer %s: %v", peer.ID, err)
+	}
+
+	return nil
+}
+
 func (ss *SignallingServer) HandleConnection(conn net.Conn) error {
+	return ss.serveConn(network.NewStreamConn(conn))
+}
+
+// serveConn runs the signalling protocol over any MessageConn, regardless
+// of whether the peer arrived over raw TCP or a WebSocket.
+func (ss *SignallingServer) serveConn(conn network.MessageConn) error {
 	defer conn.Close()
 
 	var userID string
 	var user *Peer
 	var registered bool
+	var upload *mailboxUpload
 
 	defer func() {
+		if upload != nil {
+			upload.Abort()
+		}
 		if registered {
 			ss.RemoveUser(userID)
 			log.Printf("Connection closed for user: %s", userID)
@@ -109,7 +198,7 @@ func (ss *SignallingServer) HandleConnection(conn net.Conn) error {
 
 	for {
 		buf := ss.GetBuffer()
-		opCode, n, err := protocol.ReadMessage(conn, buf)
+		opCode, n, err := conn.ReadMessage(buf)
 
 		if err != nil {
 			ss.PutBuffer(buf)
@@ -148,6 +237,76 @@ func (ss *SignallingServer) HandleConnection(conn net.Conn) error {
 				return fmt.Errorf("peer lookup failed: %w", err)
 			}
 
+		case protocol.PeerSignal:
+			if !registered {
+				return fmt.Errorf("peer signal before registration")
+			}
+
+			if err := ss.handlePeerSignal(user, payload); err != nil {
+				log.Printf("Peer signal error for %s: %v", userID, err)
+				return fmt.Errorf("peer signal failed: %w", err)
+			}
+
+		case protocol.RoomJoin, protocol.RoomLeave:
+			if !registered {
+				return fmt.Errorf("room request before registration")
+			}
+
+			if err := ss.handleRoomMembership(user, opCode, payload); err != nil {
+				log.Printf("Room request error for %s: %v", userID, err)
+				return fmt.Errorf("room request failed: %w", err)
+			}
+
+		case protocol.RoomLookup:
+			if !registered {
+				return fmt.Errorf("room lookup before registration")
+			}
+
+			if err := ss.handleRoomLookup(user, payload); err != nil {
+				log.Printf("Room lookup error for %s: %v", userID, err)
+				return fmt.Errorf("room lookup failed: %w", err)
+			}
+
+		case protocol.MailboxPut:
+			if !registered {
+				return fmt.Errorf("mailbox upload before registration")
+			}
+			if upload != nil {
+				return fmt.Errorf("mailbox upload already in progress")
+			}
+
+			upload = ss.handleMailboxPut(user, payload)
+
+		case protocol.FileTransferStart, protocol.FileTransferData,
+			protocol.FileTransferEnd:
+			if upload == nil {
+				return fmt.Errorf("transfer message outside mailbox upload")
+			}
+
+			if ss.handleMailboxData(user, upload, opCode, payload) {
+				upload = nil
+			}
+
+		case protocol.MailboxList, protocol.MailboxFetch, protocol.MailboxDelete:
+			if !registered {
+				return fmt.Errorf("mailbox request before registration")
+			}
+
+			if err := ss.handleMailboxRequest(user, opCode, payload); err != nil {
+				log.Printf("Mailbox request error for %s: %v", userID, err)
+				return fmt.Errorf("mailbox request failed: %w", err)
+			}
+
+		case protocol.PresenceList:
+			if !registered {
+				return fmt.Errorf("presence list before registration")
+			}
+
+			if err := ss.handlePresenceList(user, payload); err != nil {
+				log.Printf("Presence list error for %s: %v", userID, err)
+				return fmt.Errorf("presence list failed: %w", err)
+			}
+
 		default:
 			return fmt.Errorf("unknown operation code: %d", opCode)
 		}
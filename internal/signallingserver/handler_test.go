@@ -0,0 +1,38 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+func TestRegisterNegotiatesHello(t *testing.T) {
+	ss := newTestServer()
+	conn := pipeClient(t, ss)
+
+	hello := protocol.Hello{Version: protocol.Version, MinVersion: protocol.MinVersion}
+	opCode, payload := pipeRequest(t, conn, protocol.ServerHello,
+		PeerInfo{Type: PeerTypeNative, Hello: &hello})
+	if opCode != protocol.ServerAck {
+		t.Fatalf("expected ServerAck, got opcode %d: %s", opCode, payload)
+	}
+
+	var ack RegisterAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		t.Fatalf("failed to decode register ack: %v", err)
+	}
+	if ack.PeerID == "" || ack.Hello.Version != protocol.Version {
+		t.Fatalf("unexpected register ack %+v", ack)
+	}
+
+	future := protocol.Hello{Version: protocol.Version + 2, MinVersion: protocol.Version + 1}
+	opCode, payload = pipeRequest(t, pipeClient(t, ss), protocol.ServerHello,
+		PeerInfo{Type: PeerTypeNative, Hello: &future})
+	if opCode != protocol.Error {
+		t.Fatalf("expected Error for incompatible client, got opcode %d", opCode)
+	}
+	if len(payload) == 0 {
+		t.Fatal("expected a reason with the Error")
+	}
+}
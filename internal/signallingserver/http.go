@@ -0,0 +1,51 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/webui"
+)
+
+type ServerStatus struct {
+	Peers         int              `json:"peers"`
+	PeersByType   map[PeerType]int `json:"peersByType"`
+	UptimeSeconds int64            `json:"uptimeSeconds"`
+}
+
+// HTTPHandler serves the browser-facing side of the signalling server:
+// the embedded web UI, a WebSocket endpoint speaking the binary protocol
+// and a small JSON API.
+func (ss *SignallingServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", webui.Handler())
+	mux.Handle("/ws", ss.HandleWebSocket())
+	mux.HandleFunc("GET /api/status", ss.handleStatus)
+	return mux
+}
+
+func (ss *SignallingServer) Status() ServerStatus {
+	status := ServerStatus{
+		PeersByType:   make(map[PeerType]int),
+		UptimeSeconds: int64(time.Since(ss.StartTime).Seconds()),
+	}
+
+	ss.UserMap.Range(func(_, value any) bool {
+		if peer, ok := value.(*Peer); ok {
+			status.Peers++
+			status.PeersByType[peer.Info.Type]++
+		}
+		return true
+	})
+
+	return status
+}
+
+func (ss *SignallingServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ss.Status()); err != nil {
+		log.Printf("Failed to encode status response: %v", err)
+	}
+}
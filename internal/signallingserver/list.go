@@ -0,0 +1,99 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+// PagedListVersion is the first protocol version whose clients read list
+// replies (room members, mailbox entries) as a series of ListPages.
+const PagedListVersion = 6
+
+// maxPayloadSize is the largest payload SendToPeer can frame.
+const maxPayloadSize = bufferSize - protocol.MessageHeaderSize
+
+// ListPage is one message of a list reply. A list too long for one
+// message is split over several; More is set on every page but the last.
+type ListPage[T any] struct {
+	Items []T
+	More  bool
+}
+
+// pagedLists reports whether user registered with a Hello new enough to
+// read ListPages. Browsers and older clients get a bare JSON array.
+func pagedLists(user *Peer) bool {
+	return user.Info.Hello != nil && user.Info.Hello.Version >= PagedListVersion
+}
+
+// sendList replies to user with items as opCode messages, one page per
+// message. Clients that cannot read pages get the whole list in one
+// message, or an error if it does not fit.
+func sendList[T any](ss *SignallingServer, user *Peer, opCode byte, items []T) error {
+	if !pagedLists(user) {
+		data, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		if len(data) > maxPayloadSize {
+			return ss.SendToPeer(user, protocol.Error,
+				[]byte("list too long for this client; upgrade it"))
+		}
+		return ss.SendToPeer(user, opCode, data)
+	}
+
+	pages, err := listPages(items, maxPayloadSize)
+	if err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if err := ss.SendToPeer(user, opCode, page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listPages encodes items as ListPages of at most limit bytes each. An
+// item that does not fit a page on its own is left out.
+func listPages[T any](items []T, limit int) ([][]byte, error) {
+	fitting := make([]T, 0, len(items))
+	for i, item := range items {
+		data, err := json.Marshal(ListPage[T]{Items: []T{item}, More: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > limit {
+			log.Printf("Dropping list item %d: it does not fit in a message", i)
+			continue
+		}
+		fitting = append(fitting, item)
+	}
+
+	var pages [][]byte
+	page := ListPage[T]{Items: []T{}}
+	last, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(fitting); {
+		page.Items = append(page.Items, fitting[i])
+		page.More = i+1 < len(fitting)
+		data, err := json.Marshal(page)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= limit || len(page.Items) == 1 {
+			last = data
+			i++
+			continue
+		}
+
+		// Item i starts the next page; the previous encoding already has
+		// More set because it follows.
+		pages = append(pages, last)
+		page.Items = page.Items[:0]
+	}
+	return append(pages, last), nil
+}
@@ -0,0 +1,469 @@
+package signallingserver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const (
+	mailboxBlobExt   = ".blob"
+	mailboxMetaExt   = ".json"
+	mailboxSweepTick = time.Minute
+)
+
+var (
+	ErrMailboxDisabled = errors.New("mailbox disabled")
+	ErrQuotaExceeded   = errors.New("recipient mailbox quota exceeded")
+	ErrNotAuthorized   = errors.New("identity proof rejected")
+	ErrBlobNotFound    = errors.New("mailbox entry not found")
+)
+
+// MailboxPut opens an upload. The blob that follows is the sender's usual
+// encrypted FileTransferStart/Data/End stream, stored exactly as framed.
+type MailboxPut struct {
+	Recipient string
+	From      string
+	SaltData  string
+	Size      uint64
+}
+
+// MailboxAuth proves ownership of an identity without revealing its
+// secret: Signature is the identity key's signature of MailboxChallenge
+// for this request, and PublicKey must hash to Identity.
+type MailboxAuth struct {
+	Identity  string
+	PublicKey []byte
+	Signature []byte
+	ID        string
+}
+
+// MailboxChallenge is what a client signs to authorize one mailbox
+// request: the nonce the server issued its connection at registration,
+// the request's opcode and the entry it names. A signature is worthless
+// on any other connection or for any other request.
+func MailboxChallenge(nonce []byte, opCode byte, id string) []byte {
+	challenge := append([]byte("kdtransfer mailbox\x00"), nonce...)
+	challenge = append(challenge, opCode)
+	return append(challenge, id...)
+}
+
+type MailboxEntry struct {
+	ID       string
+	From     string
+	SaltData string
+	Size     uint64
+	Created  time.Time
+	Expires  time.Time
+}
+
+// Mailbox stores blobs on disk under <dir>/<identity>/<id>.{blob,json}.
+type Mailbox struct {
+	dir   string
+	quota int64
+	ttl   time.Duration
+
+	mu sync.Mutex
+	// reserved is the quota held by each recipient's uploads in progress,
+	// so concurrent uploads cannot each claim the whole of it.
+	reserved map[string]int64
+}
+
+func NewMailbox(dir string, quota int64, ttl time.Duration) (*Mailbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create mailbox dir: %w", err)
+	}
+	return &Mailbox{dir: dir, quota: quota, ttl: ttl, reserved: make(map[string]int64)}, nil
+}
+
+func validIdentity(identity string) bool {
+	if len(identity) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(identity)
+	return err == nil
+}
+
+// Authorize checks that auth was signed by the owner of its identity for
+// the request opCode on the connection that was issued nonce.
+func (m *Mailbox) Authorize(auth MailboxAuth, nonce []byte, opCode byte) error {
+	if !validIdentity(auth.Identity) || len(nonce) == 0 ||
+		len(auth.PublicKey) != ed25519.PublicKeySize ||
+		crypto.IdentityFromPublicKey(auth.PublicKey) != auth.Identity ||
+		!ed25519.Verify(auth.PublicKey, MailboxChallenge(nonce, opCode, auth.ID), auth.Signature) {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+func (m *Mailbox) recipientDir(identity string) string {
+	return filepath.Join(m.dir, identity)
+}
+
+// Usage returns the bytes currently stored for a recipient.
+func (m *Mailbox) Usage(identity string) int64 {
+	var total int64
+	entries, _ := os.ReadDir(m.recipientDir(identity))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+func (m *Mailbox) List(identity string) ([]MailboxEntry, error) {
+	files, err := os.ReadDir(m.recipientDir(identity))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []MailboxEntry
+	now := time.Now()
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), mailboxMetaExt) {
+			continue
+		}
+		entry, err := m.readEntry(identity, strings.TrimSuffix(file.Name(), mailboxMetaExt))
+		if err != nil || now.After(entry.Expires) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (m *Mailbox) readEntry(identity string, id string) (MailboxEntry, error) {
+	var entry MailboxEntry
+	data, err := os.ReadFile(filepath.Join(m.recipientDir(identity), id+mailboxMetaExt))
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+func (m *Mailbox) Open(identity string, id string) (io.ReadCloser, error) {
+	if _, err := hex.DecodeString(id); err != nil {
+		return nil, ErrBlobNotFound
+	}
+	file, err := os.Open(filepath.Join(m.recipientDir(identity), id+mailboxBlobExt))
+	if err != nil {
+		return nil, ErrBlobNotFound
+	}
+	return file, nil
+}
+
+func (m *Mailbox) Delete(identity string, id string) error {
+	if _, err := hex.DecodeString(id); err != nil {
+		return ErrBlobNotFound
+	}
+	dir := m.recipientDir(identity)
+	os.Remove(filepath.Join(dir, id+mailboxMetaExt))
+	if err := os.Remove(filepath.Join(dir, id+mailboxBlobExt)); err != nil {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// Sweep removes expired entries for every recipient.
+func (m *Mailbox) Sweep() {
+	recipients, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		files, _ := os.ReadDir(m.recipientDir(recipient.Name()))
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), mailboxMetaExt) {
+				continue
+			}
+			id := strings.TrimSuffix(file.Name(), mailboxMetaExt)
+			entry, err := m.readEntry(recipient.Name(), id)
+			if err == nil && now.Before(entry.Expires) {
+				continue
+			}
+			m.Delete(recipient.Name(), id)
+			log.Printf("Mailbox entry %s for %s expired", id, recipient.Name())
+		}
+	}
+}
+
+func (m *Mailbox) RunSweeper() {
+	ticker := time.NewTicker(mailboxSweepTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Sweep()
+	}
+}
+
+type mailboxUpload struct {
+	mailbox   *Mailbox
+	recipient string
+	entry     MailboxEntry
+	file      *os.File
+	remaining int64
+	reserved  int64
+}
+
+// blobLimit bounds the stored size of a file of size bytes: its chunks and
+// the start and end messages, each at most one mailbox message.
+func blobLimit(size uint64) int64 {
+	chunks := (size + protocol.MailboxChunkSize - 1) / protocol.MailboxChunkSize
+	return int64(chunks+2) * protocol.TotalMailboxSize
+}
+
+func (m *Mailbox) Create(put MailboxPut) (*mailboxUpload, error) {
+	if !validIdentity(put.Recipient) {
+		return nil, fmt.Errorf("invalid recipient identity")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := m.quota - m.Usage(put.Recipient) - m.reserved[put.Recipient]
+	if int64(put.Size) > remaining {
+		return nil, ErrQuotaExceeded
+	}
+
+	dir := m.recipientDir(put.Recipient)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString([]byte(crypto.GenerateID()))
+	file, err := os.Create(filepath.Join(dir, id+mailboxBlobExt))
+	if err != nil {
+		return nil, err
+	}
+
+	// The upload may write up to what the file needs once framed and
+	// encrypted, and holds that much of the quota until it ends.
+	reserved := min(blobLimit(put.Size), remaining)
+	m.reserved[put.Recipient] += reserved
+
+	now := time.Now()
+	return &mailboxUpload{
+		mailbox:   m,
+		recipient: put.Recipient,
+		file:      file,
+		remaining: reserved,
+		reserved:  reserved,
+		entry: MailboxEntry{
+			ID:       id,
+			From:     put.From,
+			SaltData: put.SaltData,
+			Size:     put.Size,
+			Created:  now,
+			Expires:  now.Add(m.ttl),
+		},
+	}, nil
+}
+
+func (u *mailboxUpload) Write(msg []byte) error {
+	u.remaining -= int64(len(msg))
+	if u.remaining < 0 {
+		return ErrQuotaExceeded
+	}
+	_, err := u.file.Write(msg)
+	return err
+}
+
+// Commit makes the blob visible to the recipient by writing its metadata.
+// The blob then counts towards Usage instead of the upload's reservation.
+func (u *mailboxUpload) Commit() error {
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(u.entry)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(u.mailbox.recipientDir(u.recipient),
+		u.entry.ID+mailboxMetaExt), data, 0o600)
+	if err == nil {
+		u.release()
+	}
+	return err
+}
+
+func (u *mailboxUpload) Abort() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+	u.release()
+}
+
+// release returns the upload's reservation to its recipient's quota. It
+// is safe to call more than once.
+func (u *mailboxUpload) release() {
+	m := u.mailbox
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reserved[u.recipient] -= u.reserved
+	if m.reserved[u.recipient] <= 0 {
+		delete(m.reserved, u.recipient)
+	}
+	u.reserved = 0
+}
+
+func (ss *SignallingServer) sendError(user *Peer, message string) {
+	if err := ss.SendToPeer(user, protocol.Error, []byte(message)); err != nil {
+		log.Printf("Failed sending error to user %s: %v", user.ID, err)
+	}
+}
+
+func (ss *SignallingServer) handleMailboxPut(user *Peer, payload []byte) *mailboxUpload {
+	if ss.Mailbox == nil {
+		ss.sendError(user, ErrMailboxDisabled.Error())
+		return nil
+	}
+
+	var put MailboxPut
+	if err := json.Unmarshal(payload, &put); err != nil {
+		ss.sendError(user, "invalid request")
+		return nil
+	}
+
+	upload, err := ss.Mailbox.Create(put)
+	if err != nil {
+		ss.sendError(user, err.Error())
+		return nil
+	}
+
+	if err := ss.SendToPeer(user, protocol.MailboxAck, []byte(upload.entry.ID)); err != nil {
+		upload.Abort()
+		return nil
+	}
+
+	log.Printf("User %s uploading mailbox entry %s for %s", user.ID,
+		upload.entry.ID, put.Recipient)
+	return upload
+}
+
+// handleMailboxData appends one transfer message to an upload and reports
+// whether the upload has finished (committed or aborted), after which the
+// caller must drop it.
+func (ss *SignallingServer) handleMailboxData(user *Peer, upload *mailboxUpload,
+	opCode byte, payload []byte) bool {
+	buf := ss.GetBuffer()
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err == nil {
+		err = upload.Write(buf[:n])
+	}
+	ss.PutBuffer(buf)
+
+	if err != nil {
+		upload.Abort()
+		ss.sendError(user, err.Error())
+		return true
+	}
+
+	if opCode != protocol.FileTransferEnd {
+		return false
+	}
+
+	if err := upload.Commit(); err != nil {
+		upload.Abort()
+		ss.sendError(user, "failed to store mailbox entry")
+		return true
+	}
+
+	if err := ss.SendToPeer(user, protocol.MailboxAck, []byte(upload.entry.ID)); err != nil {
+		log.Printf("Failed sending mailbox ack to %s: %v", user.ID, err)
+	}
+
+	log.Printf("Stored mailbox entry %s for %s", upload.entry.ID, upload.recipient)
+	return true
+}
+
+func (ss *SignallingServer) handleMailboxRequest(user *Peer, opCode byte,
+	payload []byte) error {
+	if ss.Mailbox == nil {
+		ss.sendError(user, ErrMailboxDisabled.Error())
+		return nil
+	}
+
+	var auth MailboxAuth
+	if err := json.Unmarshal(payload, &auth); err != nil {
+		ss.sendError(user, "invalid request")
+		return nil
+	}
+
+	if err := ss.Mailbox.Authorize(auth, user.mailboxNonce, opCode); err != nil {
+		ss.sendError(user, err.Error())
+		return nil
+	}
+
+	switch opCode {
+	case protocol.MailboxList:
+		entries, err := ss.Mailbox.List(auth.Identity)
+		if err != nil {
+			ss.sendError(user, "failed to list mailbox")
+			return nil
+		}
+		if err := sendList(ss, user, protocol.MailboxListAck, entries); err != nil {
+			return fmt.Errorf("failed sending mailbox list to %s: %w", user.ID, err)
+		}
+		return nil
+
+	case protocol.MailboxFetch:
+		blob, err := ss.Mailbox.Open(auth.Identity, auth.ID)
+		if err != nil {
+			ss.sendError(user, err.Error())
+			return nil
+		}
+		defer blob.Close()
+
+		// The replay outpaces any recipient, so it waits for room in the
+		// peer's queue rather than dropping the peer as SendToPeer would.
+		// A recipient that stops reading ends it through the writer's
+		// deadline.
+		buf := make([]byte, protocol.TotalMailboxSize)
+		for {
+			msgCode, n, err := protocol.DecodeMessage(blob, buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("corrupt mailbox entry %s: %w", auth.ID, err)
+			}
+			msg := make([]byte, protocol.MessageHeaderSize+n)
+			if _, err := protocol.MakeMessage(msgCode, buf[:n], msg); err != nil {
+				return err
+			}
+			if err := user.Send(context.Background(), msg); err != nil {
+				return fmt.Errorf("failed replaying mailbox entry %s: %w", auth.ID, err)
+			}
+		}
+
+	case protocol.MailboxDelete:
+		if err := ss.Mailbox.Delete(auth.Identity, auth.ID); err != nil {
+			ss.sendError(user, err.Error())
+			return nil
+		}
+		log.Printf("Mailbox entry %s delivered to %s", auth.ID, auth.Identity)
+		return ss.SendToPeer(user, protocol.MailboxAck, []byte(auth.ID))
+	}
+
+	return nil
+}
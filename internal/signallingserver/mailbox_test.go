@@ -0,0 +1,305 @@
+package signallingserver
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+func newTestIdentity(t *testing.T) (string, string) {
+	t.Helper()
+	secret, err := crypto.GenerateIdentitySecret()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	return secret, crypto.IdentityFromSecret(secret)
+}
+
+func signedAuth(secret string, nonce []byte, opCode byte, id string) MailboxAuth {
+	key := crypto.IdentityKey(secret)
+	return MailboxAuth{
+		Identity:  crypto.IdentityFromSecret(secret),
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, MailboxChallenge(nonce, opCode, id)),
+		ID:        id,
+	}
+}
+
+func TestMailboxStoreListFetchDelete(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 1024, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+
+	secret, identity := newTestIdentity(t)
+
+	upload, err := mailbox.Create(MailboxPut{Recipient: identity, SaltData: "salt", Size: 5})
+	if err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	if err := upload.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write upload: %v", err)
+	}
+
+	entries, _ := mailbox.List(identity)
+	if len(entries) != 0 {
+		t.Fatalf("uncommitted upload should not be listed, got %d entries", len(entries))
+	}
+
+	if err := upload.Commit(); err != nil {
+		t.Fatalf("failed to commit upload: %v", err)
+	}
+
+	entries, err = mailbox.List(identity)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List() = %v, %v; want one entry", entries, err)
+	}
+	if entries[0].SaltData != "salt" {
+		t.Errorf("salt = %q, want %q", entries[0].SaltData, "salt")
+	}
+
+	nonce := []byte("connection nonce")
+	auth := signedAuth(secret, nonce, protocol.MailboxFetch, entries[0].ID)
+	if err := mailbox.Authorize(auth, nonce, protocol.MailboxFetch); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if err := mailbox.Authorize(auth, []byte("other connection"), protocol.MailboxFetch); err == nil {
+		t.Error("signature replayed on another connection accepted")
+	}
+	if err := mailbox.Authorize(auth, nonce, protocol.MailboxDelete); err == nil {
+		t.Error("signature for a fetch accepted for a delete")
+	}
+	otherSecret, _ := newTestIdentity(t)
+	forged := signedAuth(otherSecret, nonce, protocol.MailboxFetch, entries[0].ID)
+	forged.Identity = identity
+	if err := mailbox.Authorize(forged, nonce, protocol.MailboxFetch); err == nil {
+		t.Error("another identity's key accepted")
+	}
+
+	blob, err := mailbox.Open(identity, entries[0].ID)
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "hello" {
+		t.Errorf("blob = %q, want %q", data, "hello")
+	}
+
+	if err := mailbox.Delete(identity, entries[0].ID); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if entries, _ := mailbox.List(identity); len(entries) != 0 {
+		t.Errorf("entry still listed after delete")
+	}
+}
+
+func TestMailboxQuota(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 8, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+	_, identity := newTestIdentity(t)
+
+	if _, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 16}); err != ErrQuotaExceeded {
+		t.Errorf("declared size over quota: err = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	upload, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 4})
+	if err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	if err := upload.Write(make([]byte, 16)); err != ErrQuotaExceeded {
+		t.Errorf("write over quota: err = %v, want %v", err, ErrQuotaExceeded)
+	}
+	upload.Abort()
+}
+
+func TestMailboxQuotaReservedAcrossUploads(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 64*1024, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+	_, identity := newTestIdentity(t)
+
+	first, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 40 * 1024})
+	if err != nil {
+		t.Fatalf("failed to create first upload: %v", err)
+	}
+	if _, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 40 * 1024}); err != ErrQuotaExceeded {
+		t.Errorf("concurrent upload over quota: err = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	first.Abort()
+	second, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 40 * 1024})
+	if err != nil {
+		t.Fatalf("quota not released by abort: %v", err)
+	}
+	second.Abort()
+}
+
+func TestMailboxSweepExpires(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 1024, -time.Second)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+	_, identity := newTestIdentity(t)
+
+	upload, err := mailbox.Create(MailboxPut{Recipient: identity, Size: 1})
+	if err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	upload.Write([]byte("x"))
+	if err := upload.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	mailbox.Sweep()
+
+	if usage := mailbox.Usage(identity); usage != 0 {
+		t.Errorf("usage after sweep = %d, want 0", usage)
+	}
+}
+
+// registerMailboxClient registers a paging client over a pipe and returns
+// it with its mailbox nonce.
+func registerMailboxClient(t *testing.T, ss *SignallingServer) (net.Conn, []byte) {
+	t.Helper()
+	conn := pipeClient(t, ss)
+	opCode, payload := pipeRequest(t, conn, protocol.ServerHello, PeerInfo{
+		Type:  PeerTypeNative,
+		Hello: &protocol.Hello{Version: protocol.Version, MinVersion: protocol.MinVersion},
+	})
+	if opCode != protocol.ServerAck {
+		t.Fatalf("expected ServerAck, got opcode %d", opCode)
+	}
+	var ack RegisterAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		t.Fatalf("failed to decode register ack: %v", err)
+	}
+	return conn, ack.MailboxNonce
+}
+
+func TestMailboxListPagesLongLists(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+	ss := newTestServer()
+	ss.Mailbox = mailbox
+
+	secret, identity := newTestIdentity(t)
+	for range 100 {
+		upload, err := mailbox.Create(MailboxPut{Recipient: identity, SaltData: "salt", Size: 1})
+		if err != nil {
+			t.Fatalf("failed to create upload: %v", err)
+		}
+		if err := upload.Commit(); err != nil {
+			t.Fatalf("failed to commit upload: %v", err)
+		}
+	}
+
+	conn, nonce := registerMailboxClient(t, ss)
+	opCode, payload := pipeRequest(t, conn, protocol.MailboxList,
+		signedAuth(secret, nonce, protocol.MailboxList, ""))
+
+	var entries []MailboxEntry
+	pages := 0
+	buf := make([]byte, bufferSize)
+	for {
+		if opCode != protocol.MailboxListAck {
+			t.Fatalf("expected MailboxListAck, got opcode %d: %s", opCode, payload)
+		}
+		var page ListPage[MailboxEntry]
+		if err := json.Unmarshal(payload, &page); err != nil {
+			t.Fatalf("failed to decode page: %v", err)
+		}
+		entries = append(entries, page.Items...)
+		pages++
+		if !page.More {
+			break
+		}
+		var n int
+		if opCode, n, err = protocol.ReadMessage(conn, buf); err != nil {
+			t.Fatalf("failed to read page %d: %v", pages+1, err)
+		}
+		payload = buf[:n]
+	}
+
+	if len(entries) != 100 || pages < 2 {
+		t.Errorf("got %d entries in %d pages, want 100 over several", len(entries), pages)
+	}
+}
+
+func TestMailboxFetchWaitsForSlowRecipient(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir(), 1<<30, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create mailbox: %v", err)
+	}
+	ss := newTestServer()
+	ss.Mailbox = mailbox
+
+	// Far more messages than a peer's outgoing queue holds.
+	const messages = 200
+	secret, identity := newTestIdentity(t)
+	upload, err := mailbox.Create(MailboxPut{Recipient: identity,
+		Size: messages * protocol.MailboxChunkSize})
+	if err != nil {
+		t.Fatalf("failed to create upload: %v", err)
+	}
+	msg := make([]byte, protocol.TotalMailboxSize)
+	for i := range messages {
+		n, err := protocol.MakeMessage(protocol.FileTransferData,
+			make([]byte, protocol.MailboxChunkSize-i%7), msg)
+		if err != nil {
+			t.Fatalf("failed to make message: %v", err)
+		}
+		if err := upload.Write(msg[:n]); err != nil {
+			t.Fatalf("failed to write upload: %v", err)
+		}
+	}
+	if err := upload.Commit(); err != nil {
+		t.Fatalf("failed to commit upload: %v", err)
+	}
+
+	conn, nonce := registerMailboxClient(t, ss)
+	payload, err := json.Marshal(signedAuth(secret, nonce, protocol.MailboxFetch,
+		upload.entry.ID))
+	if err != nil {
+		t.Fatalf("failed to encode auth: %v", err)
+	}
+	n, err := protocol.MakeMessage(protocol.MailboxFetch, payload, msg)
+	if err != nil {
+		t.Fatalf("failed to make message: %v", err)
+	}
+	if _, err := conn.Write(msg[:n]); err != nil {
+		t.Fatalf("failed to write fetch: %v", err)
+	}
+
+	// Let the replay fill the queue and wait longer than SendToPeer would.
+	time.Sleep(1500 * time.Millisecond)
+
+	for i := range messages {
+		opCode, n, err := protocol.ReadMessage(conn, msg)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if opCode != protocol.FileTransferData || n != protocol.MailboxChunkSize-i%7 {
+			t.Fatalf("message %d: opcode %d with %d bytes", i, opCode, n)
+		}
+	}
+	peers := 0
+	ss.UserMap.Range(func(_, _ any) bool {
+		peers++
+		return true
+	})
+	if peers != 1 {
+		t.Errorf("%d peers registered after the fetch, want the recipient", peers)
+	}
+}
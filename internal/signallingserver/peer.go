@@ -1,8 +1,12 @@
 package signallingserver
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
 )
 
 type PeerInfo struct {
@@ -10,6 +14,32 @@ type PeerInfo struct {
 	Type       PeerType
 	LocalAddr  []string
 	PublicAddr string
+	NATType    string
+	// PortMapped is set when PublicAddr is a TCP port forwarded by the
+	// receiver's gateway rather than a STUN-observed UDP mapping.
+	PortMapped bool
+	WSPort     string
+	Identity   string
+
+	// Presence, only listed when Visible is set
+	Visible     bool
+	DisplayName string
+	DeviceType  string
+	Team        string
+
+	// Hello carries the client's protocol version and capabilities;
+	// browsers and clients that predate the handshake leave it out.
+	Hello *protocol.Hello `json:",omitempty"`
+}
+
+// RegisterAck answers a ServerHello that carried a Hello. Registrations
+// without one get the bare peer ID as before.
+type RegisterAck struct {
+	PeerID string
+	Hello  protocol.Hello
+	// MailboxNonce is this connection's challenge for MailboxAuth
+	// signatures.
+	MailboxNonce []byte `json:",omitempty"`
 }
 
 type Peer struct {
@@ -17,23 +47,43 @@ type Peer struct {
 	Info     PeerInfo
 	Outgoing chan []byte
 	once     sync.Once
+
+	// closeMu keeps Outgoing from being closed under a pending send, and
+	// writerDone is closed when the connection's writer stops draining it.
+	closeMu    sync.RWMutex
+	closed     bool
+	writerDone chan struct{}
+
+	// mailboxNonce is issued at registration and signed by mailbox
+	// requests on this connection.
+	mailboxNonce []byte
 }
 
 func NewPeer(id string, info PeerInfo) *Peer {
 	return &Peer{
-		ID:       id,
-		Info:     info,
-		Outgoing: make(chan []byte, 64),
+		ID:         id,
+		Info:       info,
+		Outgoing:   make(chan []byte, 64),
+		writerDone: make(chan struct{}),
 	}
 }
 
 func (p *Peer) CloseOutgoing() {
 	p.once.Do(func() {
+		p.closeMu.Lock()
+		p.closed = true
 		close(p.Outgoing)
+		p.closeMu.Unlock()
 	})
 }
 
 func (p *Peer) SendMessage(msg []byte) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return fmt.Errorf("peer %s buffer full or closed", p.ID)
+	}
+
 	select {
 	case p.Outgoing <- msg:
 		return nil
@@ -42,11 +92,37 @@ func (p *Peer) SendMessage(msg []byte) error {
 	}
 }
 
+// Send queues msg for the peer's writer, waiting while the queue is full
+// until ctx is done or the writer has stopped.
+func (p *Peer) Send(ctx context.Context, msg []byte) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return fmt.Errorf("peer %s is disconnected", p.ID)
+	}
+
+	select {
+	case p.Outgoing <- msg:
+		return nil
+	case <-p.writerDone:
+		return fmt.Errorf("peer %s is disconnected", p.ID)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type PeerLookUp struct {
 	PeerID string
 	Info   PeerInfo
 }
 
+// PeerSignal carries an opaque WebRTC signalling blob. Senders set PeerID
+// to the target; the server rewrites it to the sender before forwarding.
+type PeerSignal struct {
+	PeerID string
+	Data   json.RawMessage
+}
+
 type PeerType string
 
 const (
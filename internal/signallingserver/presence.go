@@ -0,0 +1,91 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+// PresenceQuery scopes a directory listing to the caller's team, narrowed
+// to the members of Room when it is set.
+type PresenceQuery struct {
+	Room string
+}
+
+type PresenceEntry struct {
+	PeerID      string
+	DisplayName string
+	DeviceType  string
+	Type        PeerType
+}
+
+func presenceEntry(peer *Peer) PresenceEntry {
+	return PresenceEntry{
+		PeerID:      peer.ID,
+		DisplayName: peer.Info.DisplayName,
+		DeviceType:  peer.Info.DeviceType,
+		Type:        peer.Info.Type,
+	}
+}
+
+// VisiblePeers lists peers of the caller's team that opted in to presence,
+// excluding the caller. A room name does not widen the listing: rooms are
+// open to anyone who knows the name, teams are not.
+func (ss *SignallingServer) VisiblePeers(user *Peer, room string) []PresenceEntry {
+	var candidates []*Peer
+	if room != "" {
+		if r, found := ss.GetRoom(room); found {
+			candidates = r.Members()
+		}
+	} else {
+		ss.UserMap.Range(func(_, value any) bool {
+			if peer, ok := value.(*Peer); ok {
+				candidates = append(candidates, peer)
+			}
+			return true
+		})
+	}
+
+	entries := []PresenceEntry{}
+	for _, peer := range candidates {
+		if peer.ID == user.ID || !peer.Info.Visible || peer.Info.Team != user.Info.Team {
+			continue
+		}
+		entries = append(entries, presenceEntry(peer))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].DisplayName != entries[j].DisplayName {
+			return entries[i].DisplayName < entries[j].DisplayName
+		}
+		return entries[i].PeerID < entries[j].PeerID
+	})
+
+	return entries
+}
+
+func (ss *SignallingServer) handlePresenceList(user *Peer, payload []byte) error {
+	var query PresenceQuery
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &query); err != nil {
+			ss.sendError(user, "invalid request")
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(ss.VisiblePeers(user, query.Room))
+	if err != nil {
+		log.Printf("Failed to marshal presence list: %v", err)
+		ss.sendError(user, "server error")
+		return nil
+	}
+
+	if err := ss.SendToPeer(user, protocol.PresenceListAck, data); err != nil {
+		return fmt.Errorf("failed sending presence list to user %s: %w", user.ID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package signallingserver
+
+import "testing"
+
+func TestVisiblePeersIsOptIn(t *testing.T) {
+	ss := newTestServer()
+
+	caller := NewPeer("caller", PeerInfo{Team: "qa"})
+	visible := NewPeer("visible", PeerInfo{Team: "qa", Visible: true, DisplayName: "rack-1"})
+	hidden := NewPeer("hidden", PeerInfo{Team: "qa"})
+	otherTeam := NewPeer("other", PeerInfo{Team: "dev", Visible: true})
+
+	for _, peer := range []*Peer{caller, visible, hidden, otherTeam} {
+		ss.AddUser(peer.ID, peer)
+	}
+
+	entries := ss.VisiblePeers(caller, "")
+	if len(entries) != 1 || entries[0].PeerID != "visible" {
+		t.Fatalf("team listing = %+v, want only the visible qa peer", entries)
+	}
+	if entries[0].DisplayName != "rack-1" {
+		t.Errorf("display name = %q, want %q", entries[0].DisplayName, "rack-1")
+	}
+
+	roomMate := NewPeer("roommate", PeerInfo{Team: "qa", Visible: true})
+	ss.AddUser(roomMate.ID, roomMate)
+	ss.JoinRoom("lab", hidden)
+	ss.JoinRoom("lab", roomMate)
+	entries = ss.VisiblePeers(caller, "lab")
+	if len(entries) != 1 || entries[0].PeerID != "roommate" {
+		t.Errorf("room listing = %+v, want only the visible room member", entries)
+	}
+}
+
+func TestVisiblePeersKeepsRoomsWithinTeam(t *testing.T) {
+	ss := newTestServer()
+
+	caller := NewPeer("caller", PeerInfo{Team: "qa"})
+	otherTeam := NewPeer("other", PeerInfo{Team: "dev", Visible: true, DisplayName: "dev-box"})
+	for _, peer := range []*Peer{caller, otherTeam} {
+		ss.AddUser(peer.ID, peer)
+	}
+	ss.JoinRoom("lab", otherTeam)
+
+	if entries := ss.VisiblePeers(caller, "lab"); len(entries) != 0 {
+		t.Errorf("room listing = %+v, want no peers from another team", entries)
+	}
+	if entries := ss.VisiblePeers(otherTeam, "lab"); len(entries) != 0 {
+		t.Errorf("room listing = %+v, want none besides the caller itself", entries)
+	}
+}
@@ -0,0 +1,196 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const maxRoomNameLength = 64
+
+type Room struct {
+	Name    string
+	mu      sync.Mutex
+	members map[string]*Peer
+}
+
+func NewRoom(name string) *Room {
+	return &Room{
+		Name:    name,
+		members: make(map[string]*Peer),
+	}
+}
+
+func (r *Room) Add(peer *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members[peer.ID] = peer
+}
+
+// Remove drops a member and reports whether the room is now empty.
+func (r *Room) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, id)
+	return len(r.members) == 0
+}
+
+func (r *Room) Members() []*Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]*Peer, 0, len(r.members))
+	for _, peer := range r.members {
+		members = append(members, peer)
+	}
+	return members
+}
+
+type RoomRequest struct {
+	Room string
+}
+
+type RoomLookUp struct {
+	Room string
+	Info PeerInfo
+}
+
+// RoomMember is what a room lookup returns for each member. Info holds
+// only what a sender needs to reach it, so large rooms stay cheap to list.
+type RoomMember struct {
+	PeerID string
+	Info   PeerInfo
+}
+
+// dialInfo keeps the fields of info a sender needs to dial the peer: its
+// addresses, the salt that decrypts them, and whether it is a browser.
+func dialInfo(info PeerInfo) PeerInfo {
+	return PeerInfo{
+		SaltData:   info.SaltData,
+		Type:       info.Type,
+		LocalAddr:  info.LocalAddr,
+		PublicAddr: info.PublicAddr,
+		PortMapped: info.PortMapped,
+		WSPort:     info.WSPort,
+	}
+}
+
+func (ss *SignallingServer) JoinRoom(name string, peer *Peer) {
+	for {
+		value, _ := ss.RoomMap.LoadOrStore(name, NewRoom(name))
+		value.(*Room).Add(peer)
+
+		// The room may have emptied and been dropped concurrently; retry
+		// so the peer never ends up in an orphaned room.
+		if current, ok := ss.RoomMap.Load(name); ok && current == value {
+			return
+		}
+	}
+}
+
+func (ss *SignallingServer) LeaveRoom(name string, id string) {
+	value, ok := ss.RoomMap.Load(name)
+	if !ok {
+		return
+	}
+	if value.(*Room).Remove(id) {
+		ss.RoomMap.CompareAndDelete(name, value)
+	}
+}
+
+func (ss *SignallingServer) leaveAllRooms(id string) {
+	ss.RoomMap.Range(func(key, _ any) bool {
+		ss.LeaveRoom(key.(string), id)
+		return true
+	})
+}
+
+func (ss *SignallingServer) GetRoom(name string) (*Room, bool) {
+	if value, ok := ss.RoomMap.Load(name); ok {
+		if room, ok := value.(*Room); ok {
+			return room, true
+		}
+	}
+	return nil, false
+}
+
+func validRoomName(name string) bool {
+	return len(name) > 0 && len(name) <= maxRoomNameLength
+}
+
+func (ss *SignallingServer) handleRoomMembership(user *Peer, opCode byte,
+	payload []byte) error {
+	var req RoomRequest
+	if err := json.Unmarshal(payload, &req); err != nil || !validRoomName(req.Room) {
+		if sendErr := ss.SendToPeer(user, protocol.Error, []byte("invalid room")); sendErr != nil {
+			log.Printf("Failed sending error to user %s: %v", user.ID, sendErr)
+		}
+		return nil
+	}
+
+	if opCode == protocol.RoomJoin {
+		ss.JoinRoom(req.Room, user)
+		log.Printf("User %s joined room %s", user.ID, req.Room)
+	} else {
+		ss.LeaveRoom(req.Room, user.ID)
+		log.Printf("User %s left room %s", user.ID, req.Room)
+	}
+
+	if err := ss.SendToPeer(user, protocol.RoomAck, []byte(req.Room)); err != nil {
+		return fmt.Errorf("failed sending room ack to user %s: %w", user.ID, err)
+	}
+
+	return nil
+}
+
+func (ss *SignallingServer) handleRoomLookup(user *Peer, payload []byte) error {
+	var lookUp RoomLookUp
+	if err := json.Unmarshal(payload, &lookUp); err != nil {
+		if sendErr := ss.SendToPeer(user, protocol.Error, []byte("invalid request")); sendErr != nil {
+			log.Printf("Failed sending error to user %s: %v", user.ID, sendErr)
+		}
+		return nil
+	}
+
+	var members []RoomMember
+	var targets []*Peer
+	if room, found := ss.GetRoom(lookUp.Room); found {
+		for _, peer := range room.Members() {
+			if peer.ID == user.ID {
+				continue
+			}
+			members = append(members, RoomMember{PeerID: peer.ID, Info: dialInfo(peer.Info)})
+			targets = append(targets, peer)
+		}
+	}
+
+	if len(members) == 0 {
+		if sendErr := ss.SendToPeer(user, protocol.Error, []byte("room is empty")); sendErr != nil {
+			log.Printf("Failed sending error to user %s: %v", user.ID, sendErr)
+		}
+		return nil
+	}
+
+	if err := sendList(ss, user, protocol.RoomLookupAck, members); err != nil {
+		return fmt.Errorf("failed sending room lookup response to user %s: %w", user.ID, err)
+	}
+
+	// Forward sender info to every member (best effort)
+	senderData, err := json.Marshal(lookUp.Info)
+	if err != nil {
+		log.Printf("Failed to marshal sender info: %v", err)
+		return nil
+	}
+
+	for _, peer := range targets {
+		if err := ss.SendToPeer(peer, protocol.PeerInfoForward, senderData); err != nil {
+			log.Printf("Warning: failed forwarding sender info to peer %s: %v", peer.ID, err)
+		}
+	}
+
+	log.Printf("Room lookup completed: user %s -> room %s (%d members)",
+		user.ID, lookUp.Room, len(members))
+	return nil
+}
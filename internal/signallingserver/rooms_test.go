@@ -0,0 +1,179 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+func pipeClient(t *testing.T, ss *SignallingServer) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go ss.HandleConnection(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func pipeRequest(t *testing.T, conn net.Conn, opCode byte, v any) (byte, []byte) {
+	t.Helper()
+	payload, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to encode payload: %v", err)
+	}
+
+	buf := make([]byte, bufferSize)
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err != nil {
+		t.Fatalf("failed to make message: %v", err)
+	}
+	if _, err := conn.Write(buf[:n]); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	respCode, n, err := protocol.ReadMessage(conn, buf)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return respCode, buf[:n]
+}
+
+func TestRoomLookupReturnsOtherMembers(t *testing.T) {
+	ss := newTestServer()
+
+	var ids []string
+	var conns []net.Conn
+	for range 3 {
+		conn := pipeClient(t, ss)
+		opCode, payload := pipeRequest(t, conn, protocol.ServerHello,
+			PeerInfo{Type: PeerTypeNative})
+		if opCode != protocol.ServerAck {
+			t.Fatalf("expected ServerAck, got opcode %d", opCode)
+		}
+		ids = append(ids, string(payload))
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns[1:] {
+		if opCode, _ := pipeRequest(t, conn, protocol.RoomJoin,
+			RoomRequest{Room: "rack-1"}); opCode != protocol.RoomAck {
+			t.Fatalf("expected RoomAck, got opcode %d", opCode)
+		}
+	}
+
+	opCode, payload := pipeRequest(t, conns[0], protocol.RoomLookup,
+		RoomLookUp{Room: "rack-1"})
+	if opCode != protocol.RoomLookupAck {
+		t.Fatalf("expected RoomLookupAck, got opcode %d: %s", opCode, payload)
+	}
+
+	var members []RoomMember
+	if err := json.Unmarshal(payload, &members); err != nil {
+		t.Fatalf("failed to decode members: %v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("got %d members, want 2", len(members))
+	}
+
+	found := map[string]bool{}
+	for _, m := range members {
+		found[m.PeerID] = true
+	}
+	if !found[ids[1]] || !found[ids[2]] {
+		t.Errorf("members %v do not match joined peers %v", found, ids[1:])
+	}
+
+	if opCode, _ := pipeRequest(t, conns[0], protocol.RoomLookup,
+		RoomLookUp{Room: "missing"}); opCode != protocol.Error {
+		t.Errorf("expected Error for empty room, got opcode %d", opCode)
+	}
+}
+
+func TestRoomLookupPagesLargeRooms(t *testing.T) {
+	ss := newTestServer()
+	hello := &protocol.Hello{Version: protocol.Version, MinVersion: protocol.MinVersion}
+
+	// Members registered with a passphrase publish encrypted addresses,
+	// which makes each of them several hundred bytes.
+	encrypted := strings.Repeat("A", 88)
+	joined := map[string]bool{}
+	for range 50 {
+		conn := pipeClient(t, ss)
+		opCode, payload := pipeRequest(t, conn, protocol.ServerHello, PeerInfo{
+			Type:        PeerTypeNative,
+			SaltData:    strings.Repeat("s", 44),
+			LocalAddr:   []string{encrypted, encrypted, encrypted},
+			DisplayName: "rack machine",
+			Hello:       hello,
+		})
+		if opCode != protocol.ServerAck {
+			t.Fatalf("expected ServerAck, got opcode %d", opCode)
+		}
+		var ack RegisterAck
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			t.Fatalf("failed to decode register ack: %v", err)
+		}
+		if opCode, _ := pipeRequest(t, conn, protocol.RoomJoin,
+			RoomRequest{Room: "rack"}); opCode != protocol.RoomAck {
+			t.Fatalf("expected RoomAck, got opcode %d", opCode)
+		}
+		joined[ack.PeerID] = true
+	}
+
+	sender := pipeClient(t, ss)
+	pipeRequest(t, sender, protocol.ServerHello, PeerInfo{Type: PeerTypeNative, Hello: hello})
+	opCode, payload := pipeRequest(t, sender, protocol.RoomLookup, RoomLookUp{Room: "rack"})
+
+	var members []RoomMember
+	pages := 0
+	buf := make([]byte, bufferSize)
+	for {
+		if opCode != protocol.RoomLookupAck {
+			t.Fatalf("expected RoomLookupAck, got opcode %d: %s", opCode, payload)
+		}
+		var page ListPage[RoomMember]
+		if err := json.Unmarshal(payload, &page); err != nil {
+			t.Fatalf("failed to decode page: %v", err)
+		}
+		members = append(members, page.Items...)
+		pages++
+		if !page.More {
+			break
+		}
+		var n int
+		var err error
+		if opCode, n, err = protocol.ReadMessage(sender, buf); err != nil {
+			t.Fatalf("failed to read page %d: %v", pages+1, err)
+		}
+		payload = buf[:n]
+	}
+
+	if len(members) != 50 || pages < 2 {
+		t.Fatalf("got %d members in %d pages, want 50 over several", len(members), pages)
+	}
+	for _, m := range members {
+		if !joined[m.PeerID] || len(m.Info.LocalAddr) != 3 || m.Info.SaltData == "" {
+			t.Fatalf("member %+v is not a joined peer with its addresses", m)
+		}
+		if m.Info.DisplayName != "" || m.Info.Hello != nil {
+			t.Fatalf("member %s carries more than its dial info", m.PeerID)
+		}
+	}
+}
+
+func TestLeaveRoomDropsEmptyRoom(t *testing.T) {
+	ss := newTestServer()
+	peer := NewPeer("abc", PeerInfo{})
+
+	ss.JoinRoom("lab", peer)
+	if _, ok := ss.GetRoom("lab"); !ok {
+		t.Fatal("room should exist after join")
+	}
+
+	ss.LeaveRoom("lab", peer.ID)
+	if _, ok := ss.GetRoom("lab"); ok {
+		t.Error("empty room should be removed")
+	}
+}
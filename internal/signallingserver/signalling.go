@@ -1,9 +1,12 @@
 package signallingserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -16,9 +19,13 @@ const (
 )
 
 type SignallingServer struct {
-	UserMap     sync.Map
-	TCPListener net.Listener
-	bufferPool  sync.Pool
+	UserMap      sync.Map
+	RoomMap      sync.Map
+	TCPListener  net.Listener
+	HTTPListener net.Listener
+	StartTime    time.Time
+	Mailbox      *Mailbox
+	bufferPool   sync.Pool
 }
 
 func NewSignallingServer(cfg *config.Config) (*SignallingServer, error) {
@@ -31,8 +38,34 @@ func NewSignallingServer(cfg *config.Config) (*SignallingServer, error) {
 	}
 
 	log.Printf("Signalling Server started at addr %s", address)
+
+	var httpListener net.Listener
+	if cfg.HTTPPort != "" {
+		httpAddress := ":" + cfg.HTTPPort
+		httpListener, err = net.Listen("tcp", httpAddress)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		log.Printf("HTTP/WebSocket endpoint started at addr %s", httpAddress)
+	}
+
+	var mailbox *Mailbox
+	if cfg.MailboxDir != "" {
+		mailbox, err = NewMailbox(cfg.MailboxDir, cfg.MailboxQuota, cfg.MailboxTTL)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		log.Printf("Mailbox enabled at %s (quota %d bytes, ttl %s)",
+			cfg.MailboxDir, cfg.MailboxQuota, cfg.MailboxTTL)
+	}
+
 	return &SignallingServer{
-		TCPListener: listener,
+		Mailbox:      mailbox,
+		TCPListener:  listener,
+		HTTPListener: httpListener,
+		StartTime:    time.Now(),
 		bufferPool: sync.Pool{
 			New: func() any {
 				return make([]byte, bufferSize)
@@ -55,14 +88,17 @@ func (ss *SignallingServer) SendToPeer(peer *Peer, opCode byte,
 	copy(message, buf[:n])
 	ss.PutBuffer(buf)
 
-	select {
-	case peer.Outgoing <- message:
-		return nil
-	case <-time.After(1 * time.Second):
-		ss.RemoveUser(peer.ID)
-		return fmt.Errorf("timeout sending message to peer %s",
-			peer.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := peer.Send(ctx, message); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			ss.RemoveUser(peer.ID)
+			return fmt.Errorf("timeout sending message to peer %s",
+				peer.ID)
+		}
+		return err
 	}
+	return nil
 }
 
 func (ss *SignallingServer) GetBuffer() []byte {
@@ -78,6 +114,18 @@ func (ss *SignallingServer) PutBuffer(buf []byte) {
 }
 
 func (ss *SignallingServer) Start() error {
+	if ss.Mailbox != nil {
+		go ss.Mailbox.RunSweeper()
+	}
+
+	if ss.HTTPListener != nil {
+		go func() {
+			if err := http.Serve(ss.HTTPListener, ss.HTTPHandler()); err != nil {
+				log.Printf("HTTP server stopped: %v", err)
+			}
+		}()
+	}
+
 	for {
 		conn, err := ss.TCPListener.Accept()
 		if err != nil {
@@ -92,6 +140,7 @@ func (ss *SignallingServer) AddUser(id string, peer *Peer) {
 }
 
 func (ss *SignallingServer) RemoveUser(id string) {
+	ss.leaveAllRooms(id)
 	if user, ok := ss.UserMap.LoadAndDelete(id); ok {
 		if peer, ok := user.(*Peer); ok {
 			peer.CloseOutgoing()
@@ -0,0 +1,19 @@
+package signallingserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+)
+
+// HandleWebSocket serves browsers speaking the binary protocol over a
+// WebSocket, one message per frame. Only pages served by this server, the
+// web UI, may connect; other sites the user visits are turned away.
+func (ss *SignallingServer) HandleWebSocket() http.Handler {
+	return network.WebSocketHandler(nil, func(conn network.MessageConn) {
+		if err := ss.serveConn(conn); err != nil {
+			log.Printf("WebSocket connection from %s closed: %v", conn.RemoteAddr(), err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package signallingserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer() *SignallingServer {
+	return &SignallingServer{
+		StartTime: time.Now(),
+		bufferPool: sync.Pool{
+			New: func() any {
+				return make([]byte, bufferSize)
+			},
+		},
+	}
+}
+
+func wsSend(t *testing.T, conn *websocket.Conn, opCode byte, payload []byte) {
+	t.Helper()
+	buf := make([]byte, bufferSize)
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err != nil {
+		t.Fatalf("failed to make message: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+}
+
+func wsRead(t *testing.T, conn *websocket.Conn) (byte, []byte) {
+	t.Helper()
+	_, r, err := conn.NextReader()
+	if err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	buf := make([]byte, bufferSize)
+	opCode, n, err := protocol.DecodeMessage(r, buf)
+	if err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	return opCode, buf[:n]
+}
+
+func TestWebSocketRegisterAndLookup(t *testing.T) {
+	ss := newTestServer()
+	srv := httptest.NewServer(ss.HTTPHandler())
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	register := func() (*websocket.Conn, string) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("failed to dial websocket: %v", err)
+		}
+		info, _ := json.Marshal(PeerInfo{Type: PeerTypeBrowser})
+		wsSend(t, conn, protocol.ServerHello, info)
+		opCode, payload := wsRead(t, conn)
+		if opCode != protocol.ServerAck {
+			t.Fatalf("expected ServerAck, got opcode %d", opCode)
+		}
+		return conn, string(payload)
+	}
+
+	alice, _ := register()
+	defer alice.Close()
+	bob, bobID := register()
+	defer bob.Close()
+
+	lookup, _ := json.Marshal(PeerLookUp{PeerID: bobID})
+	wsSend(t, alice, protocol.PeerInfoLookup, lookup)
+
+	opCode, payload := wsRead(t, alice)
+	if opCode != protocol.PeerLookupAck {
+		t.Fatalf("expected PeerLookupAck, got opcode %d: %s", opCode, payload)
+	}
+
+	var info PeerInfo
+	if err := json.Unmarshal(payload, &info); err != nil {
+		t.Fatalf("failed to decode peer info: %v", err)
+	}
+	if info.Type != PeerTypeBrowser {
+		t.Errorf("peer type = %q, want %q", info.Type, PeerTypeBrowser)
+	}
+
+	if opCode, _ := wsRead(t, bob); opCode != protocol.PeerInfoForward {
+		t.Errorf("expected PeerInfoForward on target, got opcode %d", opCode)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("status request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var status ServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if status.PeersByType[PeerTypeBrowser] != 2 {
+		t.Errorf("browser peers = %d, want 2", status.PeersByType[PeerTypeBrowser])
+	}
+}
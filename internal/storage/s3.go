@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// unsignedPayload lets uploads stream without hashing the body first.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var errUploadAborted = errors.New("upload aborted")
+
+// S3 is a bucket on an S3-compatible object store (AWS, MinIO, ...). It is
+// both a Sink, storing each file as one object, and a source of objects
+// to send. Objects are addressed path-style and requests signed with AWS
+// Signature Version 4. Uploads are single PUTs, so files are limited to
+// the store's maximum object size for one request (5GiB on AWS) and must
+// have a known size.
+type S3 struct {
+	// Endpoint is the store's base URL, e.g. http://localhost:9000.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to the base of each incoming file's name.
+	Prefix string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Create uploads the file as it arrives.
+func (s *S3) Create(name string, size uint64) (SinkFile, error) {
+	if size == UnknownSize {
+		return nil, fmt.Errorf("cannot upload %s: s3 objects need their size up front", name)
+	}
+	key := s.Prefix + path.Base(filepath.ToSlash(name))
+	req, err := s.request(http.MethodPut, key)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req.Body = pr
+	req.ContentLength = int64(size)
+	if size == 0 {
+		req.Body = http.NoBody
+		pw.Close()
+	}
+
+	upload := &s3Upload{inOrder: newInOrder(pw, size), pw: pw, done: make(chan struct{})}
+	go func() {
+		upload.err = s.do(req, http.StatusOK)
+		pr.Close()
+		close(upload.done)
+	}()
+	return upload, nil
+}
+
+type s3Upload struct {
+	*inOrder
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (u *s3Upload) Commit() error {
+	if err := u.complete(); err != nil {
+		u.Abort()
+		return err
+	}
+	u.pw.Close()
+	<-u.done
+	return u.err
+}
+
+func (u *s3Upload) Abort() error {
+	u.pw.CloseWithError(errUploadAborted)
+	<-u.done
+	return nil
+}
+
+// Open returns the object at key as a source, read with range requests.
+func (s *S3) Open(key string) (Source, error) {
+	req, err := s.request(http.MethodHead, key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 HEAD %s: %w", key, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 HEAD %s: %s", key, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("s3 HEAD %s: no content length", key)
+	}
+
+	return &s3Object{store: s, key: key, size: uint64(resp.ContentLength)}, nil
+}
+
+type s3Object struct {
+	store *S3
+	key   string
+	size  uint64
+}
+
+func (o *s3Object) Name() string     { return path.Base(o.key) }
+func (o *s3Object) Size() uint64     { return o.size }
+func (o *s3Object) Sequential() bool { return false }
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if uint64(off) >= o.size {
+		return 0, io.EOF
+	}
+	length := min(uint64(len(p)), o.size-uint64(off))
+
+	req, err := o.store.request(http.MethodGet, o.key)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, uint64(off)+length-1))
+
+	resp, err := o.store.client().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("s3 GET %s: %w", o.key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("s3 GET %s: %s", o.key, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p[:length])
+	if err == nil && length < uint64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// do sends a signed request and checks the status, including the error
+// body S3 returns in the message.
+func (s *S3) do(req *http.Request, want int) error {
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("s3 %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// request builds a request for key, signed with an unsigned payload so
+// the body can be streamed.
+func (s *S3) request(method string, key string) (*http.Request, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	endpoint.Path = "/" + s.Bucket + "/" + strings.TrimPrefix(key, "/")
+	endpoint.RawPath = s3Escape(endpoint.Path)
+
+	req, err := http.NewRequest(method, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a path the way SigV4 expects: everything but
+// unreserved characters and the slashes between segments.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
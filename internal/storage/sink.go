@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemorySink keeps incoming files in memory, keyed by name.
+type MemorySink struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{files: make(map[string][]byte)}
+}
+
+func (s *MemorySink) Create(name string, size uint64) (SinkFile, error) {
+	return &memoryFile{sink: s, name: name, size: size}, nil
+}
+
+// File returns a committed file's content.
+func (s *MemorySink) File(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// memoryFile grows as chunks arrive rather than trusting the announced
+// size with one allocation.
+type memoryFile struct {
+	sink *MemorySink
+	name string
+	size uint64
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	end := uint64(off) + uint64(len(p))
+	if f.size != UnknownSize && end > f.size {
+		return 0, fmt.Errorf("write at %d runs past the %d byte file", off, f.size)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end > uint64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-uint64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memoryFile) Commit() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size != UnknownSize && uint64(len(f.data)) != f.size {
+		return fmt.Errorf("file incomplete: %d of %d bytes written", len(f.data), f.size)
+	}
+
+	f.sink.mu.Lock()
+	defer f.sink.mu.Unlock()
+	f.sink.files[f.name] = f.data
+	return nil
+}
+
+func (f *memoryFile) Abort() error { return nil }
+
+// WriterSink writes incoming files to w one after another, e.g. to stdout.
+// A file is refused while another is still arriving, so their bytes never
+// interleave. Bytes already written stay written if a transfer fails.
+type WriterSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	busy bool
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Create(name string, size uint64) (SinkFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy {
+		return nil, fmt.Errorf("cannot write %s: another file is still arriving", name)
+	}
+	s.busy = true
+	return &streamFile{inOrder: newInOrder(s.w, size), done: s.release}, nil
+}
+
+func (s *WriterSink) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+}
+
+// streamFile is a file written in order to a shared stream; done lets the
+// next file start.
+type streamFile struct {
+	*inOrder
+	done func()
+}
+
+func (f *streamFile) Commit() error {
+	defer f.done()
+	return f.complete()
+}
+
+func (f *streamFile) Abort() error {
+	f.done()
+	return nil
+}
+
+// TarSink writes each incoming file as an entry of a tar stream, named by
+// the base of the sender's file name. Close ends the archive. A failed
+// transfer leaves its entry short, so the sink refuses further files.
+// Entry headers carry the size, so streams of UnknownSize are refused.
+type TarSink struct {
+	mu     sync.Mutex
+	tw     *tar.Writer
+	busy   bool
+	broken error
+}
+
+func NewTarSink(w io.Writer) *TarSink {
+	return &TarSink{tw: tar.NewWriter(w)}
+}
+
+func (s *TarSink) Create(name string, size uint64) (SinkFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken != nil {
+		return nil, s.broken
+	}
+	if s.busy {
+		return nil, fmt.Errorf("cannot write %s: another file is still arriving", name)
+	}
+	if size == UnknownSize {
+		return nil, fmt.Errorf("cannot write %s: tar entries need their size up front", name)
+	}
+
+	err := s.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Base(filepath.ToSlash(name)),
+		Size:     int64(size),
+		Mode:     0o644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		s.broken = fmt.Errorf("tar stream failed: %w", err)
+		return nil, s.broken
+	}
+
+	s.busy = true
+	return &tarEntry{sink: s, inOrder: newInOrder(s.tw, size), name: name}, nil
+}
+
+// Close writes the end of the archive.
+func (s *TarSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken != nil {
+		return s.broken
+	}
+	return s.tw.Close()
+}
+
+type tarEntry struct {
+	*inOrder
+	sink *TarSink
+	name string
+}
+
+func (e *tarEntry) Commit() error {
+	err := e.complete()
+	if err == nil {
+		e.sink.mu.Lock()
+		err = e.sink.tw.Flush()
+		e.sink.mu.Unlock()
+	}
+	if err != nil {
+		e.Abort()
+		return err
+	}
+
+	e.sink.mu.Lock()
+	defer e.sink.mu.Unlock()
+	e.sink.busy = false
+	return nil
+}
+
+func (e *tarEntry) Abort() error {
+	e.sink.mu.Lock()
+	defer e.sink.mu.Unlock()
+	e.sink.busy = false
+	e.sink.broken = fmt.Errorf("tar stream ends inside %s", e.name)
+	return nil
+}
+
+// NextTarSource returns the next regular file in tr as a sequential
+// source, skipping directories and links, or io.EOF at the end.
+func NextTarSource(tr *tar.Reader) (Source, error) {
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			return &readerSource{
+				name:       header.Name,
+				size:       uint64(header.Size),
+				ReaderAt:   &orderedReader{r: tr},
+				sequential: true,
+			}, nil
+		}
+	}
+}
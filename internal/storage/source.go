@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileSource reads a file on disk.
+type FileSource struct {
+	file *os.File
+	name string
+	size uint64
+	path string
+}
+
+// OpenFile opens the regular file at path for sending.
+func OpenFile(path string) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	return &FileSource{file: file, name: info.Name(), size: uint64(info.Size()), path: path}, nil
+}
+
+func (f *FileSource) Name() string     { return f.name }
+func (f *FileSource) Size() uint64     { return f.size }
+func (f *FileSource) Sequential() bool { return false }
+
+func (f *FileSource) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+// Path is the file's location.
+func (f *FileSource) Path() string { return f.path }
+
+func (f *FileSource) Close() error {
+	return f.file.Close()
+}
+
+// ReaderSource sends size bytes from r as a file called name, reading at
+// random offsets when r supports it and in order otherwise. A size of
+// UnknownSize makes it a StreamSource.
+func ReaderSource(name string, size uint64, r io.Reader) Source {
+	if size == UnknownSize {
+		return StreamSource(name, r)
+	}
+	if at, ok := r.(io.ReaderAt); ok {
+		return &readerSource{name: name, size: size, ReaderAt: at}
+	}
+	return &readerSource{name: name, size: size, ReaderAt: &orderedReader{r: r}, sequential: true}
+}
+
+// StreamSource sends everything r yields until EOF as a file called name,
+// for pipes and other streams whose length is not known up front. Its size
+// is UnknownSize.
+func StreamSource(name string, r io.Reader) Source {
+	return &readerSource{name: name, size: UnknownSize, ReaderAt: &orderedReader{r: r}, sequential: true}
+}
+
+// BytesSource sends data as a file called name.
+func BytesSource(name string, data []byte) Source {
+	return ReaderSource(name, uint64(len(data)), bytes.NewReader(data))
+}
+
+type readerSource struct {
+	io.ReaderAt
+	name       string
+	size       uint64
+	sequential bool
+}
+
+func (r *readerSource) Name() string     { return r.name }
+func (r *readerSource) Size() uint64     { return r.size }
+func (r *readerSource) Sequential() bool { return r.sequential }
+
+// orderedReader serves ReadAt from a plain reader as long as offsets never
+// go backwards; skipped ranges, such as a resumed prefix, are discarded.
+type orderedReader struct {
+	r   io.Reader
+	off int64
+}
+
+func (o *orderedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < o.off {
+		return 0, fmt.Errorf("cannot seek back to %d in a stream at %d", off, o.off)
+	}
+	if off > o.off {
+		skipped, err := io.CopyN(io.Discard, o.r, off-o.off)
+		o.off += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(o.r, p)
+	o.off += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
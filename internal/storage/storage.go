@@ -0,0 +1,119 @@
+// Package storage holds the backends transfers read from and write to:
+// files, standard streams, memory, tar streams and S3-compatible object
+// stores.
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// UnknownSize is the size of a stream whose length is only known once it
+// ends. It matches the value announced on the wire.
+const UnknownSize = math.MaxUint64
+
+// Source is the content of one outgoing file.
+type Source interface {
+	io.ReaderAt
+	Name() string
+	Size() uint64
+	// Sequential sources can only be read front to back, so they are sent
+	// over a single stream.
+	Sequential() bool
+}
+
+// Sink stores incoming files.
+type Sink interface {
+	// Create starts a file of size bytes named by the sender, or of
+	// UnknownSize for a stream. Sinks that write to a filesystem use only
+	// the base of name.
+	Create(name string, size uint64) (SinkFile, error)
+}
+
+// SinkFile is one incoming file. Chunks arrive through WriteAt, in any
+// order when the sender stripes them over several streams. Commit is
+// called once every chunk has arrived and Abort if the transfer fails;
+// either one ends the file.
+type SinkFile interface {
+	io.WriterAt
+	Commit() error
+	Abort() error
+}
+
+// inOrder turns WriteAt calls into ordered writes to w, holding chunks
+// that arrive ahead of the next offset. The sender's ack window bounds how
+// much is held.
+type inOrder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	size    uint64
+	next    int64
+	pending map[int64][]byte
+	err     error
+}
+
+func newInOrder(w io.Writer, size uint64) *inOrder {
+	return &inOrder{w: w, size: size, pending: make(map[int64][]byte)}
+}
+
+func (o *inOrder) WriteAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err != nil {
+		return 0, o.err
+	}
+	if off < o.next {
+		return 0, fmt.Errorf("bytes at %d already written", off)
+	}
+	if o.size != UnknownSize && uint64(off)+uint64(len(p)) > o.size {
+		return 0, fmt.Errorf("write at %d runs past the %d byte file", off, o.size)
+	}
+	if off > o.next {
+		o.pending[off] = bytes.Clone(p)
+		return len(p), nil
+	}
+
+	if err := o.write(p); err != nil {
+		return 0, err
+	}
+	for {
+		held, ok := o.pending[o.next]
+		if !ok {
+			return len(p), nil
+		}
+		delete(o.pending, o.next)
+		if err := o.write(held); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (o *inOrder) write(p []byte) error {
+	n, err := o.w.Write(p)
+	o.next += int64(n)
+	if err != nil {
+		o.err = err
+	}
+	return err
+}
+
+// complete reports whether every byte reached w.
+func (o *inOrder) complete() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err != nil {
+		return o.err
+	}
+	if len(o.pending) != 0 {
+		return fmt.Errorf("file incomplete: gap at byte %d", o.next)
+	}
+	if o.size != UnknownSize && uint64(o.next) != o.size {
+		return fmt.Errorf("file incomplete: %d of %d bytes written", o.next, o.size)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeChunks writes data to f in chunks of size n, last chunk first, as
+// striped streams can deliver them.
+func writeChunks(t *testing.T, f SinkFile, data []byte, n int) {
+	t.Helper()
+	for off := (len(data) - 1) / n * n; off >= 0; off -= n {
+		end := min(off+n, len(data))
+		if _, err := f.WriteAt(data[off:end], int64(off)); err != nil {
+			t.Fatalf("write at %d failed: %v", off, err)
+		}
+	}
+}
+
+func TestWriterSinkReordersChunks(t *testing.T) {
+	data := make([]byte, 10_000)
+	rand.Read(data)
+
+	var out bytes.Buffer
+	sink := NewWriterSink(&out)
+	file, err := sink.Create("a.bin", uint64(len(data)))
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := sink.Create("b.bin", 1); err == nil {
+		t.Fatal("second file accepted while the first was arriving")
+	}
+
+	writeChunks(t, file, data, 999)
+	if err := file.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("stream content differs from what was written")
+	}
+	if _, err := sink.Create("b.bin", 1); err != nil {
+		t.Fatalf("next file refused after commit: %v", err)
+	}
+}
+
+func TestWriterSinkRejectsIncompleteFile(t *testing.T) {
+	file, err := NewWriterSink(io.Discard).Create("a.bin", 10)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	file.WriteAt([]byte("hello"), 5)
+	if err := file.Commit(); err == nil {
+		t.Fatal("commit succeeded with the first half missing")
+	}
+}
+
+func TestTarSinkRoundTrip(t *testing.T) {
+	files := map[string][]byte{"one.txt": []byte("first file"), "two.bin": make([]byte, 3000)}
+	rand.Read(files["two.bin"])
+
+	var archive bytes.Buffer
+	sink := NewTarSink(&archive)
+	for _, name := range []string{"one.txt", "../two.bin"} {
+		data := files[strings.TrimPrefix(name, "../")]
+		file, err := sink.Create(name, uint64(len(data)))
+		if err != nil {
+			t.Fatalf("create %s failed: %v", name, err)
+		}
+		writeChunks(t, file, data, 512)
+		if err := file.Commit(); err != nil {
+			t.Fatalf("commit %s failed: %v", name, err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	tr := tar.NewReader(&archive)
+	for range files {
+		src, err := NextTarSource(tr)
+		if err != nil {
+			t.Fatalf("next entry failed: %v", err)
+		}
+		want, ok := files[src.Name()]
+		if !ok || !src.Sequential() || src.Size() != uint64(len(want)) {
+			t.Fatalf("unexpected entry %s (%d bytes)", src.Name(), src.Size())
+		}
+		got := make([]byte, src.Size())
+		if _, err := src.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("read %s failed: %v", src.Name(), err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s content differs", src.Name())
+		}
+	}
+	if _, err := NextTarSource(tr); err != io.EOF {
+		t.Fatalf("after last entry got %v, want io.EOF", err)
+	}
+}
+
+func TestMemorySinkKeepsCommittedFiles(t *testing.T) {
+	sink := NewMemorySink()
+	file, err := sink.Create("note.txt", 5)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("toolong"), 0); err == nil {
+		t.Fatal("write past the announced size accepted")
+	}
+	file.WriteAt([]byte("lo"), 3)
+	file.WriteAt([]byte("hel"), 0)
+	if _, ok := sink.File("note.txt"); ok {
+		t.Fatal("file visible before commit")
+	}
+	if err := file.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if got, _ := sink.File("note.txt"); string(got) != "hello" {
+		t.Fatalf("stored %q, want hello", got)
+	}
+}
+
+// fakeS3 is an in-memory object store that checks each request is signed
+// for its bucket, like MinIO with a single access key.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	store   *S3
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, "missing date", http.StatusForbidden)
+		return
+	}
+	got := r.Header.Get("Authorization")
+	check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.EscapedPath(), nil)
+	f.store.sign(check, date)
+	if got != check.Header.Get("Authorization") {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case http.MethodHead, http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if start, end, err := parseRange(r.Header.Get("Range")); err == nil {
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseRange(header string) (start, end int, err error) {
+	from, to, _ := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+	if start, err = strconv.Atoi(from); err != nil {
+		return 0, 0, err
+	}
+	end, err = strconv.Atoi(to)
+	return start, end, err
+}
+
+func TestS3SinkAndSource(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := &S3{
+		Endpoint:  srv.URL,
+		Region:    "us-east-1",
+		Bucket:    "drops",
+		Prefix:    "in/",
+		AccessKey: "minio",
+		SecretKey: "minio-secret",
+	}
+	fake.store = store
+
+	data := make([]byte, 70_000)
+	rand.Read(data)
+	file, err := store.Create("../report v2.bin", uint64(len(data)))
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	writeChunks(t, file, data, 16_384)
+	if err := file.Commit(); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	src, err := store.Open("in/report v2.bin")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if src.Size() != uint64(len(data)) || src.Name() != "report v2.bin" {
+		t.Fatalf("object is %s (%d bytes)", src.Name(), src.Size())
+	}
+	got := make([]byte, 1000)
+	if n, err := src.ReadAt(got, 69_500); n != 500 || err != io.EOF {
+		t.Fatalf("tail read = %d, %v; want 500, io.EOF", n, err)
+	}
+	if !bytes.Equal(got[:500], data[69_500:]) {
+		t.Fatal("range read returned the wrong bytes")
+	}
+
+	bad := *store
+	bad.SecretKey = "wrong"
+	upload, err := bad.Create("x.bin", 1)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	upload.WriteAt([]byte{1}, 0)
+	if err := upload.Commit(); err == nil {
+		t.Fatal("upload signed with the wrong secret succeeded")
+	}
+}
+
+func TestStreamOfUnknownSize(t *testing.T) {
+	data := []byte("a stream whose length nobody knew")
+
+	var out bytes.Buffer
+	file, err := NewWriterSink(&out).Create("pipe", UnknownSize)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	writeChunks(t, file, data, 5)
+	if err := file.Commit(); err != nil || out.String() != string(data) {
+		t.Fatalf("commit = %v, wrote %q", err, out.String())
+	}
+
+	if _, err := NewTarSink(io.Discard).Create("pipe", UnknownSize); err == nil {
+		t.Fatal("tar sink accepted an entry of unknown size")
+	}
+
+	src := StreamSource("pipe", bytes.NewReader(data))
+	if src.Size() != UnknownSize || !src.Sequential() {
+		t.Fatalf("stream source is %d bytes, sequential %v", src.Size(), src.Sequential())
+	}
+}
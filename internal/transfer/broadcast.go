@@ -0,0 +1,181 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+)
+
+const broadcastProgressInterval = 2 * time.Second
+
+// BroadcastResult is the outcome of sending to one room member.
+type BroadcastResult struct {
+	PeerID   string
+	Bytes    uint64
+	Duration time.Duration
+	Err      error
+}
+
+type recipient struct {
+	member signallingserver.RoomMember
+	client *Client
+}
+
+func (c *Client) lookupRoom(ctx context.Context,
+	room string) ([]signallingserver.RoomMember, error) {
+	payload, err := json.Marshal(signallingserver.RoomLookUp{Room: room})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode room lookup: %w", err)
+	}
+
+	members, err := signalList[signallingserver.RoomMember](ctx, c, protocol.RoomLookup,
+		payload, protocol.RoomLookupAck)
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// HandleBroadcastCommand sends one file to every member of a room in
+// parallel, each over its own peer connection.
+func (c *Client) HandleBroadcastCommand(ctx context.Context, room string,
+	filepath string, passphrase string) error {
+	fileInfo, err := os.Stat(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to process file: %w", err)
+	}
+	fileSize := uint64(fileInfo.Size())
+
+	members, err := c.lookupRoom(ctx, room)
+	if err != nil {
+		return fmt.Errorf("room lookup failed: %w", err)
+	}
+
+	log.Printf("Broadcasting to %d peers in room %s", len(members), room)
+	for _, member := range members {
+		c.emit(Event{Type: EventPeerFound, PeerID: member.PeerID})
+	}
+
+	recipients := make([]*recipient, len(members))
+	for i, member := range members {
+		recipients[i] = &recipient{member: member, client: c.peerClient()}
+		c.peers.Store(recipients[i].client, struct{}{})
+		defer c.peers.Delete(recipients[i].client)
+	}
+
+	results := make([]BroadcastResult, len(recipients))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i, r := range recipients {
+		wg.Add(1)
+		go func(i int, r *recipient) {
+			defer wg.Done()
+			results[i] = r.send(ctx, filepath, fileSize, passphrase)
+		}(i, r)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(broadcastProgressInterval)
+	defer ticker.Stop()
+
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			for _, r := range recipients {
+				r.logProgress()
+			}
+		case <-done:
+			running = false
+		}
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			log.Printf("[%s] failed: %v", result.PeerID, result.Err)
+			continue
+		}
+		log.Printf("[%s] sent %d bytes in %s", result.PeerID, result.Bytes,
+			result.Duration.String())
+	}
+
+	log.Printf("Broadcast to room %s: %d/%d succeeded", room,
+		len(results)-failed, len(results))
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("broadcast interrupted: %w", context.Cause(ctx))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: broadcast failed for %d of %d peers", ErrTransferFailed,
+			failed, len(results))
+	}
+
+	return nil
+}
+
+func (r *recipient) send(ctx context.Context, filepath string, fileSize uint64,
+	passphrase string) BroadcastResult {
+	result := BroadcastResult{PeerID: r.member.PeerID}
+	start := time.Now()
+	info := r.member.Info
+
+	if info.Type == signallingserver.PeerTypeBrowser {
+		result.Err = fmt.Errorf("browser peers must be sent to from the web UI")
+		return result
+	}
+
+	if len(passphrase) != 0 {
+		if err := r.client.decryptPeerAddresses(&info, passphrase); err != nil {
+			result.Err = fmt.Errorf("failed to decrypt addresses: %w", err)
+			return result
+		}
+	}
+
+	peerConn, transport, err := network.RaceConnections(ctx, dialCandidates(info))
+	if err != nil {
+		result.Err = fmt.Errorf("%w: %w", ErrUnreachable, err)
+		return result
+	}
+	defer peerConn.Close()
+
+	r.client.Transport = transport
+	log.Printf("[%s] connected via %s", r.member.PeerID, transport.Name())
+	r.client.emitConnected(r.member.PeerID, peerConn)
+
+	if err := r.client.transferFile(ctx, filepath, peerConn); err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Bytes = fileSize
+	result.Duration = time.Since(start)
+	return result
+}
+
+func (r *recipient) logProgress() {
+	r.client.Transfers.Range(func(_, value any) bool {
+		ft := value.(*FileTransfer)
+		sent := ft.Transferred.Load()
+		percent := 100.0
+		if ft.Filesize > 0 {
+			percent = float64(sent) * 100 / float64(ft.Filesize)
+		}
+		log.Printf("[%s] %s: %.1f%% (%d/%d bytes)", r.member.PeerID,
+			ft.Filename, percent, sent, ft.Filesize)
+		return true
+	})
+}
@@ -0,0 +1,162 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const abortWriteTimeout = 2 * time.Second
+
+// interrupted marks err as caused by ctx when ctx is done, so callers see
+// the cancellation rather than the I/O error it provoked.
+func interrupted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", context.Cause(ctx), err)
+}
+
+// transferFailure builds the error sent to the peer when this side cannot
+// carry on with a transfer.
+func transferFailure(code protocol.ErrorCode, transferID uint32,
+	err error) *protocol.TransferError {
+	return &protocol.TransferError{Code: code, TransferID: transferID, Message: err.Error()}
+}
+
+// sendTransferError writes an Error, TransferCancel or TransferAbort. It is
+// best effort: the connection may already be the thing that failed.
+func sendTransferError(conn network.MessageConn, opCode byte, e *protocol.TransferError) {
+	payload := protocol.CreateErrorPayload(e)
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err != nil {
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(abortWriteTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	conn.WriteMessage(buf[:n])
+}
+
+// dropTransfer forgets a transfer that will not complete, removing the
+// partial file if this side was receiving it.
+func (c *Client) dropTransfer(transferID uint32, reason error) {
+	value, ok := c.Transfers.LoadAndDelete(transferID)
+	if !ok {
+		return
+	}
+	ft := value.(*FileTransfer)
+
+	if ft.File != nil {
+		if err := ft.File.Abort(); err != nil {
+			log.Printf("Failed to discard partial file %s: %v", ft.Filename, err)
+		}
+	}
+
+	c.finishProgress(ft, ProgressFailed, reason)
+	c.emit(Event{
+		Type:        EventFailed,
+		TransferID:  transferID,
+		File:        ft.Filename,
+		Path:        ft.Path,
+		Direction:   ft.Direction,
+		State:       ProgressFailed,
+		Bytes:       ft.Transferred.Load(),
+		Total:       ft.Filesize,
+		ContentType: ft.ContentType,
+		Error:       reason.Error(),
+	})
+	log.Printf("Transfer %d: aborted: %v", transferID, reason)
+}
+
+// CancelTransfer stops an in-flight transfer and tells the peer, which
+// cleans up its side as well.
+func (c *Client) CancelTransfer(transferID uint32, reason string) error {
+	ft, ok := c.ownerOf(transferID).Transfer(transferID)
+	if !ok {
+		return fmt.Errorf("no transfer with ID %d", transferID)
+	}
+	if ft.cancel == nil {
+		return fmt.Errorf("transfer %d cannot be cancelled", transferID)
+	}
+
+	ft.cancel(&protocol.TransferError{
+		Code:       protocol.CodeCancelled,
+		TransferID: transferID,
+		Message:    reason,
+	})
+	return nil
+}
+
+// CancelTransfers cancels every in-flight transfer.
+func (c *Client) CancelTransfers(reason string) {
+	c.forEachTransfer(func(owner *Client, transferID uint32) {
+		owner.CancelTransfer(transferID, reason)
+	})
+}
+
+// forEachTransfer calls fn for every transfer of c and of any broadcast
+// recipients or reader sends it is running.
+func (c *Client) forEachTransfer(fn func(owner *Client, transferID uint32)) {
+	c.Transfers.Range(func(key, _ any) bool {
+		fn(c, key.(uint32))
+		return true
+	})
+	c.peers.Range(func(key, _ any) bool {
+		key.(*Client).forEachTransfer(fn)
+		return true
+	})
+}
+
+// ownerOf returns the client running transferID: c itself or one of the
+// per-peer clients it started.
+func (c *Client) ownerOf(transferID uint32) *Client {
+	owner := c
+	c.forEachTransfer(func(o *Client, id uint32) {
+		if id == transferID {
+			owner = o
+		}
+	})
+	return owner
+}
+
+// streamStop ends every stream of an outgoing transfer at once, keeping
+// the first reason: a cancel on this side or an abort from the receiver.
+type streamStop struct {
+	conns []network.MessageConn
+	done  chan struct{}
+	mu    sync.Mutex
+	err   error
+}
+
+func newStreamStop(conns []network.MessageConn) *streamStop {
+	return &streamStop{conns: conns, done: make(chan struct{})}
+}
+
+// stop records err and closes the streams so blocked writes return.
+func (s *streamStop) stop(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+
+	s.err = err
+	close(s.done)
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Err returns why the transfer was stopped, or nil.
+func (s *streamStop) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -1,68 +1,204 @@
 package transfer
 
 import (
+	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"time"
 
+	"github.com/KD0S-02/KDTransfer/internal/codec"
 	"github.com/KD0S-02/KDTransfer/internal/config"
 	"github.com/KD0S-02/KDTransfer/internal/crypto"
 	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/portmap"
 	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
 	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
 )
 
 type Client struct {
-	Config     *config.Config
-	SignalConn net.Conn
-	ConnType   network.ConnType
-	Transfers  sync.Map
-	Key        []byte
+	Config         *config.Config
+	SignalConn     network.MessageConn
+	Transport      network.Transport
+	Transfers      sync.Map
+	Key            []byte
+	ID             string
+	SaltData       string
+	passphrase     string // derive Key from the receiver's hello salt
+	Identity       string
+	identitySecret string
+	mailboxNonce   []byte // server's challenge for mailbox requests
+	portMapping    *portmap.Mapping
+	Limiter        *ratelimit.Limiter
+	// Sink receives incoming files; nil writes them into ReceiveDir.
+	Sink storage.Sink
+
+	// OnProgress, when set, receives a ProgressEvent for every transfer
+	// about four times a second and once when it ends. It may be called
+	// from several goroutines at once.
+	OnProgress func(ProgressEvent)
+	// OnEvent, when set, receives registration, lookup, connection,
+	// completion and failure events for machine-readable output.
+	OnEvent func(Event)
+	// OnMessage, when set, receives typed messages such as text, which
+	// are not stored through Sink.
+	OnMessage func(Message)
+
+	// peers holds the per-recipient clients of a running broadcast or
+	// SendReader, so commands on this client reach their transfers too.
+	peers sync.Map
 }
 
-func NewClient() (*Client, error) {
-	cfg := config.LoadConfig()
+func NewClient(ctx context.Context) (*Client, error) {
+	client := NewClientWithConfig(config.LoadConfig())
+	if err := client.ConnectServer(ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewLANClient creates a client that works without a signalling server,
+// finding peers through mDNS instead.
+func NewLANClient() *Client {
+	return NewClientWithConfig(config.LoadConfig())
+}
+
+// NewClientWithConfig creates a client from cfg without reading .env or
+// connecting anywhere; call ConnectServer to use the signalling server.
+func NewClientWithConfig(cfg *config.Config) *Client {
+	client := &Client{
+		Config:  cfg,
+		Limiter: ratelimit.NewLimiter(cfg.RateLimit),
+	}
 
-	conn, err := net.DialTimeout("tcp",
-		cfg.SignallingServerHost+":"+cfg.SignallingServerPort, 5*time.Second)
+	var err error
+	client.identitySecret, client.Identity, err = loadIdentity(cfg.IdentityFile)
 	if err != nil {
-		return nil, err
+		log.Printf("Persistent identity unavailable, mailbox disabled: %v", err)
 	}
 
-	return &Client{
-		SignalConn: conn,
-		Config:     cfg,
-	}, nil
+	if path := candidateHistoryPath(cfg); path != "" {
+		if err := network.LoadCandidateHistory(path); err != nil {
+			log.Printf("Candidate history unavailable: %v", err)
+		}
+	}
+
+	return client
 }
 
-func (c *Client) RegisterWithServer(passphrase string) (string, error) {
+// candidateHistoryPath is where connection scores persist between runs:
+// CANDIDATE_HISTORY, or next to the identity file by default. "none"
+// keeps them in memory.
+func candidateHistoryPath(cfg *config.Config) string {
+	switch cfg.CandidateHistory {
+	case "none":
+		return ""
+	case "":
+		if cfg.IdentityFile == "" {
+			return ""
+		}
+		return filepath.Join(filepath.Dir(cfg.IdentityFile), "candidates.json")
+	}
+	return cfg.CandidateHistory
+}
+
+// ConnectServer opens the connection to the configured signalling server.
+func (c *Client) ConnectServer(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp",
+		c.Config.SignallingServerHost+":"+c.Config.SignallingServerPort)
+	if err != nil {
+		return err
+	}
+	c.SignalConn = network.NewStreamConn(conn)
+	return nil
+}
+
+// setupKey derives this client's receive key from the passphrase and a
+// fresh salt that is published to senders alongside its addresses.
+func (c *Client) setupKey(passphrase string) error {
+	if len(passphrase) == 0 {
+		return nil
+	}
+
+	c.SaltData = crypto.GenerateRandSalt()
+
+	var err error
+	c.Key, err = crypto.GenerateKey(passphrase, c.SaltData)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	return nil
+}
+
+// StartLocal assigns a locally generated peer ID when no signalling server
+// is available to hand one out.
+func (c *Client) StartLocal(passphrase string) (string, error) {
+	if err := c.setupKey(passphrase); err != nil {
+		return "", err
+	}
+
+	c.ID = crypto.GenerateID()
+	c.emit(Event{Type: EventRegistered, PeerID: c.ID, Identity: c.Identity})
+	return c.ID, nil
+}
+
+func (c *Client) RegisterWithServer(ctx context.Context, passphrase string) (string, error) {
 	localAddrs, err := network.LocalAddresses(c.Config.TCPPort)
 	if err != nil {
 		return "", fmt.Errorf("failed to get local addresses: %w", err)
 	}
-	publicAddr, err := network.PublicAddr()
+	// Without a public address peers can still reach us on the LAN, so a
+	// missing or unreachable STUN server is not fatal.
+	publicAddr, natType, err := network.PublicAddr(ctx, c.Config.STUNServers)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to get public IP: %w", err)
+		log.Printf("Public address unavailable, using local addresses only: %v", err)
+	} else {
+		log.Printf("Public address %s (NAT: %s)", publicAddr, natType)
+	}
+
+	hello := protocol.Hello{
+		Version:    protocol.Version,
+		MinVersion: protocol.MinVersion,
+		Transports: []string{"tcp"},
 	}
 
 	peerInfo := signallingserver.PeerInfo{
 		LocalAddr:  localAddrs,
 		PublicAddr: publicAddr,
+		NATType:    string(natType),
 		Type:       signallingserver.PeerTypeNative,
+		WSPort:     c.Config.WSPort,
+		Identity:   c.Identity,
+
+		Visible:     c.Config.Visible,
+		DisplayName: c.Config.DisplayName,
+		DeviceType:  runtime.GOOS,
+		Team:        c.Config.Team,
+		Hello:       &hello,
 	}
 
-	if len(passphrase) != 0 {
-		saltData := crypto.GenerateRandSalt()
-		c.Key, err = crypto.GenerateKey(passphrase, saltData)
-		if err != nil {
-			return "", fmt.Errorf("failed to generate key: %w", err)
-		}
+	if c.portMapping != nil {
+		peerInfo.PublicAddr = c.portMapping.ExternalAddr()
+		peerInfo.PortMapped = true
+	}
 
+	if err := c.setupKey(passphrase); err != nil {
+		return "", err
+	}
+
+	if len(c.Key) != 0 {
 		for i, addr := range localAddrs {
 			data, err := crypto.EncryptData([]byte(addr), c.Key)
 			if err != nil {
@@ -70,7 +206,7 @@ func (c *Client) RegisterWithServer(passphrase string) (string, error) {
 			}
 			localAddrs[i] = base64.StdEncoding.EncodeToString(data)
 		}
-		peerInfo.SaltData = saltData
+		peerInfo.SaltData = c.SaltData
 	}
 
 	payload, err := json.Marshal(peerInfo)
@@ -85,13 +221,15 @@ func (c *Client) RegisterWithServer(passphrase string) (string, error) {
 		return "", fmt.Errorf("failed to create message: %w", err)
 	}
 
-	if _, err := c.SignalConn.Write(buf[:n]); err != nil {
-		return "", fmt.Errorf("failed to send registration: %w", err)
+	defer network.WatchContext(ctx, c.SignalConn)()
+
+	if err := c.SignalConn.WriteMessage(buf[:n]); err != nil {
+		return "", interrupted(ctx, fmt.Errorf("failed to send registration: %w", err))
 	}
 
-	opCode, n, err := protocol.ReadMessage(c.SignalConn, buf)
+	opCode, n, err := c.SignalConn.ReadMessage(buf)
 	if err != nil {
-		return "", fmt.Errorf("failed to read server response: %w", err)
+		return "", interrupted(ctx, fmt.Errorf("failed to read server response: %w", err))
 	}
 
 	if opCode != protocol.ServerAck {
@@ -101,12 +239,137 @@ func (c *Client) RegisterWithServer(passphrase string) (string, error) {
 		return "", fmt.Errorf("unexpected response: opcode %d", opCode)
 	}
 
-	peerID := string(buf[:n])
+	ack, err := parseRegisterAck(hello, buf[:n])
+	if err != nil {
+		return "", err
+	}
+	peerID := ack.PeerID
+	c.ID = peerID
+	c.mailboxNonce = ack.MailboxNonce
 	log.Printf("Registered with peer ID: %s", peerID)
+	c.emit(Event{Type: EventRegistered, PeerID: peerID, Identity: c.Identity})
 
 	return peerID, nil
 }
 
+// parseRegisterAck reads the server's answer to our ServerHello. Servers
+// that predate the handshake reply with the bare peer ID.
+func parseRegisterAck(local protocol.Hello,
+	data []byte) (signallingserver.RegisterAck, error) {
+	var ack signallingserver.RegisterAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return signallingserver.RegisterAck{PeerID: string(data)}, nil
+	}
+
+	if _, err := protocol.Negotiate(local, ack.Hello); err != nil {
+		return ack, fmt.Errorf("signalling server: %w", err)
+	}
+	return ack, nil
+}
+
+// peerClient returns a client sharing c's configuration and signalling
+// connection but with its own key and transfer state, so transfers to
+// several peers can run in parallel.
+func (c *Client) peerClient() *Client {
+	return &Client{
+		Config:         c.Config,
+		SignalConn:     c.SignalConn,
+		Identity:       c.Identity,
+		identitySecret: c.identitySecret,
+		mailboxNonce:   c.mailboxNonce,
+		Limiter:        c.Limiter,
+		Sink:           c.Sink,
+		OnProgress:     c.OnProgress,
+		OnEvent:        c.OnEvent,
+		OnMessage:      c.OnMessage,
+	}
+}
+
+// transport returns the transport of the current peer connection, TCP
+// until a race has chosen one.
+func (c *Client) transport() network.Transport {
+	if c.Transport == nil {
+		return network.TCP
+	}
+	return c.Transport
+}
+
+// signalRequest sends one message to the signalling server and waits for
+// the reply, turning server Error messages into Go errors.
+func (c *Client) signalRequest(ctx context.Context, opCode byte, payload []byte,
+	expect byte) ([]byte, error) {
+	buf := make([]byte, 8192)
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+
+	stop := network.WatchContext(ctx, c.SignalConn)
+	err = c.SignalConn.WriteMessage(buf[:n])
+	stop()
+	if err != nil {
+		return nil, interrupted(ctx, fmt.Errorf("failed to send request: %w", err))
+	}
+
+	return c.readSignalReply(ctx, expect)
+}
+
+func (c *Client) readSignalReply(ctx context.Context, expect byte) ([]byte, error) {
+	defer network.WatchContext(ctx, c.SignalConn)()
+
+	buf := make([]byte, 8192)
+	respCode, n, err := c.SignalConn.ReadMessage(buf)
+	if err != nil {
+		return nil, interrupted(ctx, fmt.Errorf("failed to read response: %w", err))
+	}
+
+	if respCode == protocol.Error {
+		return nil, fmt.Errorf("server error: %s", string(buf[:n]))
+	}
+
+	if respCode != expect {
+		return nil, fmt.Errorf("unexpected response: opcode %d", respCode)
+	}
+
+	return buf[:n], nil
+}
+
+// signalList sends a request whose reply is a list and reads every page
+// of it, since long lists span several messages.
+func signalList[T any](ctx context.Context, c *Client, opCode byte, payload []byte,
+	expect byte) ([]T, error) {
+	data, err := c.signalRequest(ctx, opCode, payload, expect)
+	var items []T
+	for {
+		if err != nil {
+			return nil, err
+		}
+		var page signallingserver.ListPage[T]
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("failed to decode list page: %w", err)
+		}
+		items = append(items, page.Items...)
+		if !page.More {
+			return items, nil
+		}
+		data, err = c.readSignalReply(ctx, expect)
+	}
+}
+
+func (c *Client) JoinRoom(ctx context.Context, room string) error {
+	payload, err := json.Marshal(signallingserver.RoomRequest{Room: room})
+	if err != nil {
+		return fmt.Errorf("failed to encode room request: %w", err)
+	}
+
+	if _, err := c.signalRequest(ctx, protocol.RoomJoin, payload, protocol.RoomAck); err != nil {
+		return fmt.Errorf("failed to join room %s: %w", room, err)
+	}
+
+	log.Printf("Joined room %s", room)
+	return nil
+}
+
 func (c *Client) Transfer(transferID uint32) (*FileTransfer, bool) {
 	value, ok := c.Transfers.Load(transferID)
 
@@ -126,26 +389,36 @@ func (c *Client) CompleteTransfer(transferID uint32, message string) {
 		return
 	}
 
-	ft.File.Close()
-
 	c.Transfers.Delete(transferID)
+	c.finishProgress(ft, ProgressCompleted, nil)
 
 	duration := time.Since(ft.StartTime)
+	c.emitCompleted(ft, duration)
+
+	if wire := ft.WireBytes.Load(); ft.Codec != codec.None && wire > 0 {
+		log.Printf("Transfer %d: %s successfully in %s (%s, ratio %.2fx)",
+			transferID, message, duration.String(), ft.Codec,
+			float64(ft.Transferred.Load())/float64(wire))
+		return
+	}
 
 	log.Printf("Transfer %d: %s successfully in %s",
 		transferID, message, duration.String())
 }
 
 func (c *Client) AddTransfer(transferID uint32, ft *FileTransfer) {
+	c.trackProgress(ft)
 	c.Transfers.Store(transferID, ft)
 }
 
-func (c *Client) sendTransferStart(conn net.Conn, transferID uint32, filename string,
-	fileSize uint64, numChunks uint32) error {
+func (c *Client) sendTransferStart(conn network.MessageConn, transferID uint32, filename string,
+	fileSize uint64, numChunks uint32, layout protocol.TransferLayout,
+	meta protocol.TransferMeta) error {
 
 	buf := make([]byte, protocol.TotalTCPSize)
 
-	n, err := protocol.CreateFileTransferStartPayload(transferID, filename, fileSize, numChunks, buf)
+	n, err := protocol.CreateFileTransferStartPayload(transferID, filename, fileSize,
+		numChunks, layout, meta, buf)
 	if err != nil {
 		return fmt.Errorf("failed to create start payload: %w", err)
 	}
@@ -165,16 +438,16 @@ func (c *Client) sendTransferStart(conn net.Conn, transferID uint32, filename st
 		return fmt.Errorf("failed to create start message: %w", err)
 	}
 
-	if _, err := conn.Write(buf[:msgSize]); err != nil {
+	if err := conn.WriteMessage(buf[:msgSize]); err != nil {
 		return fmt.Errorf("failed to send start message: %w", err)
 	}
 
 	return nil
 }
 
-func (c *Client) sendTransferEnd(conn net.Conn, transferID uint32, buf []byte) error {
-	endPayload := make([]byte, 4)
-	binary.BigEndian.PutUint32(endPayload, transferID)
+func (c *Client) sendTransferEnd(conn network.MessageConn, transferID uint32,
+	summary *protocol.StreamSummary, buf []byte) error {
+	endPayload := protocol.CreateFileTransferEndPayload(transferID, summary)
 
 	if len(c.Key) != 0 {
 		var err error
@@ -189,7 +462,7 @@ func (c *Client) sendTransferEnd(conn net.Conn, transferID uint32, buf []byte) e
 		return fmt.Errorf("failed to create end message: %w", err)
 	}
 
-	if _, err := conn.Write(buf[:n]); err != nil {
+	if err := conn.WriteMessage(buf[:n]); err != nil {
 		return fmt.Errorf("failed to send end message: %w", err)
 	}
 
@@ -0,0 +1,184 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+)
+
+// Failure classes, so callers such as the CLI can tell them apart with
+// errors.Is.
+var (
+	ErrPeerNotFound   = errors.New("peer not found")
+	ErrUnreachable    = errors.New("peer unreachable")
+	ErrTransferFailed = errors.New("transfer failed")
+)
+
+type EventType string
+
+const (
+	EventRegistered EventType = "registered"
+	EventPeerFound  EventType = "peer_found"
+	EventConnected  EventType = "connected"
+	EventProgress   EventType = "progress"
+	EventCompleted  EventType = "completed"
+	EventFailed     EventType = "failed"
+	EventError      EventType = "error"
+	// EventPeer is one entry of a peer listing.
+	EventPeer EventType = "peer"
+)
+
+// Event is one line of machine-readable output. The JSON names are what
+// scripts depend on: add fields, but do not rename or repurpose them.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	PeerID    string   `json:"peer_id,omitempty"`
+	Identity  string   `json:"identity,omitempty"`
+	Transport string   `json:"transport,omitempty"`
+	Addr      string   `json:"addr,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Device    string   `json:"device,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+
+	TransferID      uint32        `json:"transfer_id,omitempty"`
+	File            string        `json:"file,omitempty"`
+	Path            string        `json:"path,omitempty"`
+	Direction       Direction     `json:"direction,omitempty"`
+	State           ProgressState `json:"state,omitempty"`
+	Bytes           uint64        `json:"bytes,omitempty"`
+	Acked           uint64        `json:"acked,omitempty"`
+	Total           uint64        `json:"total,omitempty"`
+	Streaming       bool          `json:"streaming,omitempty"`
+	Rate            float64       `json:"rate,omitempty"`
+	AverageRate     float64       `json:"average_rate,omitempty"`
+	ETASeconds      float64       `json:"eta_seconds,omitempty"`
+	DurationSeconds float64       `json:"duration_seconds,omitempty"`
+	SHA256          string        `json:"sha256,omitempty"`
+
+	// ContentType marks typed messages; Text is a received text message.
+	ContentType string `json:"content_type,omitempty"`
+	Text        string `json:"text,omitempty"`
+
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+// AsEvent converts a progress snapshot to a progress Event.
+func (e ProgressEvent) AsEvent() Event {
+	return Event{
+		Type:            EventProgress,
+		Time:            time.Now(),
+		TransferID:      e.TransferID,
+		File:            e.Filename,
+		Direction:       e.Direction,
+		State:           e.State,
+		Bytes:           e.Bytes,
+		Acked:           e.Acked,
+		Total:           e.Total,
+		Streaming:       e.Streaming,
+		Rate:            e.Rate,
+		AverageRate:     e.AverageRate,
+		ETASeconds:      e.ETA.Seconds(),
+		DurationSeconds: e.Elapsed.Seconds(),
+		Error:           e.Err,
+	}
+}
+
+// emit passes e to OnEvent, if set.
+func (c *Client) emit(e Event) {
+	if c.OnEvent == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	c.OnEvent(e)
+}
+
+// emitConnected reports the transport chosen for a peer connection.
+func (c *Client) emitConnected(peerID string, conn network.MessageConn) {
+	c.emit(Event{
+		Type:      EventConnected,
+		PeerID:    peerID,
+		Transport: c.transport().Name(),
+		Addr:      conn.RemoteAddr().String(),
+	})
+}
+
+// emitCompleted reports a finished transfer with the SHA-256 of the file
+// on this side. Receivers hash in the background so the sender's
+// confirmation is not held up by a large file.
+func (c *Client) emitCompleted(ft *FileTransfer, duration time.Duration) {
+	if c.OnEvent == nil {
+		return
+	}
+	if ft.Direction == Receiving {
+		go c.emitCompletedSum(ft, duration)
+		return
+	}
+	c.emitCompletedSum(ft, duration)
+}
+
+func (c *Client) emitCompletedSum(ft *FileTransfer, duration time.Duration) {
+
+	event := Event{
+		Type:            EventCompleted,
+		TransferID:      ft.TransferID,
+		File:            ft.Filename,
+		Direction:       ft.Direction,
+		Path:            ft.Path,
+		Bytes:           ft.Transferred.Load(),
+		Total:           ft.Filesize,
+		DurationSeconds: duration.Seconds(),
+		ContentType:     ft.ContentType,
+	}
+
+	// Messages are hashed in memory and streams of unknown size were
+	// hashed as they went; other streams sent from a reader have no file
+	// to hash.
+	if ft.message != nil {
+		data, _ := ft.message.File(ft.Filename)
+		sum := sha256.Sum256(data)
+		event.SHA256 = hex.EncodeToString(sum[:])
+		if strings.HasPrefix(ft.ContentType, "text/") {
+			event.Text = string(data)
+		}
+	} else if ft.digest != nil {
+		event.Total = event.Bytes
+		event.SHA256 = hex.EncodeToString(ft.digest.summary().SHA256[:])
+	} else if ft.Path != "" {
+		sum, err := fileSHA256(ft.Path)
+		if err != nil {
+			event.Error = err.Error()
+		}
+		event.SHA256 = sum
+		// Reading the file can move its access time off the sender's.
+		if ft.Direction == Receiving {
+			c.applyAttrs(ft, c.Config.Preserve&fileattr.Times)
+		}
+	}
+	c.emit(event)
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,158 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const (
+	// ackWindow is how many chunks a stream may have unacknowledged before
+	// the sender waits; 32 TCP chunks keeps 8MB in flight per stream.
+	ackWindow = 32
+	// confirmTimeout bounds the wait for TransferComplete after the last
+	// chunk, which includes the receiver flushing the file to disk.
+	confirmTimeout = 2 * time.Minute
+)
+
+// streamWindow counts one stream's chunks that the receiver has not yet
+// acknowledged.
+type streamWindow struct {
+	credits chan struct{}
+	stop    *streamStop
+
+	// Cumulative totals from the last ChunkAck; only the stream's reply
+	// reader touches them.
+	chunks uint32
+	bytes  uint64
+}
+
+func newStreamWindow(size int, stop *streamStop) *streamWindow {
+	return &streamWindow{credits: make(chan struct{}, size), stop: stop}
+}
+
+// acquire waits until the stream may send another chunk. A nil window
+// never waits.
+func (w *streamWindow) acquire() error {
+	if w == nil {
+		return nil
+	}
+
+	select {
+	case w.credits <- struct{}{}:
+		return nil
+	case <-w.stop.done:
+		return w.stop.Err()
+	}
+}
+
+// ack releases the chunks acknowledged since the last ChunkAck and returns
+// how many more file bytes the receiver has written.
+func (w *streamWindow) ack(chunks uint32, bytes uint64) uint64 {
+	for ; w.chunks < chunks; w.chunks++ {
+		select {
+		case <-w.credits:
+		default:
+		}
+	}
+
+	if bytes < w.bytes {
+		return 0
+	}
+	written := bytes - w.bytes
+	w.bytes = bytes
+	return written
+}
+
+// readReplies reads what the receiver sends back on one stream until it
+// closes: chunk acks, the final confirmation, or a cancel or abort.
+func readReplies(conn network.MessageConn, ft *FileTransfer, window *streamWindow,
+	stop *streamStop, confirmed chan<- struct{}) {
+	buf := make([]byte, protocol.TotalTCPSize)
+	for {
+		opCode, n, err := conn.ReadMessage(buf)
+		if err != nil {
+			return
+		}
+
+		switch opCode {
+		case protocol.ChunkAck:
+			transferID, chunks, bytes, err := protocol.ParseChunkAckPayload(buf[:n])
+			if err != nil || transferID != ft.TransferID || window == nil {
+				continue
+			}
+			ft.Acked.Add(window.ack(chunks, bytes))
+
+		case protocol.TransferComplete:
+			ft.Acked.Store(ft.Transferred.Load())
+			select {
+			case confirmed <- struct{}{}:
+			default:
+			}
+
+		case protocol.TransferPause, protocol.TransferResume:
+			paused := opCode == protocol.TransferPause
+			if ft.pause == nil || n < 4 || binary.BigEndian.Uint32(buf[:4]) != ft.TransferID {
+				continue
+			}
+			if paused {
+				ft.pause.pause()
+			} else {
+				ft.pause.resume()
+			}
+			ft.notePaused(paused, "receiver")
+
+		case protocol.TransferCancel, protocol.TransferAbort, protocol.Error:
+			stop.stop(fmt.Errorf("receiver stopped the transfer: %w",
+				protocol.ParseErrorPayload(buf[:n])))
+			return
+		}
+	}
+}
+
+// awaitConfirmation waits for the receiver to report the file flushed.
+func awaitConfirmation(confirmed <-chan struct{}, stop *streamStop) error {
+	select {
+	case <-confirmed:
+		return nil
+	case <-stop.done:
+		return stop.Err()
+	case <-time.After(confirmTimeout):
+		return fmt.Errorf("receiver did not confirm the transfer within %s", confirmTimeout)
+	}
+}
+
+// sendChunkAck tells the sender how much of this stream has been written.
+func sendChunkAck(conn network.MessageConn, transferID uint32, chunks uint32, bytes uint64) error {
+	payload := protocol.CreateChunkAckPayload(transferID, chunks, bytes)
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(protocol.ChunkAck, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk ack: %w", err)
+	}
+
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		return fmt.Errorf("failed to send chunk ack: %w", err)
+	}
+	return nil
+}
+
+// sendTransferComplete confirms the whole file has been flushed to disk.
+func sendTransferComplete(conn network.MessageConn, transferID uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, transferID)
+
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(protocol.TransferComplete, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create completion message: %w", err)
+	}
+
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		return fmt.Errorf("failed to send completion message: %w", err)
+	}
+	return nil
+}
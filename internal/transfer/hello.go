@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const helloTimeout = 5 * time.Second
+
+// localHello describes what this client can do on a peer connection. The
+// sender offers its configured codecs; a receiver accepts any it can decode.
+func (c *Client) localHello(codecs []codec.Codec) protocol.Hello {
+	cipher := protocol.CipherNone
+	if len(c.Key) != 0 || c.passphrase != "" {
+		cipher = protocol.CipherAES256GCM
+	}
+	return protocol.Hello{
+		Version:      protocol.Version,
+		MinVersion:   protocol.MinVersion,
+		Transports:   []string{"tcp", "websocket"},
+		Ciphers:      []string{cipher},
+		Compression:  codec.Names(codecs),
+		MaxChunkSize: protocol.TCPChunkSize,
+	}
+}
+
+// handshake exchanges PeerHello with the receiver before anything else is
+// sent and returns what both sides agreed on.
+func (c *Client) handshake(conn network.MessageConn) (protocol.Hello, error) {
+	local := c.localHello(c.Config.Compression)
+	if err := writeHello(conn, local); err != nil {
+		return protocol.Hello{}, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 8192)
+	opCode, n, err := conn.ReadMessage(buf)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return protocol.Hello{}, fmt.Errorf("%w: peer did not answer the handshake "+
+				"(it may be running an older kdtransfer)", protocol.ErrIncompatible)
+		}
+		return protocol.Hello{}, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	if opCode == protocol.Error {
+		return protocol.Hello{}, fmt.Errorf("peer rejected handshake: %w",
+			protocol.ParseErrorPayload(buf[:n]))
+	}
+	if opCode != protocol.PeerHello {
+		return protocol.Hello{}, fmt.Errorf("unexpected handshake response: opcode %d", opCode)
+	}
+
+	var remote protocol.Hello
+	if err := json.Unmarshal(buf[:n], &remote); err != nil {
+		return protocol.Hello{}, fmt.Errorf("failed to decode peer hello: %w", err)
+	}
+	if err := c.keyFromHello(remote); err != nil {
+		return protocol.Hello{}, err
+	}
+
+	return protocol.Negotiate(local, remote)
+}
+
+// keyFromHello derives the key from the passphrase and the salt in the
+// receiver's hello, for senders that found the receiver over mDNS, which
+// does not publish the salt.
+func (c *Client) keyFromHello(remote protocol.Hello) error {
+	if len(c.Key) != 0 || c.passphrase == "" {
+		return nil
+	}
+	if remote.Salt == "" {
+		return fmt.Errorf("%w: peer is not using a passphrase", protocol.ErrIncompatible)
+	}
+
+	key, err := crypto.GenerateKey(c.passphrase, remote.Salt)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	c.Key = key
+	return nil
+}
+
+// answerHello negotiates with a sender's PeerHello. On incompatibility the
+// reason is sent back as an Error so both sides report the same thing.
+func (c *Client) answerHello(conn network.MessageConn, payload []byte) error {
+	var remote protocol.Hello
+	if err := json.Unmarshal(payload, &remote); err != nil {
+		return fmt.Errorf("failed to decode peer hello: %w", err)
+	}
+
+	local := c.localHello(codec.All)
+	if len(c.Key) != 0 {
+		local.Salt = c.SaltData
+	}
+	if _, err := protocol.Negotiate(local, remote); err != nil {
+		sendTransferError(conn, protocol.Error,
+			transferFailure(protocol.CodeIncompatible, 0, err))
+		return err
+	}
+
+	return writeHello(conn, local)
+}
+
+func writeHello(conn network.MessageConn, hello protocol.Hello) error {
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return fmt.Errorf("failed to encode hello: %w", err)
+	}
+
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(protocol.PeerHello, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create hello message: %w", err)
+	}
+
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	return nil
+}
+
+// agreedCodecs maps the negotiated compression names back to codecs.
+func agreedCodecs(agreed protocol.Hello) []codec.Codec {
+	codecs, err := codec.ParseList(strings.Join(agreed.Compression, ","))
+	if err != nil {
+		return nil
+	}
+	return codecs
+}
@@ -0,0 +1,39 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+)
+
+// loadIdentity reads the persistent identity secret from path, creating
+// one on first use, and returns it with the public identity derived from it.
+func loadIdentity(path string) (secret string, identity string, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		secret = strings.TrimSpace(string(data))
+		return secret, crypto.IdentityFromSecret(secret), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	secret, err = crypto.GenerateIdentitySecret()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate identity: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", "", fmt.Errorf("failed to create identity dir: %w", err)
+	}
+
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		return "", "", fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	return secret, crypto.IdentityFromSecret(secret), nil
+}
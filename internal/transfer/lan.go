@@ -0,0 +1,223 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/discovery"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+)
+
+const lanLookupTimeout = 2 * time.Second
+
+// advertiseLAN publishes this receiver over mDNS so senders on the same
+// network can find it without the signalling server. It returns a func
+// that withdraws the advertisement.
+func (c *Client) advertiseLAN() func() {
+	if c.ID == "" {
+		return func() {}
+	}
+
+	port, err := strconv.ParseUint(c.Config.TCPPort, 10, 16)
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: invalid TCP port %q", c.Config.TCPPort)
+		return func() {}
+	}
+
+	text := map[string]string{}
+	if c.Config.WSPort != "" {
+		text["ws"] = c.Config.WSPort
+	}
+
+	// With a passphrase the addresses are only ever published encrypted,
+	// so the advertisement carries neither them nor the salt. Senders
+	// dial the address the answer came from and learn the salt from
+	// this receiver's PeerHello.
+	var ips []net.IP
+	if len(c.Key) != 0 {
+		text["e2ee"] = "1"
+	} else {
+		addrs, err := network.LocalAddresses(c.Config.TCPPort)
+		if err != nil {
+			log.Printf("mDNS advertisement disabled: %v", err)
+			return func() {}
+		}
+		ips = advertisedIPs(addrs)
+	}
+	if c.Config.Visible && c.Config.DisplayName != "" {
+		text["name"] = c.Config.DisplayName
+	}
+
+	bus, err := discovery.NewMulticastBus()
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: %v", err)
+		return func() {}
+	}
+
+	advertiser := discovery.NewAdvertiser(bus, discovery.Service{
+		ID:   c.ID,
+		Port: uint16(port),
+		IPs:  ips,
+		Text: text,
+	})
+
+	go func() {
+		if err := advertiser.Run(); err != nil {
+			log.Printf("mDNS advertisement stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Advertising %s on the local network", discovery.ServiceType)
+	return func() { advertiser.Close() }
+}
+
+// advertisedIPs turns host:port addresses into A and AAAA record values.
+// Records have no room for an IPv6 zone, which names an interface of this
+// host anyway; senders qualify link-local addresses with their own.
+func advertisedIPs(addrs []string) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			ips = append(ips, net.IP(ip.WithZone("").AsSlice()))
+		}
+	}
+	return ips
+}
+
+// ListLANPeers browses the local network for receivers.
+func (c *Client) ListLANPeers(ctx context.Context) ([]discovery.Service, error) {
+	bus, err := openLANBus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bus.Close()
+
+	services, err := discovery.Browse(bus, lanLookupTimeout, nil)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return services, err
+}
+
+// openLANBus joins the mDNS group; the bus is closed early if ctx is done,
+// which ends any browse on it.
+func openLANBus(ctx context.Context) (discovery.Bus, error) {
+	bus, err := discovery.NewMulticastBus()
+	if err != nil {
+		return nil, err
+	}
+	return &lanBus{Bus: bus, stop: context.AfterFunc(ctx, func() { bus.Close() })}, nil
+}
+
+type lanBus struct {
+	discovery.Bus
+	stop func() bool
+}
+
+func (b *lanBus) Close() error {
+	b.stop()
+	return b.Bus.Close()
+}
+
+func (c *Client) resolveLANPeer(ctx context.Context, peer string,
+	name string) (discovery.Service, error) {
+	bus, err := openLANBus(ctx)
+	if err != nil {
+		return discovery.Service{}, err
+	}
+	defer bus.Close()
+
+	if peer != "" {
+		service, err := discovery.Lookup(bus, peer, lanLookupTimeout)
+		if err := ctx.Err(); err != nil {
+			return discovery.Service{}, err
+		}
+		if errors.Is(err, discovery.ErrNotFound) {
+			err = fmt.Errorf("%w: %w", ErrPeerNotFound, err)
+		}
+		return service, err
+	}
+
+	services, err := discovery.Browse(bus, lanLookupTimeout, nil)
+	if err := ctx.Err(); err != nil {
+		return discovery.Service{}, err
+	}
+	if err != nil {
+		return discovery.Service{}, err
+	}
+
+	var matches []discovery.Service
+	for _, service := range services {
+		if strings.EqualFold(service.Text["name"], name) {
+			matches = append(matches, service)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return discovery.Service{}, fmt.Errorf("%w: no peer named %q on the local network",
+			ErrPeerNotFound, name)
+	case 1:
+		return matches[0], nil
+	default:
+		return discovery.Service{}, fmt.Errorf("%d peers named %q on the local network; use --peer",
+			len(matches), name)
+	}
+}
+
+// HandleLANSendCommand finds the receiver by peer ID or display name over
+// mDNS and sends the file directly, without the signalling server.
+func (c *Client) HandleLANSendCommand(ctx context.Context, peer string, name string,
+	filepath string, passphrase string) error {
+	service, err := c.resolveLANPeer(ctx, peer, name)
+	if err != nil {
+		return fmt.Errorf("peer lookup failed: %w", err)
+	}
+
+	log.Printf("Found peer %s on the local network", service.ID)
+	c.emit(Event{Type: EventPeerFound, PeerID: service.ID})
+
+	if len(passphrase) != 0 {
+		// Receivers before protocol v5 advertised their salt; newer ones
+		// only send it in their PeerHello, and handshake derives the key.
+		salt, ok := service.Text["salt"]
+		switch {
+		case ok:
+			c.Key, err = crypto.GenerateKey(passphrase, salt)
+			if err != nil {
+				return fmt.Errorf("failed to generate key: %w", err)
+			}
+		case service.Text["e2ee"] == "1":
+			c.passphrase = passphrase
+		default:
+			return fmt.Errorf("peer %s is not using a passphrase", service.ID)
+		}
+	}
+
+	peerConn, transport, err := network.RaceConnections(ctx, service.Addresses())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	defer peerConn.Close()
+
+	c.Transport = transport
+	log.Printf("Connected to peer via %s", transport.Name())
+	c.emitConnected(service.ID, peerConn)
+
+	if err := c.transferFile(ctx, filepath, peerConn); err != nil {
+		return fmt.Errorf("%w: %w", ErrTransferFailed, err)
+	}
+	return nil
+}
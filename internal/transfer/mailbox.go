@@ -0,0 +1,190 @@
+package transfer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+)
+
+// HandleMailboxSendCommand uploads a file to the signalling server's
+// mailbox for an offline recipient. The blob is encrypted end to end with
+// a key only the passphrase holder can derive.
+func (c *Client) HandleMailboxSendCommand(ctx context.Context, identity string,
+	filepath string, passphrase string) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("--passphrase required for mailbox delivery")
+	}
+
+	fileInfo, err := os.Stat(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to process file: %w", err)
+	}
+
+	sender := c.peerClient()
+	saltData := crypto.GenerateRandSalt()
+	sender.Key, err = crypto.GenerateKey(passphrase, saltData)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	put := signallingserver.MailboxPut{
+		Recipient: identity,
+		From:      c.Identity,
+		SaltData:  saltData,
+		Size:      uint64(fileInfo.Size()),
+	}
+
+	payload, err := json.Marshal(put)
+	if err != nil {
+		return fmt.Errorf("failed to encode mailbox request: %w", err)
+	}
+
+	if _, err := c.signalRequest(ctx, protocol.MailboxPut, payload,
+		protocol.MailboxAck); err != nil {
+		return fmt.Errorf("mailbox upload rejected: %w", err)
+	}
+
+	if err := sender.transferFileChunked(ctx, filepath, c.SignalConn,
+		protocol.MailboxChunkSize); err != nil {
+		return fmt.Errorf("mailbox upload failed: %w", err)
+	}
+
+	id, err := c.readSignalReply(ctx, protocol.MailboxAck)
+	if err != nil {
+		return fmt.Errorf("mailbox upload failed: %w", err)
+	}
+
+	log.Printf("Stored %s in mailbox for %s (entry %s)", fileInfo.Name(),
+		identity, string(id))
+	return nil
+}
+
+// CheckMailbox downloads every blob waiting for this client's identity and
+// confirms delivery so the server deletes it.
+func (c *Client) CheckMailbox(ctx context.Context, passphrase string) error {
+	if c.Identity == "" {
+		return nil
+	}
+
+	payload, err := c.mailboxAuth(protocol.MailboxList, "")
+	if err != nil {
+		return err
+	}
+
+	entries, err := signalList[signallingserver.MailboxEntry](ctx, c, protocol.MailboxList,
+		payload, protocol.MailboxListAck)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err != nil {
+		// A server without a mailbox is not an error for the receiver.
+		log.Printf("Mailbox unavailable: %v", err)
+		return nil
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if len(passphrase) == 0 {
+		log.Printf("%d mailbox entries waiting; rerun with --passphrase to receive them",
+			len(entries))
+		return nil
+	}
+
+	for _, entry := range entries {
+		if err := c.fetchMailboxEntry(ctx, entry, passphrase); err != nil {
+			return fmt.Errorf("failed to fetch mailbox entry %s: %w", entry.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// mailboxAuth encodes a mailbox request for entry id, signed with the
+// identity key over the nonce the server issued this connection, so the
+// identity secret itself never leaves the client.
+func (c *Client) mailboxAuth(opCode byte, id string) ([]byte, error) {
+	key := crypto.IdentityKey(c.identitySecret)
+	auth := signallingserver.MailboxAuth{
+		Identity:  c.Identity,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key,
+			signallingserver.MailboxChallenge(c.mailboxNonce, opCode, id)),
+		ID: id,
+	}
+
+	payload, err := json.Marshal(auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode mailbox request: %w", err)
+	}
+	return payload, nil
+}
+
+func (c *Client) fetchMailboxEntry(ctx context.Context,
+	entry signallingserver.MailboxEntry, passphrase string) error {
+	receiver := c.peerClient()
+
+	var err error
+	receiver.Key, err = crypto.GenerateKey(passphrase, entry.SaltData)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	payload, err := c.mailboxAuth(protocol.MailboxFetch, entry.ID)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, protocol.TotalMailboxSize)
+	n, err := protocol.MakeMessage(protocol.MailboxFetch, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create message: %w", err)
+	}
+
+	stop := network.WatchContext(ctx, c.SignalConn)
+	defer stop()
+
+	if err := c.SignalConn.WriteMessage(buf[:n]); err != nil {
+		return interrupted(ctx, fmt.Errorf("failed to send fetch: %w", err))
+	}
+
+	log.Printf("Fetching mailbox entry %s from %s", entry.ID, entry.From)
+
+	// The server replays the stored transfer messages, ending with
+	// FileTransferEnd, so the normal receive path handles them.
+	var stream peerStream
+	for {
+		shouldClose, err := handleMessages(c.SignalConn, receiver, &stream)
+		if err != nil {
+			err = interrupted(ctx, err)
+			if stream.open {
+				receiver.dropTransfer(stream.transferID, err)
+			}
+			return err
+		}
+		if shouldClose {
+			break
+		}
+	}
+	stop()
+
+	payload, err = c.mailboxAuth(protocol.MailboxDelete, entry.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := c.signalRequest(ctx, protocol.MailboxDelete, payload,
+		protocol.MailboxAck); err != nil {
+		return fmt.Errorf("failed to confirm delivery: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/KD0S-02/KDTransfer/internal/storage"
+)
+
+// maxMessageSize bounds typed messages, which the receiver holds in memory.
+const maxMessageSize = 1 << 20
+
+// messageName is what receivers that predate typed messages save one as.
+const messageName = "message.txt"
+
+// Message is a typed message received instead of a file.
+type Message struct {
+	TransferID  uint32
+	ContentType string
+	Data        []byte
+}
+
+// messageSource sends its content as a message of contentType.
+type messageSource struct {
+	storage.Source
+	contentType string
+}
+
+func (m messageSource) ContentType() string { return m.contentType }
+
+// SendMessage sends data to peer as a message of contentType, such as
+// protocol.ContentTypeText. The receiver hands it to OnMessage instead of
+// storing a file; receivers that predate messages save it as message.txt.
+func (c *Client) SendMessage(ctx context.Context, peer string, contentType string,
+	data []byte, passphrase string) error {
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("message is %d bytes; messages are limited to %d",
+			len(data), maxMessageSize)
+	}
+	src := messageSource{Source: storage.BytesSource(messageName, data), contentType: contentType}
+	return c.SendSource(ctx, peer, src, passphrase)
+}
+
+// deliverMessage passes a completed incoming message to OnMessage.
+func (c *Client) deliverMessage(ft *FileTransfer) {
+	data, _ := ft.message.File(ft.Filename)
+	log.Printf("Transfer %d: received %s message (%d bytes)", ft.TransferID,
+		ft.ContentType, len(data))
+	if c.OnMessage != nil {
+		c.OnMessage(Message{TransferID: ft.TransferID, ContentType: ft.ContentType, Data: data})
+	}
+}
@@ -0,0 +1,174 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+)
+
+const defaultPauseTimeout = 10 * time.Minute
+
+// pauseGate holds an outgoing transfer's streams while either side has it
+// paused. A pause that outlasts the timeout expires the transfer.
+type pauseGate struct {
+	timeout time.Duration
+	stop    *streamStop
+	expire  func()
+
+	mu      sync.Mutex
+	resumed chan struct{} // nil while running, closed on resume
+	since   time.Time
+	expired sync.Once
+}
+
+func newPauseGate(timeout time.Duration, stop *streamStop, expire func()) *pauseGate {
+	return &pauseGate{timeout: timeout, stop: stop, expire: expire}
+}
+
+// pause reports whether the gate was running.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.since = time.Now()
+	return true
+}
+
+// resume reports whether the gate was paused.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return true
+}
+
+// wait blocks while the transfer is paused. A nil gate never waits.
+func (g *pauseGate) wait() error {
+	if g == nil {
+		return nil
+	}
+
+	for {
+		g.mu.Lock()
+		resumed, since := g.resumed, g.since
+		g.mu.Unlock()
+		if resumed == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(time.Until(since.Add(g.timeout)))
+		select {
+		case <-resumed:
+			timer.Stop()
+		case <-g.stop.done:
+			timer.Stop()
+			return g.stop.Err()
+		case <-timer.C:
+			g.expired.Do(g.expire)
+			return g.stop.Err()
+		}
+	}
+}
+
+func (c *Client) pauseTimeout() time.Duration {
+	if c.Config == nil || c.Config.PauseTimeout <= 0 {
+		return defaultPauseTimeout
+	}
+	return c.Config.PauseTimeout
+}
+
+// PauseTransfer holds an in-flight transfer without closing its
+// connections and tells the peer.
+func (c *Client) PauseTransfer(transferID uint32) error {
+	return c.ownerOf(transferID).setPaused(transferID, true)
+}
+
+// ResumeTransfer lets a paused transfer continue.
+func (c *Client) ResumeTransfer(transferID uint32) error {
+	return c.ownerOf(transferID).setPaused(transferID, false)
+}
+
+func (c *Client) setPaused(transferID uint32, paused bool) error {
+	ft, ok := c.Transfer(transferID)
+	if !ok {
+		return fmt.Errorf("no transfer with ID %d", transferID)
+	}
+	if ft.setPaused == nil {
+		return fmt.Errorf("transfer %d cannot be paused", transferID)
+	}
+	return ft.setPaused(paused)
+}
+
+// RunCommand applies an interactive command (pause, resume or cancel) to
+// every in-flight transfer, including those of a running broadcast.
+func (c *Client) RunCommand(command string) error {
+	var paused bool
+	switch command {
+	case "pause":
+		paused = true
+	case "resume":
+		paused = false
+	case "cancel":
+		c.CancelTransfers("cancelled by user")
+		return nil
+	case "":
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q (pause, resume or cancel)", command)
+	}
+
+	c.forEachTransfer(func(owner *Client, transferID uint32) {
+		if err := owner.setPaused(transferID, paused); err != nil {
+			log.Printf("Failed to %s transfer %d: %v", command, transferID, err)
+		}
+	})
+	return nil
+}
+
+// notePaused records a pause or resume from either side.
+func (ft *FileTransfer) notePaused(paused bool, by string) {
+	if ft.paused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		log.Printf("Transfer %d: paused by %s", ft.TransferID, by)
+	} else {
+		log.Printf("Transfer %d: resumed by %s", ft.TransferID, by)
+	}
+}
+
+// sendTransferControl writes TransferPause or TransferResume.
+func sendTransferControl(conn network.MessageConn, opCode byte, transferID uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, transferID)
+
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(opCode, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create control message: %w", err)
+	}
+
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		return fmt.Errorf("failed to send control message: %w", err)
+	}
+	return nil
+}
+
+func controlOpCode(paused bool) byte {
+	if paused {
+		return protocol.TransferPause
+	}
+	return protocol.TransferResume
+}
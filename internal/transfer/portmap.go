@@ -0,0 +1,48 @@
+package transfer
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/KD0S-02/KDTransfer/internal/portmap"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+)
+
+// MapPort asks the gateway to forward TCPPort to this receiver. Call it
+// before RegisterWithServer so the external address is advertised.
+func (c *Client) MapPort() error {
+	port, err := strconv.ParseUint(c.Config.TCPPort, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid TCP port %q: %w", c.Config.TCPPort, err)
+	}
+
+	mapping, err := portmap.Map(portmap.DefaultMappers(c.Config.PortMapGateway),
+		uint16(port), c.Config.PortMapLifetime)
+	if err != nil {
+		return err
+	}
+
+	c.portMapping = mapping
+	return nil
+}
+
+// UnmapPort removes the mapping created by MapPort, if any.
+func (c *Client) UnmapPort() {
+	if c.portMapping == nil {
+		return
+	}
+	if err := c.portMapping.Close(); err != nil {
+		log.Printf("%v", err)
+	}
+	c.portMapping = nil
+}
+
+// dialCandidates lists the addresses to race for a peer: its LAN addresses
+// plus the gateway-forwarded address when it has one.
+func dialCandidates(info signallingserver.PeerInfo) []string {
+	if !info.PortMapped || info.PublicAddr == "" {
+		return info.LocalAddr
+	}
+	return append(append([]string(nil), info.LocalAddr...), info.PublicAddr)
+}
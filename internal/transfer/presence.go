@@ -0,0 +1,62 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+)
+
+// ListPeers returns the peers that opted in to presence in the client's
+// team, or in room when it is set.
+func (c *Client) ListPeers(ctx context.Context, room string) ([]signallingserver.PresenceEntry, error) {
+	payload, err := json.Marshal(signallingserver.PresenceQuery{Room: room})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode presence query: %w", err)
+	}
+
+	data, err := c.signalRequest(ctx, protocol.PresenceList, payload, protocol.PresenceListAck)
+	if err != nil {
+		return nil, fmt.Errorf("presence list failed: %w", err)
+	}
+
+	var entries []signallingserver.PresenceEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode presence list: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ResolvePeerName maps a display name to a peer ID. Names are matched
+// case-insensitively and must be unique among visible peers.
+func (c *Client) ResolvePeerName(ctx context.Context, name string) (string, error) {
+	entries, err := c.ListPeers(ctx, "")
+	if err != nil {
+		return "", err
+	}
+
+	var matches []signallingserver.PresenceEntry
+	for _, entry := range entries {
+		if strings.EqualFold(entry.DisplayName, name) {
+			matches = append(matches, entry)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w: no visible peer named %q", ErrPeerNotFound, name)
+	case 1:
+		return matches[0].PeerID, nil
+	default:
+		ids := make([]string, len(matches))
+		for i, match := range matches {
+			ids[i] = match.PeerID
+		}
+		return "", fmt.Errorf("%d peers named %q (%s); use --peer",
+			len(matches), name, strings.Join(ids, ", "))
+	}
+}
@@ -0,0 +1,182 @@
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	progressInterval = 250 * time.Millisecond
+	// rateSmoothing is the weight of the newest sample in the current
+	// rate; lower values steady the ETA at the cost of reacting slower.
+	rateSmoothing = 0.3
+)
+
+// Direction says whether this side is sending or receiving a transfer.
+type Direction string
+
+const (
+	Sending   Direction = "send"
+	Receiving Direction = "receive"
+)
+
+type ProgressState string
+
+const (
+	ProgressRunning   ProgressState = "running"
+	ProgressPaused    ProgressState = "paused"
+	ProgressCompleted ProgressState = "completed"
+	ProgressFailed    ProgressState = "failed"
+	ProgressSuspended ProgressState = "suspended"
+)
+
+// ProgressEvent is a snapshot of one transfer, published every
+// progressInterval while it runs and once more when it ends.
+type ProgressEvent struct {
+	TransferID uint32
+	Filename   string
+	Direction  Direction
+	State      ProgressState
+
+	// Bytes counts file bytes sent or written on this side; Acked those
+	// the receiver has confirmed, when sending with acknowledgements.
+	Bytes uint64
+	Acked uint64
+	Total uint64
+	// Streaming is set while a stream of unknown size is in flight, so
+	// Total is not known yet.
+	Streaming bool
+
+	// Rate is the recent throughput in bytes per second and AverageRate
+	// the throughput since the transfer started.
+	Rate        float64
+	AverageRate float64
+	Elapsed     time.Duration
+	// ETA is zero when it cannot be estimated.
+	ETA time.Duration
+
+	Err string `json:",omitempty"`
+}
+
+// Percent returns how much of the file has been transferred.
+func (e ProgressEvent) Percent() float64 {
+	if e.Streaming {
+		return 0
+	}
+	if e.Total == 0 {
+		return 100
+	}
+	return float64(e.Bytes) * 100 / float64(e.Total)
+}
+
+// progressMeter turns successive byte counts into a smoothed rate.
+type progressMeter struct {
+	lastBytes uint64
+	lastTime  time.Time
+	rate      float64
+}
+
+func (m *progressMeter) sample(ft *FileTransfer, now time.Time) ProgressEvent {
+	bytes := ft.Transferred.Load()
+	event := ProgressEvent{
+		TransferID: ft.TransferID,
+		Filename:   ft.Filename,
+		Direction:  ft.Direction,
+		State:      ProgressRunning,
+		Bytes:      bytes,
+		Acked:      ft.Acked.Load(),
+		Total:      ft.Filesize,
+		Streaming:  ft.digest != nil,
+		Elapsed:    now.Sub(ft.StartTime),
+	}
+	if ft.Paused() {
+		event.State = ProgressPaused
+	}
+
+	if m.lastTime.IsZero() {
+		m.lastBytes, m.lastTime = ft.resumedBytes, ft.StartTime
+	}
+	if interval := now.Sub(m.lastTime).Seconds(); interval > 0 {
+		current := float64(bytes-min(m.lastBytes, bytes)) / interval
+		if m.rate == 0 {
+			m.rate = current
+		} else {
+			m.rate = rateSmoothing*current + (1-rateSmoothing)*m.rate
+		}
+	}
+	m.lastBytes, m.lastTime = bytes, now
+	event.Rate = m.rate
+
+	if seconds := event.Elapsed.Seconds(); seconds > 0 {
+		event.AverageRate = float64(bytes-min(ft.resumedBytes, bytes)) / seconds
+	}
+	if event.Rate > 0 && bytes < ft.Filesize && event.State == ProgressRunning {
+		event.ETA = time.Duration(float64(ft.Filesize-bytes) / event.Rate * float64(time.Second))
+	}
+
+	return event
+}
+
+// progress tracks the reporting goroutine of one transfer.
+type progress struct {
+	meter    progressMeter
+	mu       sync.Mutex
+	done     chan struct{}
+	finished bool
+}
+
+// trackProgress publishes progress for ft until it finishes. It does
+// nothing unless OnProgress is set.
+func (c *Client) trackProgress(ft *FileTransfer) {
+	if c.OnProgress == nil {
+		return
+	}
+
+	p := &progress{done: make(chan struct{})}
+	ft.progress = p
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case now := <-ticker.C:
+				p.mu.Lock()
+				if !p.finished {
+					c.OnProgress(p.meter.sample(ft, now))
+				}
+				p.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// finishProgress stops ft's reporting and publishes its final state.
+func (c *Client) finishProgress(ft *FileTransfer, state ProgressState, reason error) {
+	p := ft.progress
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	close(p.done)
+
+	event := p.meter.sample(ft, time.Now())
+	event.State = state
+	event.ETA = 0
+	if ft.digest != nil && state == ProgressCompleted {
+		event.Total, event.Streaming = event.Bytes, false
+	}
+	if reason != nil {
+		event.Err = reason.Error()
+	}
+	c.OnProgress(event)
+}
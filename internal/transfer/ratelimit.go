@@ -0,0 +1,25 @@
+package transfer
+
+import (
+	"log"
+
+	"github.com/KD0S-02/KDTransfer/internal/config"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
+)
+
+// SetRateLimit changes the outgoing bandwidth cap, in bytes per second, for
+// running and future transfers. Zero removes the cap.
+func (c *Client) SetRateLimit(rate int64) {
+	c.Limiter.SetRate(rate)
+	log.Printf("Outgoing rate limit: %s", ratelimit.FormatRate(rate))
+}
+
+func (c *Client) reloadRateLimit() {
+	rate, err := config.ReadRateLimit()
+	if err != nil {
+		log.Printf("Keeping rate limit %s: %v",
+			ratelimit.FormatRate(c.Limiter.Rate()), err)
+		return
+	}
+	c.SetRateLimit(rate)
+}
@@ -2,20 +2,57 @@ package transfer
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/KD0S-02/KDTransfer/internal/codec"
 	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/network"
 	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
 )
 
-func (c *Client) Receiver(passphrase string) error {
+// Receiver accepts transfers until ctx is done or the user types
+// "disconnect".
+func (c *Client) Receiver(ctx context.Context, passphrase string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	listener, err := net.Listen("tcp", ":"+c.Config.TCPPort)
+	input := make(chan error, 1)
+	go func() {
+		input <- waitForUserInput(c)
+		cancel()
+	}()
+
+	if err := c.Serve(ctx); err != nil {
+		return err
+	}
+
+	// Stdin stays blocked after an interrupt, so only wait for it when it
+	// was the reason the receiver stopped.
+	select {
+	case err := <-input:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Serve listens for senders on TCP_PORT (and WS_PORT for browsers) and
+// receives files into ReceiveDir until ctx is done. Transfers still in
+// flight are then cancelled, so their partial files are removed and the
+// senders told, before Serve returns.
+func (c *Client) Serve(ctx context.Context) error {
+	listener, err := network.TCP.Listen(":" + c.Config.TCPPort)
 
 	if err != nil {
 		return fmt.Errorf("failed to create listener: %w", err)
@@ -23,37 +60,136 @@ func (c *Client) Receiver(passphrase string) error {
 
 	defer listener.Close()
 
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+
+	// handle runs a connection handler unless shutdown has begun, so the
+	// wait below covers every handler that started.
+	var (
+		mu       sync.Mutex
+		stopped  bool
+		handlers sync.WaitGroup
+	)
+	handle := func(conn network.MessageConn) {
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			conn.Close()
+			return
+		}
+		handlers.Add(1)
+		mu.Unlock()
+
+		defer handlers.Done()
+		handlePeerConnection(connCtx, conn, c)
+	}
+
 	go func() {
 		for {
 			peerConn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
-				fmt.Printf("failed to accept connection: %v", err)
+				log.Printf("failed to accept connection: %v", err)
+				continue
 			}
-			go handlePeerConnection(peerConn, c)
+			go handle(peerConn)
 		}
 	}()
 
-	return waitForUserInput()
+	// Browsers cannot open raw TCP sockets, so the web UI reaches the
+	// receiver over a WebSocket carrying the same framed messages. The
+	// listener is opt-in: most receivers only serve native senders.
+	if c.Config.WSPort != "" {
+		wsListener, err := net.Listen("tcp", ":"+c.Config.WSPort)
+		if err != nil {
+			return fmt.Errorf("failed to create websocket listener: %w", err)
+		}
+		wsServer := &http.Server{
+			Handler: network.WebSocketHandler(network.AllowOrigins(c.webUIOrigins()...), handle),
+		}
+		defer wsServer.Close()
+
+		go func() {
+			if err := wsServer.Serve(wsListener); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("WebSocket listener stopped: %v", err)
+			}
+		}()
+	}
+
+	stopAdvertising := c.advertiseLAN()
+	defer stopAdvertising()
+
+	<-ctx.Done()
+
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+
+	c.CancelTransfers("receiver shut down")
+	closeConns()
+	handlers.Wait()
+	return nil
 }
 
-func waitForUserInput() error {
+// webUIOrigins are the pages whose WebSockets Serve accepts: WEBUI_ORIGINS
+// if set, otherwise the web UI served by the signalling server. Without
+// this any site the user opens could push files into ReceiveDir.
+func (c *Client) webUIOrigins() []string {
+	if len(c.Config.WebUIOrigins) > 0 {
+		return c.Config.WebUIOrigins
+	}
+	host := net.JoinHostPort(c.Config.SignallingServerHost, c.Config.HTTPPort)
+	return []string{"http://" + host, "https://" + host}
+}
+
+func waitForUserInput(c *Client) error {
 	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Println("Type 'disconnect' to exit")
+	fmt.Fprintln(os.Stderr, "Type 'pause', 'resume' or 'cancel' to control incoming transfers, or 'disconnect' to exit")
 	for scanner.Scan() {
-		if scanner.Text() == "disconnect" {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "disconnect" {
 			return nil
 		}
+		if err := c.RunCommand(command); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
 	}
 	return scanner.Err()
 }
 
-func handlePeerConnection(conn net.Conn, c *Client) error {
+// peerStream tracks the transfer carried by one connection, so it can be
+// cleaned up if the connection fails before FileTransferEnd.
+type peerStream struct {
+	transferID uint32
+	open       bool
+
+	// Chunks and bytes written from this connection, and the chunk count
+	// last acknowledged to the sender.
+	chunks uint32
+	bytes  uint64
+	acked  uint32
+}
+
+// handlePeerConnection serves one sender until it is done or ctx ends,
+// which closes the connection.
+func handlePeerConnection(ctx context.Context, conn network.MessageConn, c *Client) error {
 	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
 
+	var stream peerStream
 	for {
-		shouldClose, err := handleMessages(conn, c)
+		shouldClose, err := handleMessages(conn, c, &stream)
 
 		if err != nil {
+			// Failures on this side are reported so the sender stops too.
+			if failure, ok := err.(*protocol.TransferError); ok {
+				sendTransferError(conn, protocol.TransferAbort, failure)
+			}
+			if stream.open {
+				c.dropTransfer(stream.transferID, err)
+			}
 			return err
 		}
 
@@ -70,15 +206,42 @@ func (c *Client) handleDecrpyption(data []byte) ([]byte, error) {
 	return crypto.DecryptData(data, c.Key)
 }
 
-func handleMessages(peerConn net.Conn, c *Client) (close bool, err error) {
+func handleMessages(peerConn network.MessageConn, c *Client,
+	stream *peerStream) (close bool, err error) {
 
 	buf := make([]byte, protocol.TotalTCPSize)
-	opCode, n, err := protocol.ReadMessage(peerConn, buf)
+	opCode, n, err := peerConn.ReadMessage(buf)
 	if err != nil {
 		return true, err
 	}
 
 	switch opCode {
+	case protocol.Error:
+		return true, fmt.Errorf("remote error: %w", protocol.ParseErrorPayload(buf[:n]))
+	case protocol.TransferCancel, protocol.TransferAbort:
+		reason := protocol.ParseErrorPayload(buf[:n])
+		if stream.open {
+			if reason.Code == protocol.CodeSuspended {
+				c.suspendTransfer(stream.transferID, reason)
+			} else {
+				c.dropTransfer(stream.transferID,
+					fmt.Errorf("sender stopped the transfer: %w", reason))
+			}
+			stream.open = false
+		}
+		return true, nil
+	case protocol.TransferPause, protocol.TransferResume:
+		if n < 4 {
+			return true, transferFailure(protocol.CodeBadRequest, stream.transferID,
+				fmt.Errorf("control message too short"))
+		}
+		if ft, ok := c.Transfer(binary.BigEndian.Uint32(buf[:4])); ok {
+			ft.notePaused(opCode == protocol.TransferPause, "sender")
+		}
+	case protocol.PeerHello:
+		if err := c.answerHello(peerConn, buf[:n]); err != nil {
+			return true, fmt.Errorf("handshake failed: %w", err)
+		}
 	case protocol.PeerInfoForward:
 		payload, err := c.handleDecrpyption(buf[:n])
 		if err != nil {
@@ -89,76 +252,294 @@ func handleMessages(peerConn net.Conn, c *Client) (close bool, err error) {
 	case protocol.FileTransferStart:
 		payload, err := c.handleDecrpyption(buf[:n])
 		if err != nil {
-			return true, fmt.Errorf("error while decrypting transfer start payload: %s",
-				err.Error())
+			return true, transferFailure(protocol.CodeDecrypt, 0,
+				fmt.Errorf("error while decrypting transfer start payload: %w", err))
 		}
 
 		transferID, filename, filesize, nChunks :=
 			protocol.ParseFileTransferPayload(payload)
 
-		ft := &FileTransfer{
-			TransferID: transferID,
-			Filename:   filename,
-			Filesize:   filesize,
-			StartTime:  time.Now(),
+		layout := protocol.ParseFileTransferLayout(payload)
+		meta, err := protocol.ParseFileTransferMeta(payload)
+		if err != nil {
+			return true, transferFailure(protocol.CodeBadRequest, transferID, err)
 		}
 
-		log.Printf("Receiving file: %s (ID: %d, Size: %d bytes, Chunks: %d)",
-			filename, transferID, filesize, nChunks)
+		// A stream of unknown size arrives in order on one stream and is
+		// checked against the sender's summary at the end.
+		unsized := filesize == protocol.UnknownSize
+		if unsized && layout.Streams > 1 {
+			return true, transferFailure(protocol.CodeBadRequest, transferID,
+				fmt.Errorf("stream of unknown size announced on %d streams", layout.Streams))
+		}
+		if meta.ContentType != "" && (unsized || filesize > maxMessageSize) {
+			return true, transferFailure(protocol.CodeBadRequest, transferID,
+				fmt.Errorf("%s message too large: messages are limited to %d bytes",
+					meta.ContentType, maxMessageSize))
+		}
 
-		file, err := os.Create(filename)
-		if err != nil {
-			return true, err
+		ft := &FileTransfer{
+			TransferID:  transferID,
+			Filename:    filename,
+			Filesize:    filesize,
+			Direction:   Receiving,
+			StartTime:   time.Now(),
+			ChunkSize:   layout.ChunkSize,
+			nChunks:     nChunks,
+			ContentType: meta.ContentType,
+			attrs:       metaAttrs(meta),
+			Codec:       codec.Choose(codecsOf(layout.Codecs)),
+			window:      layout.Window,
+		}
+		ft.streams.Store(int32(max(layout.Streams, 1)))
+
+		if unsized {
+			ft.Filesize, ft.digest = 0, newStreamDigest()
+			log.Printf("Receiving stream: %s (ID: %d, Compression: %s)",
+				filename, transferID, ft.Codec)
+		} else {
+			log.Printf("Receiving file: %s (ID: %d, Size: %d bytes, Chunks: %d, Streams: %d, Compression: %s)",
+				filename, transferID, filesize, nChunks, ft.streams.Load(), ft.Codec)
+		}
+
+		// Senders with an ack window read the resume point from
+		// FileTransferReady, so only they can continue a suspended file.
+		// Streams cannot be rewound, so they always start over. Messages
+		// are held in memory until they are complete.
+		sink := c.sink()
+		if ft.ContentType != "" {
+			ft.message = storage.NewMemorySink()
+			sink = ft.message
+		}
+		var resumeFrom uint32
+		if dir, ok := sink.(dirSink); ok && layout.Window != 0 && layout.ChunkSize != 0 && !unsized {
+			file, chunks, err := dir.resume(filename, filesize, layout.ChunkSize, meta.Fingerprint)
+			if err != nil {
+				return true, transferFailure(protocol.CodeIO, transferID, err)
+			}
+			if file != nil {
+				ft.File, resumeFrom = file, min(chunks, nChunks)
+			}
+		}
+		if ft.File == nil {
+			ft.File, err = sink.Create(filename, filesize)
+			if err != nil {
+				return true, transferFailure(protocol.CodeIO, transferID, err)
+			}
+		}
+		if file, ok := ft.File.(*dirFile); ok {
+			ft.Path = file.path
+		}
+		if resumeFrom > 0 {
+			log.Printf("Resuming %s at chunk %d of %d", ft.Path, resumeFrom, nChunks)
+			ft.resumedBytes = min(uint64(resumeFrom)*uint64(layout.ChunkSize), filesize)
+			ft.Transferred.Store(ft.resumedBytes)
+		}
+		if layout.ChunkSize != 0 && !unsized {
+			ft.chunks = newChunkSet(nChunks, resumeFrom)
+			ft.fingerprint = meta.Fingerprint
+		}
+		ft.cancel = func(reason *protocol.TransferError) {
+			sendTransferError(peerConn, protocol.TransferCancel, reason)
+			c.dropTransfer(transferID, reason)
+			peerConn.Close()
+		}
+		if layout.Window != 0 {
+			ft.setPaused = func(paused bool) error {
+				ft.notePaused(paused, "receiver")
+				return sendTransferControl(peerConn, controlOpCode(paused), transferID)
+			}
 		}
-		ft.File = file
 		c.AddTransfer(transferID, ft)
+		stream.transferID, stream.open = transferID, true
+
+		if layout.Streams > 1 || len(layout.Codecs) != 0 || layout.Window != 0 {
+			if err := sendTransferReady(peerConn, transferID, ft.Codec,
+				resumeFrom); err != nil {
+				return true, err
+			}
+		}
 
 	case protocol.FileTransferData:
-		transferID, _, chunkData := protocol.
+		transferID, chunkIndex, chunkData := protocol.
 			ParseFileTransferDataPayload(buf[:n])
 
+		ft, ok := c.Transfer(transferID)
+		if !ok {
+			return true, transferFailure(protocol.CodeUnknownTransfer, transferID,
+				fmt.Errorf("chunk received for invalid transfer id: %d", transferID))
+		}
+		stream.transferID, stream.open = transferID, true
+
 		if len(c.Key) != 0 {
 			chunkData, err = crypto.DecryptData(chunkData, c.Key)
 			if err != nil {
-				return true, fmt.Errorf("error while decrypting transfer payload: %s",
-					err.Error())
+				return true, transferFailure(protocol.CodeDecrypt, transferID,
+					fmt.Errorf("error while decrypting transfer payload: %w", err))
 			}
 		}
 
-		ft, ok := c.Transfer(transferID)
-		if !ok {
-			return true, fmt.Errorf("chunk received for invalid transfer id: %d",
-				transferID)
-		}
-
 		file := ft.File
 		if file == nil {
-			return true, fmt.Errorf("file not open for transfer ID: %d", transferID)
+			return true, transferFailure(protocol.CodeInternal, transferID,
+				fmt.Errorf("file not open for transfer ID: %d", transferID))
+		}
+
+		if ft.Codec != codec.None {
+			ft.WireBytes.Add(uint64(len(chunkData)))
+			maxSize := int(ft.ChunkSize)
+			if maxSize == 0 {
+				maxSize = protocol.TotalTCPSize
+			}
+			chunkData, err = codec.Decode(ft.Codec, chunkData, maxSize)
+			if err != nil {
+				return true, transferFailure(protocol.CodeCorrupt, transferID,
+					fmt.Errorf("chunk %d: %w", chunkIndex, err))
+			}
 		}
 
-		_, err := file.Write(chunkData)
+		if ft.digest != nil && chunkIndex != ft.digest.chunks {
+			return true, transferFailure(protocol.CodeCorrupt, transferID,
+				fmt.Errorf("stream chunk %d arrived out of order, expected %d",
+					chunkIndex, ft.digest.chunks))
+		}
+
+		// Without a chunk size, chunks arrive in order on one stream.
+		offset := int64(ft.Transferred.Load())
+		if ft.ChunkSize != 0 {
+			offset = int64(chunkIndex) * int64(ft.ChunkSize)
+		}
+		// A file of known size must not be written past its end, or a
+		// sender could grow it without bound.
+		if ft.digest == nil && (chunkIndex >= ft.nChunks ||
+			uint64(offset)+uint64(len(chunkData)) > ft.Filesize) {
+			return true, transferFailure(protocol.CodeCorrupt, transferID,
+				fmt.Errorf("chunk %d (%d bytes at offset %d) lies outside the %d chunk, %d byte file",
+					chunkIndex, len(chunkData), offset, ft.nChunks, ft.Filesize))
+		}
+		// Every chunk but the last is full, so a chunk marked written
+		// leaves no hole behind it.
+		if ft.chunks != nil {
+			if want := min(uint64(ft.ChunkSize), ft.Filesize-uint64(offset)); uint64(len(chunkData)) != want {
+				return true, transferFailure(protocol.CodeCorrupt, transferID,
+					fmt.Errorf("chunk %d is %d bytes, want %d", chunkIndex, len(chunkData), want))
+			}
+		}
+		_, err = file.WriteAt(chunkData, offset)
 		if err != nil {
-			return true, err
+			return true, transferFailure(protocol.CodeIO, transferID, err)
+		}
+		ft.Transferred.Add(uint64(len(chunkData)))
+		if ft.digest != nil {
+			ft.digest.add(chunkData)
+		}
+		if ft.chunks != nil {
+			ft.chunks.mark(chunkIndex)
+		}
+
+		if ft.window != 0 {
+			stream.chunks++
+			stream.bytes += uint64(len(chunkData))
+			// Acking every half window keeps the sender from stalling
+			// while the ack is in flight.
+			if stream.chunks-stream.acked >= max(uint32(ft.window)/2, 1) {
+				if err := sendChunkAck(peerConn, transferID, stream.chunks,
+					stream.bytes); err != nil {
+					return true, err
+				}
+				stream.acked = stream.chunks
+			}
 		}
 
 	case protocol.FileTransferEnd:
 		payload, err := c.handleDecrpyption(buf[:n])
 		if err != nil {
-			return true, fmt.Errorf("error while decrypting transfer start payload: %s",
-				err.Error())
+			return true, transferFailure(protocol.CodeDecrypt, stream.transferID,
+				fmt.Errorf("error while decrypting transfer end payload: %w", err))
 		}
 
-		transferID := binary.BigEndian.Uint32(payload)
+		transferID, summary, err := protocol.ParseFileTransferEndPayload(payload)
+		if err != nil {
+			return true, transferFailure(protocol.CodeBadRequest, stream.transferID, err)
+		}
 		ft, ok := c.Transfer(transferID)
 
 		if !ok {
-			return true, fmt.Errorf("invalid ID for FILE_TRANSFER_END message")
+			return true, transferFailure(protocol.CodeUnknownTransfer, transferID,
+				fmt.Errorf("invalid ID for FILE_TRANSFER_END message"))
+		}
+		stream.open = false
+
+		// Each stream ends separately; the file is complete once all have.
+		// A stream ending twice would otherwise stand in for one that has
+		// not finished.
+		if _, ended := ft.endedStreams.LoadOrStore(stream, struct{}{}); ended {
+			err := fmt.Errorf("stream ended transfer %d twice", transferID)
+			c.dropTransfer(transferID, err)
+			return true, transferFailure(protocol.CodeBadRequest, transferID, err)
+		}
+		if ft.streams.Add(-1) > 0 {
+			return true, nil
 		}
 
+		if ft.digest != nil {
+			if err := ft.digest.check(summary); err != nil {
+				c.dropTransfer(transferID, err)
+				return true, transferFailure(protocol.CodeCorrupt, transferID, err)
+			}
+		} else if err := ft.checkComplete(); err != nil {
+			c.dropTransfer(transferID, err)
+			return true, transferFailure(protocol.CodeCorrupt, transferID, err)
+		}
+
+		if err := ft.File.Commit(); err != nil {
+			err = fmt.Errorf("failed to finish file: %w", err)
+			c.dropTransfer(transferID, err)
+			return true, transferFailure(protocol.CodeIO, transferID, err)
+		}
+		if ft.Path != "" {
+			c.applyAttrs(ft, c.Config.Preserve)
+		}
+		if ft.message != nil {
+			c.deliverMessage(ft)
+		}
 		c.CompleteTransfer(ft.TransferID, "received")
+		if ft.window == 0 {
+			return true, nil
+		}
 
-		return true, nil
+		return true, sendTransferComplete(peerConn, transferID)
 	}
 
 	return false, nil
 }
+
+func codecsOf(offer []byte) []codec.Codec {
+	codecs := make([]codec.Codec, len(offer))
+	for i, c := range offer {
+		codecs[i] = codec.Codec(c)
+	}
+	return codecs
+}
+
+// sendTransferReady accepts a transfer announced with extra streams, a
+// compression offer or an ack window, naming the codec the sender should
+// use and the chunk to resume from.
+func sendTransferReady(conn network.MessageConn, transferID uint32, chosen codec.Codec,
+	resumeFrom uint32) error {
+	payload := make([]byte, 9)
+	binary.BigEndian.PutUint32(payload, transferID)
+	payload[4] = byte(chosen)
+	binary.BigEndian.PutUint32(payload[5:], resumeFrom)
+
+	buf := make([]byte, protocol.MessageHeaderSize+len(payload))
+	n, err := protocol.MakeMessage(protocol.FileTransferReady, payload, buf)
+	if err != nil {
+		return fmt.Errorf("failed to create ready message: %w", err)
+	}
+
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		return fmt.Errorf("failed to send ready message: %w", err)
+	}
+	return nil
+}
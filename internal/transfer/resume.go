@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// resumeSuffix names the file kept next to a suspended transfer's partial
+// file, recording how much of it is already written.
+const resumeSuffix = ".kdpart"
+
+type resumePoint struct {
+	Filesize    uint64
+	ChunkSize   uint32
+	Chunks      uint32
+	Fingerprint string
+}
+
+// chunkSet tracks which chunks of an incoming file have been written, so a
+// suspended transfer knows where it can safely restart.
+type chunkSet struct {
+	mu   sync.Mutex
+	done []bool
+}
+
+func newChunkSet(nChunks uint32, from uint32) *chunkSet {
+	set := &chunkSet{done: make([]bool, nChunks)}
+	for i := range min(from, nChunks) {
+		set.done[i] = true
+	}
+	return set
+}
+
+func (s *chunkSet) mark(chunkIndex uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int(chunkIndex) < len(s.done) {
+		s.done[chunkIndex] = true
+	}
+}
+
+// prefix counts the chunks written without a gap from the start. Striped
+// streams can leave later chunks written too; they are simply sent again.
+func (s *chunkSet) prefix() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n uint32
+	for n < uint32(len(s.done)) && s.done[n] {
+		n++
+	}
+	return n
+}
+
+// loadResumePoint returns how many chunks of filename a suspended transfer
+// already wrote, or zero if it cannot be resumed with this layout. A file
+// is only resumed from a sender whose fingerprint matches the one saved,
+// since a different file of the same name and size would otherwise be
+// spliced onto the old one's first chunks.
+func loadResumePoint(filename string, filesize uint64, chunkSize uint32, fingerprint string) uint32 {
+	data, err := os.ReadFile(filename + resumeSuffix)
+	if err != nil {
+		return 0
+	}
+
+	var point resumePoint
+	if err := json.Unmarshal(data, &point); err != nil {
+		return 0
+	}
+	if point.Filesize != filesize || point.ChunkSize != chunkSize {
+		return 0
+	}
+	if fingerprint == "" || point.Fingerprint != fingerprint {
+		return 0
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return 0
+	}
+	return point.Chunks
+}
+
+func saveResumePoint(filename string, point resumePoint) error {
+	data, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename+resumeSuffix, data, 0o600)
+}
+
+func removeResumePoint(filename string) {
+	if err := os.Remove(filename + resumeSuffix); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove %s: %v", filename+resumeSuffix, err)
+	}
+}
+
+// suspendTransfer stops an incoming transfer but keeps what has been
+// written, so sending the same file again picks up where it left off.
+func (c *Client) suspendTransfer(transferID uint32, reason error) {
+	value, ok := c.Transfers.Load(transferID)
+	if !ok {
+		return
+	}
+	ft := value.(*FileTransfer)
+	file, ok := ft.File.(*dirFile)
+	if ft.chunks == nil || ft.window == 0 || !ok {
+		c.dropTransfer(transferID, reason)
+		return
+	}
+	c.Transfers.Delete(transferID)
+
+	chunks := ft.chunks.prefix()
+	if err := file.suspend(resumePoint{
+		Filesize:    ft.Filesize,
+		ChunkSize:   ft.ChunkSize,
+		Chunks:      chunks,
+		Fingerprint: ft.fingerprint,
+	}); err != nil {
+		log.Printf("Transfer %d: failed to save resume point: %v", transferID, err)
+	}
+
+	c.finishProgress(ft, ProgressSuspended, reason)
+	c.emit(Event{
+		Type:        EventFailed,
+		TransferID:  transferID,
+		File:        ft.Filename,
+		Path:        ft.Path,
+		Direction:   ft.Direction,
+		State:       ProgressSuspended,
+		Bytes:       ft.Transferred.Load(),
+		Total:       ft.Filesize,
+		ContentType: ft.ContentType,
+		Error:       reason.Error(),
+	})
+	log.Printf("Transfer %d: suspended at %d of %d bytes (%v); send it again to resume",
+		transferID, min(uint64(chunks)*uint64(ft.ChunkSize), ft.Filesize), ft.Filesize, reason)
+}
@@ -1,22 +1,32 @@
 package transfer
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"net"
-	"os"
+	"sync"
 	"time"
 
+	"github.com/KD0S-02/KDTransfer/internal/codec"
 	"github.com/KD0S-02/KDTransfer/internal/crypto"
 	"github.com/KD0S-02/KDTransfer/internal/network"
 	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
 	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
+)
+
+const (
+	// maxStreams is bounded by the one-byte stream count in the layout.
+	maxStreams   = 255
+	readyTimeout = 5 * time.Second
 )
 
 func generateTransferID(filename string, senderIP string) uint32 {
@@ -26,45 +36,95 @@ func generateTransferID(filename string, senderIP string) uint32 {
 	return binary.BigEndian.Uint32(hash[:4])
 }
 
-func (c *Client) processFile(filepath string,
-	chunkSize int) (string, uint64, uint32, error) {
-	fileInfo, err := os.Stat(filepath)
+func numChunksOf(size uint64, chunkSize int) uint32 {
+	return uint32(math.Ceil(float64(size) / float64(chunkSize)))
+}
+
+func (c *Client) HandleSendCommand(ctx context.Context, peer string, filepath string,
+	passphrase string) error {
+	peerConn, err := c.connectPeer(ctx, peer, passphrase)
+	if err != nil {
+		return err
+	}
+	defer peerConn.Close()
+
+	if err := c.transferFile(ctx, filepath, peerConn); err != nil {
+		return fmt.Errorf("%w: %w", ErrTransferFailed, err)
+	}
+	return nil
+}
+
+// SendReader sends size bytes read from r to peer as a file called name.
+// Readers that also implement io.ReaderAt can be striped over several
+// streams; others are read once, in order, over one.
+func (c *Client) SendReader(ctx context.Context, peer string, name string, size uint64,
+	r io.Reader, passphrase string) error {
+	return c.SendSource(ctx, peer, storage.ReaderSource(name, size, r), passphrase)
+}
+
+// SendSource sends src to peer. The send uses its own key and transfer
+// state, so c can keep receiving meanwhile, and cancelling ctx cancels the
+// transfer on both sides.
+func (c *Client) SendSource(ctx context.Context, peer string, src storage.Source,
+	passphrase string) error {
+	sender := c.peerClient()
+	c.peers.Store(sender, struct{}{})
+	defer c.peers.Delete(sender)
+
+	peerConn, err := sender.connectPeer(ctx, peer, passphrase)
 	if err != nil {
-		return "", 0, 0, err
+		return err
+	}
+	defer peerConn.Close()
+
+	if err := sender.transferSource(ctx, src, peerConn); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("send cancelled: %w", context.Cause(ctx))
+		}
+		return fmt.Errorf("%w: %w", ErrTransferFailed, err)
 	}
-	filename := fileInfo.Name()
-	filesize := uint64(fileInfo.Size())
-	numChunks := uint32(math.Ceil(float64(filesize) / float64(chunkSize)))
-	return filename, filesize, numChunks, nil
+	return nil
 }
 
-func (c *Client) HandleSendCommand(peer string, filepath string, passphrase string) error {
-	receiverInfo, err := c.lookupPeer(peer)
+// connectPeer looks peer up on the signalling server and races its
+// addresses, returning the connection that answered first.
+func (c *Client) connectPeer(ctx context.Context, peer string,
+	passphrase string) (network.MessageConn, error) {
+	receiverInfo, err := c.lookupPeer(ctx, peer)
 	if err != nil {
-		return fmt.Errorf("peer lookup failed: %w", err)
+		return nil, fmt.Errorf("peer lookup failed: %w", err)
 	}
 
 	log.Printf("Found peer %s", peer)
+	c.emit(Event{Type: EventPeerFound, PeerID: peer, Identity: receiverInfo.Identity})
+
+	if receiverInfo.Type == signallingserver.PeerTypeBrowser {
+		return nil, fmt.Errorf("peer %s is a browser; send to it from the web UI", peer)
+	}
 
 	if len(passphrase) != 0 {
 		if err := c.decryptPeerAddresses(&receiverInfo, passphrase); err != nil {
-			return fmt.Errorf("failed to decrypt addresses: %w", err)
+			return nil, fmt.Errorf("failed to decrypt addresses: %w", err)
 		}
 	}
 
-	peerConn, connType, err := network.RaceConnections(receiverInfo.LocalAddr)
+	peerConn, transport, err := network.RaceConnections(ctx, dialCandidates(receiverInfo))
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer: %w", err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
 	}
-	defer peerConn.Close()
 
-	c.ConnType = connType
-	log.Printf("Connected to peer via %s", connType)
+	c.Transport = transport
+	log.Printf("Connected to peer via %s", transport.Name())
+	c.emitConnected(peer, peerConn)
 
-	return c.transferFile(filepath, peerConn)
+	return peerConn, nil
 }
 
-func (c *Client) lookupPeer(peerID string) (signallingserver.PeerInfo, error) {
+func (c *Client) lookupPeer(ctx context.Context,
+	peerID string) (signallingserver.PeerInfo, error) {
 	lookupRequest := signallingserver.PeerLookUp{PeerID: peerID}
 	payload, err := json.Marshal(lookupRequest)
 	if err != nil {
@@ -77,17 +137,22 @@ func (c *Client) lookupPeer(peerID string) (signallingserver.PeerInfo, error) {
 		return signallingserver.PeerInfo{}, fmt.Errorf("failed to create message: %w", err)
 	}
 
-	if _, err := c.SignalConn.Write(buf[:n]); err != nil {
-		return signallingserver.PeerInfo{}, fmt.Errorf("failed to send lookup: %w", err)
+	defer network.WatchContext(ctx, c.SignalConn)()
+
+	if err := c.SignalConn.WriteMessage(buf[:n]); err != nil {
+		return signallingserver.PeerInfo{}, interrupted(ctx,
+			fmt.Errorf("failed to send lookup: %w", err))
 	}
 
-	opCode, n, err := protocol.ReadMessage(c.SignalConn, buf)
+	opCode, n, err := c.SignalConn.ReadMessage(buf)
 	if err != nil {
-		return signallingserver.PeerInfo{}, fmt.Errorf("failed to read response: %w", err)
+		return signallingserver.PeerInfo{}, interrupted(ctx,
+			fmt.Errorf("failed to read response: %w", err))
 	}
 
 	if opCode == protocol.Error {
-		return signallingserver.PeerInfo{}, fmt.Errorf("server error: %s", string(buf[:n]))
+		return signallingserver.PeerInfo{}, fmt.Errorf("%w: server error: %s",
+			ErrPeerNotFound, string(buf[:n]))
 	}
 
 	if opCode != protocol.PeerLookupAck {
@@ -125,68 +190,349 @@ func (c *Client) decryptPeerAddresses(peerInfo *signallingserver.PeerInfo, passp
 	return nil
 }
 
-func (c *Client) transferFile(filepath string, peerConn net.Conn) error {
-	chunkSize := protocol.TCPChunkSize
-	if c.ConnType == network.WEBRTCConn {
-		chunkSize = protocol.WebRTCChunkSize
+func (c *Client) transferFile(ctx context.Context, filepath string,
+	peerConn network.MessageConn) error {
+	src, err := openSource(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to process file: %w", err)
 	}
+	defer closeSource(src)
 
-	filename, fileSize, numChunks, err := c.processFile(filepath, chunkSize)
+	return c.transferSource(ctx, src, peerConn)
+}
+
+func (c *Client) transferSource(ctx context.Context, src storage.Source,
+	peerConn network.MessageConn) error {
+	stop := network.WatchContext(ctx, peerConn)
+	agreed, err := c.handshake(peerConn)
+	stop()
+	if err != nil {
+		return interrupted(ctx, err)
+	}
+	if src.Size() == storage.UnknownSize && agreed.Version < protocol.StreamVersion {
+		return fmt.Errorf("%w: peer speaks protocol v%d and cannot receive streams "+
+			"of unknown size", protocol.ErrIncompatible, agreed.Version)
+	}
+
+	chunkSize := c.transport().MaxMessageSize() - protocol.TransferHeaderSize
+	if agreed.MaxChunkSize != 0 {
+		chunkSize = min(chunkSize, agreed.MaxChunkSize)
+	}
+	// Leave room for the nonce and tag so an encrypted chunk still fits
+	// the receiver's message buffer.
+	if len(c.Key) != 0 {
+		chunkSize -= protocol.EncryptionOverhead
+	}
+
+	conns := []network.MessageConn{peerConn}
+	if c.transport().Reliable() && c.Config.Streams > 1 && !src.Sequential() {
+		extra := openStreams(ctx, c.transport(), peerConn.RemoteAddr().String(),
+			c.Config.Streams-1)
+		for _, conn := range extra {
+			defer conn.Close()
+		}
+		conns = append(conns, extra...)
+	}
+
+	return c.transferStriped(ctx, src, conns, chunkSize, agreedCodecs(agreed), ackWindow)
+}
+
+// openStreams dials extra connections to the address that won the race.
+// Streams that fail to connect are dropped; the transfer just uses fewer.
+func openStreams(ctx context.Context, transport network.Transport, addr string,
+	n int) []network.MessageConn {
+	var conns []network.MessageConn
+	for range min(n, maxStreams-1) {
+		conn, err := transport.Dial(ctx, addr)
+		if err != nil {
+			log.Printf("Failed to open extra stream to %s: %v", addr, err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (c *Client) transferFileChunked(ctx context.Context, filepath string,
+	peerConn network.MessageConn, chunkSize int) error {
+	src, err := openSource(filepath)
 	if err != nil {
 		return fmt.Errorf("failed to process file: %w", err)
 	}
+	defer closeSource(src)
 
-	transferID := generateTransferID(filename, peerConn.LocalAddr().String())
+	return c.transferStriped(ctx, src, []network.MessageConn{peerConn}, chunkSize, nil, 0)
+}
 
-	if err := c.sendTransferStart(peerConn, transferID, filename, fileSize, numChunks); err != nil {
-		return err
+// transferStriped announces the transfer on the first connection and
+// sends chunk i on connection i % len(conns). Every connection ends with its
+// own FileTransferEnd, so the receiver knows when all stripes have landed.
+// When codecs are offered the receiver picks one, and each chunk is
+// compressed before encryption. With a window, each stream waits for the
+// receiver's ChunkAcks and the transfer only completes once the receiver
+// confirms the file is on disk. Sources of unknown size are sent until
+// they end and summarised in FileTransferEnd. Cancelling ctx cancels the
+// transfer on both sides.
+func (c *Client) transferStriped(ctx context.Context, src storage.Source,
+	conns []network.MessageConn, chunkSize int, offer []codec.Codec, window int) error {
+	// Compressed chunks carry a flag byte, so read one byte less.
+	if len(offer) != 0 {
+		chunkSize--
+	}
+
+	filename, fileSize := src.Name(), src.Size()
+	numChunks := numChunksOf(fileSize, chunkSize)
+	var digest *streamDigest
+	if fileSize == storage.UnknownSize {
+		if len(conns) > 1 {
+			return fmt.Errorf("streams of unknown size cannot be striped")
+		}
+		digest, numChunks = newStreamDigest(), 0
+	}
+
+	transferID := generateTransferID(filename, conns[0].LocalAddr().String())
+	layout := protocol.TransferLayout{
+		ChunkSize: uint32(chunkSize),
+		Streams:   uint8(len(conns)),
+		Window:    uint16(window),
+	}
+	for _, offered := range offer {
+		layout.Codecs = append(layout.Codecs, byte(offered))
+	}
+
+	meta := c.sourceMeta(src)
+	watch := network.WatchContext(ctx, conns[0])
+	if err := c.sendTransferStart(conns[0], transferID, filename, fileSize,
+		numChunks, layout, meta); err != nil {
+		watch()
+		return interrupted(ctx, err)
 	}
 
-	log.Printf("Sending file: %s (ID: %d, Size: %d bytes, Chunks: %d)",
-		filename, transferID, fileSize, numChunks)
+	var err error
+	chosen := codec.None
+	var resumeFrom uint32
+	if len(conns) > 1 || len(offer) != 0 || window > 0 {
+		chosen, resumeFrom, err = awaitTransferReady(conns[0], transferID)
+		if err != nil {
+			watch()
+			return interrupted(ctx, err)
+		}
+	}
+	watch()
+
+	if digest != nil {
+		log.Printf("Sending stream: %s (ID: %d, Compression: %s)", filename, transferID, chosen)
+	} else {
+		log.Printf("Sending file: %s (ID: %d, Size: %d bytes, Chunks: %d, Streams: %d, Compression: %s)",
+			filename, transferID, fileSize, numChunks, len(conns), chosen)
+	}
+	if resumeFrom > 0 {
+		log.Printf("Resuming transfer %d at chunk %d of %d", transferID, resumeFrom, numChunks)
+	}
+
+	stop := newStreamStop(conns)
 
 	ft := NewFileTransfer(filename, fileSize, transferID)
+	if digest != nil {
+		ft.Filesize, ft.digest = 0, digest
+	}
+	ft.Path = sourcePath(src)
+	ft.ContentType = meta.ContentType
+	ft.Codec = chosen
+	ft.resumedBytes = min(uint64(resumeFrom)*uint64(chunkSize), fileSize)
+	ft.Transferred.Store(ft.resumedBytes)
+	ft.Acked.Store(ft.resumedBytes)
+	ft.cancel = func(reason *protocol.TransferError) {
+		sendTransferError(conns[0], protocol.TransferCancel, reason)
+		stop.stop(reason)
+	}
+	if window > 0 {
+		ft.pause = newPauseGate(c.pauseTimeout(), stop, func() {
+			suspended := &protocol.TransferError{
+				Code:       protocol.CodeSuspended,
+				TransferID: transferID,
+				Message:    fmt.Sprintf("paused for longer than %s", c.pauseTimeout()),
+			}
+			sendTransferError(conns[0], protocol.TransferAbort, suspended)
+			stop.stop(fmt.Errorf("send the file again to resume: %w", suspended))
+		})
+		ft.setPaused = func(paused bool) error {
+			if paused {
+				ft.pause.pause()
+			} else {
+				ft.pause.resume()
+			}
+			ft.notePaused(paused, "sender")
+			return sendTransferControl(conns[0], controlOpCode(paused), transferID)
+		}
+	}
 	c.AddTransfer(transferID, ft)
 
-	buf := make([]byte, protocol.TotalTCPSize)
-	if err := c.sendFile(transferID, filepath, chunkSize, peerConn, buf); err != nil {
-		return fmt.Errorf("file transfer failed: %w", err)
+	defer context.AfterFunc(ctx, func() {
+		ft.cancel(&protocol.TransferError{
+			Code:       protocol.CodeCancelled,
+			TransferID: transferID,
+			Message:    context.Cause(ctx).Error(),
+		})
+	})()
+
+	windows := make([]*streamWindow, len(conns))
+	confirmed := make(chan struct{}, 1)
+	for stream, conn := range conns {
+		if window > 0 {
+			windows[stream] = newStreamWindow(window, stop)
+		}
+		// Mailbox uploads go over the signalling connection, where the
+		// server's MailboxAck is read by the caller once the upload ends;
+		// a reply reader left running would swallow it.
+		if conn != c.SignalConn {
+			go readReplies(conn, ft, windows[stream], stop, confirmed)
+		}
 	}
 
-	if err := c.sendTransferEnd(peerConn, transferID, buf); err != nil {
+	flow := c.Limiter.Open()
+	defer flow.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(conns))
+
+	for stream, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, protocol.MessageHeaderSize+protocol.TotalTCPSize)
+			// Each stream keeps its share of chunks, starting at the
+			// first one at or after the resume point.
+			first := resumeFrom - resumeFrom%uint32(len(conns)) + uint32(stream)
+			if first < resumeFrom {
+				first += uint32(len(conns))
+			}
+
+			if err := c.sendFile(transferID, src, numChunks, chunkSize,
+				conn, first, len(conns), flow, windows[stream], digest, buf); err != nil {
+				errs[stream] = fmt.Errorf("file transfer failed: %w", err)
+				return
+			}
+
+			var summary *protocol.StreamSummary
+			if digest != nil {
+				summary = digest.summary()
+			}
+			errs[stream] = c.sendTransferEnd(conn, transferID, summary, buf)
+		}()
+	}
+	wg.Wait()
+
+	if err := stop.Err(); err != nil {
+		c.dropTransfer(transferID, err)
+		return err
+	}
+	if err := errors.Join(errs...); err != nil {
+		sendTransferError(conns[0], protocol.TransferAbort,
+			transferFailure(protocol.CodeIO, transferID, err))
+		c.dropTransfer(transferID, err)
 		return err
 	}
 
+	if window > 0 {
+		if err := awaitConfirmation(confirmed, stop); err != nil {
+			c.dropTransfer(transferID, err)
+			return err
+		}
+	}
+
 	c.CompleteTransfer(transferID, "sent")
 
 	return nil
 }
 
-func (c *Client) sendFile(transferID uint32, filepath string, chunkSize int,
-	peerConn net.Conn, buf []byte) error {
-	file, err := os.Open(filepath)
+// awaitTransferReady waits for the receiver to register the transfer, so
+// chunks on other streams never arrive before it, and returns the codec it
+// chose from our offer and the chunk to resume from.
+func awaitTransferReady(conn network.MessageConn, transferID uint32) (codec.Codec, uint32, error) {
+	conn.SetReadDeadline(time.Now().Add(readyTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, protocol.TotalTCPSize)
+	opCode, n, err := conn.ReadMessage(buf)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return codec.None, 0, fmt.Errorf("receiver did not accept the transfer: %w", err)
+	}
+
+	switch opCode {
+	case protocol.Error, protocol.TransferCancel, protocol.TransferAbort:
+		return codec.None, 0, fmt.Errorf("receiver refused the transfer: %w",
+			protocol.ParseErrorPayload(buf[:n]))
+	}
+	if opCode != protocol.FileTransferReady || n < 4 ||
+		binary.BigEndian.Uint32(buf[:4]) != transferID {
+		return codec.None, 0, fmt.Errorf("unexpected response: opcode %d", opCode)
 	}
-	defer file.Close()
 
+	if n < 5 {
+		return codec.None, 0, nil
+	}
+	if n < 9 {
+		return codec.Codec(buf[4]), 0, nil
+	}
+	return codec.Codec(buf[4]), binary.BigEndian.Uint32(buf[5:9]), nil
+}
+
+// sendFile sends this stream's share of the chunks: first, first+streams,
+// and so on. With a digest, the file is a stream of unknown size read
+// until it ends, each chunk added to the digest as it is read.
+func (c *Client) sendFile(transferID uint32, file io.ReaderAt, numChunks uint32,
+	chunkSize int, peerConn network.MessageConn, first uint32, streams int, flow *ratelimit.Flow,
+	window *streamWindow, digest *streamDigest, buf []byte) error {
 	chunk := make([]byte, chunkSize)
-	chunkIndex := uint32(0)
+	wire := make([]byte, 0, chunkSize+1)
+	ft, _ := c.Transfer(transferID)
+	chosen := codec.None
+	if ft != nil {
+		chosen = ft.Codec
+	}
 
-	for {
-		n, err := file.Read(chunk)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+	var gate *pauseGate
+	if ft != nil {
+		gate = ft.pause
+	}
+
+	for chunkIndex := first; digest != nil || chunkIndex < numChunks; chunkIndex += uint32(streams) {
+		if err := gate.wait(); err != nil {
+			return err
+		}
+		if err := window.acquire(); err != nil {
+			return err
+		}
+
+		n, err := file.ReadAt(chunk, int64(chunkIndex)*int64(chunkSize))
+		if err != nil && err != io.EOF {
 			return fmt.Errorf("read error at chunk %d: %w", chunkIndex, err)
 		}
-		if n == 0 {
+		if n == 0 && digest != nil {
 			break
 		}
+		// A file that shrank while being sent cannot fill its chunks, and
+		// the receiver would refuse the short one.
+		if digest == nil && ft != nil &&
+			uint64(n) < min(uint64(chunkSize), ft.Filesize-uint64(chunkIndex)*uint64(chunkSize)) {
+			return fmt.Errorf("%s shrank while being sent: chunk %d is short", ft.Filename, chunkIndex)
+		}
+		if digest != nil {
+			if chunkIndex == math.MaxUint32 {
+				return fmt.Errorf("stream exceeds %d chunks", uint32(math.MaxUint32))
+			}
+			digest.add(chunk[:n])
+		}
 
 		actualChunk := chunk[:n]
 
+		if chosen != codec.None {
+			actualChunk = codec.Encode(chosen, wire, actualChunk)
+		}
+		wireLen := len(actualChunk)
+
 		if len(c.Key) != 0 {
 			actualChunk, err = crypto.EncryptData(actualChunk, c.Key)
 			if err != nil {
@@ -199,11 +545,23 @@ func (c *Client) sendFile(transferID uint32, filepath string, chunkSize int,
 			return fmt.Errorf("failed to create chunk %d message: %w", chunkIndex, err)
 		}
 
-		if _, err := peerConn.Write(buf[:msgSize]); err != nil {
+		flow.Wait(msgSize)
+
+		if err := peerConn.WriteMessage(buf[:msgSize]); err != nil {
 			return fmt.Errorf("failed to send chunk %d: %w", chunkIndex, err)
 		}
 
-		chunkIndex++
+		if ft != nil {
+			ft.Transferred.Add(uint64(n))
+			if chosen != codec.None {
+				ft.WireBytes.Add(uint64(wireLen))
+			}
+		}
+
+		// A short read is the end of a stream.
+		if digest != nil && n < chunkSize {
+			break
+		}
 	}
 
 	return nil
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package transfer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchRateLimit re-reads RATE_LIMIT whenever the process gets SIGHUP. The
+// returned func stops watching.
+func (c *Client) WatchRateLimit() func() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				c.reloadRateLimit()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangups)
+		close(done)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package transfer
+
+// WatchRateLimit is a no-op on Windows, which has no SIGHUP; use
+// SetRateLimit instead.
+func (c *Client) WatchRateLimit() func() {
+	return func() {}
+}
@@ -0,0 +1,249 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
+)
+
+// openSource opens the file to send. "-" streams standard input until it
+// ends.
+func openSource(path string) (storage.Source, error) {
+	if path == "-" {
+		return storage.StreamSource("stdin", os.Stdin), nil
+	}
+	return storage.OpenFile(path)
+}
+
+// closeSource closes src if it holds anything open.
+func closeSource(src storage.Source) {
+	if closer, ok := src.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// streamDigest follows a stream of unknown size in chunk order. The sender
+// fills it as chunks are read and the receiver as they are written, and
+// the receiver checks its own against the sender's in FileTransferEnd.
+type streamDigest struct {
+	hash   hash.Hash
+	chunks uint32
+	bytes  uint64
+}
+
+func newStreamDigest() *streamDigest {
+	return &streamDigest{hash: sha256.New()}
+}
+
+func (d *streamDigest) add(chunk []byte) {
+	d.hash.Write(chunk)
+	d.chunks++
+	d.bytes += uint64(len(chunk))
+}
+
+// check compares what arrived with the sender's summary.
+func (d *streamDigest) check(sent *protocol.StreamSummary) error {
+	if sent == nil {
+		return fmt.Errorf("stream ended without a summary")
+	}
+	got := d.summary()
+	if got.Chunks != sent.Chunks || got.Bytes != sent.Bytes {
+		return fmt.Errorf("stream incomplete: received %d chunks (%d bytes), sender sent %d (%d bytes)",
+			got.Chunks, got.Bytes, sent.Chunks, sent.Bytes)
+	}
+	if got.SHA256 != sent.SHA256 {
+		return fmt.Errorf("stream corrupted: SHA-256 %x, sender had %x", got.SHA256, sent.SHA256)
+	}
+	return nil
+}
+
+func (d *streamDigest) summary() *protocol.StreamSummary {
+	summary := &protocol.StreamSummary{Chunks: d.chunks, Bytes: d.bytes}
+	d.hash.Sum(summary.SHA256[:0])
+	return summary
+}
+
+// sourcePath is where src lives on disk, if anywhere, so the completed
+// event can hash it.
+func sourcePath(src storage.Source) string {
+	if file, ok := src.(interface{ Path() string }); ok {
+		return file.Path()
+	}
+	return ""
+}
+
+// sourceMeta is what FileTransferStart says about src beyond its name
+// and size: its content type, and for files on disk a fingerprint and the
+// attributes Preserve selects.
+func (c *Client) sourceMeta(src storage.Source) protocol.TransferMeta {
+	var meta protocol.TransferMeta
+	if typed, ok := src.(interface{ ContentType() string }); ok {
+		meta.ContentType = typed.ContentType()
+	}
+
+	path := sourcePath(src)
+	if path == "" {
+		return meta
+	}
+	fingerprint, err := fileFingerprint(path)
+	if err != nil {
+		log.Printf("%s cannot be resumed if suspended: %v", path, err)
+	}
+	meta.Fingerprint = fingerprint
+	if c.Config.Preserve == 0 {
+		return meta
+	}
+	attrs, err := fileattr.Read(path, c.Config.Preserve)
+	if err != nil {
+		log.Printf("Some attributes of %s will not be sent: %v", path, err)
+	}
+
+	meta.Mode = uint32(attrs.Mode)
+	if !attrs.ModTime.IsZero() {
+		meta.ModTime = attrs.ModTime.UnixNano()
+	}
+	if !attrs.AccessTime.IsZero() {
+		meta.AccessTime = attrs.AccessTime.UnixNano()
+	}
+	meta.Xattrs, meta.ACL = attrs.Xattrs, attrs.ACL
+	return meta
+}
+
+// fingerprintPrefix is how much of a file its fingerprint reads.
+const fingerprintPrefix = 1 << 20
+
+// fileFingerprint identifies the file at path by its size, modification
+// time and a hash of its first MiB. It is cheap even for large files and
+// changes when the file is replaced or rewritten, which is all a receiver
+// needs to tell whether a partial copy came from it.
+func fileFingerprint(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:", info.Size(), info.ModTime().UnixNano())
+	if _, err := io.CopyN(h, file, fingerprintPrefix); err != nil && err != io.EOF {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:16]), nil
+}
+
+// metaAttrs turns received metadata back into file attributes.
+func metaAttrs(meta protocol.TransferMeta) fileattr.Attrs {
+	attrs := fileattr.Attrs{
+		Mode:   fs.FileMode(meta.Mode).Perm(),
+		Xattrs: meta.Xattrs,
+		ACL:    meta.ACL,
+	}
+	if meta.ModTime != 0 {
+		attrs.ModTime = time.Unix(0, meta.ModTime)
+	}
+	if meta.AccessTime != 0 {
+		attrs.AccessTime = time.Unix(0, meta.AccessTime)
+	}
+	return attrs
+}
+
+// applyAttrs gives a received file the attributes its sender sent, as
+// far as Preserve selects them. Failures are logged; the file is kept.
+func (c *Client) applyAttrs(ft *FileTransfer, set fileattr.Set) {
+	if err := fileattr.Apply(ft.Path, ft.attrs, set); err != nil {
+		log.Printf("Transfer %d: some attributes of %s were not applied: %v",
+			ft.TransferID, ft.Path, err)
+	}
+}
+
+// sink is where incoming files go: Sink if set, else ReceiveDir.
+func (c *Client) sink() storage.Sink {
+	if c.Sink != nil {
+		return c.Sink
+	}
+	return dirSink{dir: c.Config.ReceiveDir}
+}
+
+// dirSink writes incoming files into a directory, using only the base of
+// the sender's name so a sender cannot write outside it. A suspended file
+// keeps a resume point beside it for the next attempt.
+type dirSink struct {
+	dir string
+}
+
+func (s dirSink) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s dirSink) Create(name string, size uint64) (storage.SinkFile, error) {
+	path := s.path(name)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{File: file, path: path}, nil
+}
+
+// resume reopens name if a suspended transfer of the same file, by size,
+// chunk size and fingerprint, left it, returning how many chunks are
+// already written. It returns a nil file when there is nothing to resume.
+func (s dirSink) resume(name string, size uint64, chunkSize uint32, fingerprint string) (*dirFile, uint32, error) {
+	path := s.path(name)
+	chunks := loadResumePoint(path, size, chunkSize, fingerprint)
+	if chunks == 0 {
+		return nil, 0, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &dirFile{File: file, path: path}, chunks, nil
+}
+
+type dirFile struct {
+	*os.File
+	path string
+}
+
+func (f *dirFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	removeResumePoint(f.path)
+	return nil
+}
+
+func (f *dirFile) Abort() error {
+	f.Close()
+	removeResumePoint(f.path)
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// suspend closes the file but keeps it, recording how much is written.
+func (f *dirFile) suspend(point resumePoint) error {
+	f.Sync()
+	f.Close()
+	return saveResumePoint(f.path, point)
+}
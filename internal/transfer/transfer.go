@@ -1,16 +1,96 @@
 package transfer
 
 import (
-	"os"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
 )
 
 type FileTransfer struct {
-	File       *os.File
-	TransferID uint32
-	Filename   string
-	Filesize   uint64
-	StartTime  time.Time
+	// File is where a receiving transfer writes.
+	File        storage.SinkFile
+	TransferID  uint32
+	Filename    string
+	Path        string
+	Filesize    uint64
+	Direction   Direction
+	StartTime   time.Time
+	Transferred atomic.Uint64
+	// Acked counts the bytes the receiver has confirmed writing.
+	Acked atomic.Uint64
+
+	// ChunkSize places each chunk at chunkIndex*ChunkSize; zero means the
+	// sender predates chunk offsets and chunks arrive in order.
+	ChunkSize uint32
+	// nChunks is how many chunks the sender announced for a file of
+	// known size.
+	nChunks uint32
+	// streams counts the connections still to send FileTransferEnd, and
+	// endedStreams holds the *peerStream of each that has.
+	streams      atomic.Int32
+	endedStreams sync.Map
+	// window is the sender's ack window; zero means it expects no acks.
+	window uint16
+
+	// ContentType is set for typed messages, whose content is held in
+	// message rather than written to a sink.
+	ContentType string
+	message     *storage.MemorySink
+
+	// attrs are what the sender sent of its file's mode, times, extended
+	// attributes and ACL, applied once a received file is complete.
+	attrs fileattr.Attrs
+
+	// Codec is the compression negotiated for this transfer, and
+	// WireBytes the chunk bytes actually sent before encryption.
+	Codec     codec.Codec
+	WireBytes atomic.Uint64
+
+	// cancel tells the peer and stops the transfer, and setPaused pauses
+	// or resumes it; both are set by whichever side owns the connections.
+	cancel    func(*protocol.TransferError)
+	setPaused func(paused bool) error
+	paused    atomic.Bool
+	// pause holds the sender's streams while paused.
+	pause *pauseGate
+
+	// chunks records written chunks on the receiving side, for resuming,
+	// and fingerprint the sender's identity for the file's contents.
+	chunks      *chunkSet
+	fingerprint string
+	// digest follows a stream of unknown size, whose Filesize stays zero.
+	digest *streamDigest
+	// resumedBytes were already in place when a resumed transfer started,
+	// and are left out of its rates.
+	resumedBytes uint64
+
+	progress *progress
+}
+
+// checkComplete reports an error unless every chunk of a file of known
+// size has been written, or, without chunk offsets, all of its bytes.
+func (ft *FileTransfer) checkComplete() error {
+	if ft.chunks != nil {
+		if written := ft.chunks.prefix(); written != ft.nChunks {
+			return fmt.Errorf("only %d of %d chunks arrived", written, ft.nChunks)
+		}
+		return nil
+	}
+	if received := ft.Transferred.Load(); received != ft.Filesize {
+		return fmt.Errorf("received %d of %d bytes", received, ft.Filesize)
+	}
+	return nil
+}
+
+// Paused reports whether either side has paused the transfer.
+func (ft *FileTransfer) Paused() bool {
+	return ft.paused.Load()
 }
 
 func NewFileTransfer(filename string, filesize uint64, transferID uint32) *FileTransfer {
@@ -18,6 +98,7 @@ func NewFileTransfer(filename string, filesize uint64, transferID uint32) *FileT
 		TransferID: transferID,
 		Filename:   filename,
 		Filesize:   filesize,
+		Direction:  Sending,
 		StartTime:  time.Now(),
 	}
 }
@@ -0,0 +1,1202 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/config"
+	"github.com/KD0S-02/KDTransfer/internal/crypto"
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/ratelimit"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
+)
+
+// startReceiver accepts peer connections on localhost like Receiver does,
+// writing received files into the test's working directory.
+func startReceiver(t *testing.T, key []byte) (*Client, string, chan error) {
+	t.Helper()
+
+	listener, err := network.TCP.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	receiver := &Client{Config: &config.Config{}, Key: key}
+	errs := make(chan error, 16)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { errs <- handlePeerConnection(context.Background(), conn, receiver) }()
+		}
+	}()
+
+	return receiver, listener.Addr().String(), errs
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func sendTestFile(t *testing.T, cfg *config.Config, key []byte, data []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	src := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, errs := startReceiver(t, key)
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{
+		Config:    cfg,
+		Transport: network.TCP,
+		Key:       key,
+	}
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	for range max(cfg.Streams, 1) {
+		if err := <-errs; err != nil {
+			t.Fatalf("receiver failed: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "payload.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestStripedTransferReassemblesFile(t *testing.T) {
+	sendTestFile(t, &config.Config{Streams: 4}, nil,
+		randomData(5*protocol.TCPChunkSize+1234))
+}
+
+func TestStripedTransferIntoStreamSink(t *testing.T) {
+	data := randomData(6*protocol.TCPChunkSize + 99)
+	src := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	receiver, addr, errs := startReceiver(t, nil)
+	var out bytes.Buffer
+	receiver.Sink = storage.NewWriterSink(&out)
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{Config: &config.Config{Streams: 3}, Transport: network.TCP}
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Fatalf("receiver failed: %v", err)
+		}
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("sink got %d bytes that differ from the %d sent", out.Len(), len(data))
+	}
+}
+
+func TestEncryptedSingleStreamTransfer(t *testing.T) {
+	key, err := crypto.GenerateKey("secret", crypto.GenerateRandSalt())
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	sendTestFile(t, &config.Config{Streams: 1}, key,
+		randomData(2*protocol.TCPChunkSize+7))
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	key, err := crypto.GenerateKey("secret", crypto.GenerateRandSalt())
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+
+	// Compressible log lines followed by random bytes that must be sent raw.
+	data := bytes.Repeat([]byte("level=info msg=\"chunk stored\" bytes=262144\n"), 30000)
+	data = append(data, randomData(protocol.TCPChunkSize)...)
+
+	sendTestFile(t, &config.Config{Streams: 2, Compression: []codec.Codec{codec.Zstd}},
+		key, data)
+}
+
+func TestHandshakeRejectsCipherMismatch(t *testing.T) {
+	key, err := crypto.GenerateKey("secret", crypto.GenerateRandSalt())
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+
+	_, addr, errs := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP, Key: key}
+	_, err = sender.handshake(conn)
+	if err == nil || !strings.Contains(err.Error(), "--passphrase") {
+		t.Fatalf("expected cipher mismatch, got %v", err)
+	}
+	if err := <-errs; !errors.Is(err, protocol.ErrIncompatible) {
+		t.Fatalf("receiver error = %v, want ErrIncompatible", err)
+	}
+}
+
+func TestHandshakeDerivesKeyFromReceiverSalt(t *testing.T) {
+	salt := crypto.GenerateRandSalt()
+	key, err := crypto.GenerateKey("secret", salt)
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+
+	receiver, addr, _ := startReceiver(t, key)
+	receiver.SaltData = salt
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	// A sender that found the receiver over mDNS knows only the passphrase.
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP, passphrase: "secret"}
+	if _, err := sender.handshake(conn); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if !bytes.Equal(sender.Key, key) {
+		t.Fatal("sender did not derive the receiver's key from its hello")
+	}
+}
+
+func TestSenderAbortRemovesPartialFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	receiver, addr, errs := startReceiver(t, nil)
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+	if _, err := sender.handshake(conn); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if err := sender.sendTransferStart(conn, 9, "partial.bin", 1<<20, 4,
+		protocol.TransferLayout{ChunkSize: protocol.TCPChunkSize, Streams: 1},
+		protocol.TransferMeta{}); err != nil {
+		t.Fatalf("failed to start transfer: %v", err)
+	}
+
+	buf := make([]byte, protocol.MessageHeaderSize+protocol.TotalTCPSize)
+	n, err := protocol.CreateFileTransferDataRequest(9, 0, randomData(protocol.TCPChunkSize), buf)
+	if err != nil {
+		t.Fatalf("failed to create chunk: %v", err)
+	}
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		t.Fatalf("failed to send chunk: %v", err)
+	}
+	sendTransferError(conn, protocol.TransferAbort, &protocol.TransferError{
+		Code: protocol.CodeIO, TransferID: 9, Message: "disk on fire"})
+
+	if err := <-errs; err != nil {
+		t.Fatalf("receiver failed: %v", err)
+	}
+	if _, err := os.Stat("partial.bin"); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+	if _, ok := receiver.Transfer(9); ok {
+		t.Fatal("aborted transfer still registered")
+	}
+}
+
+func TestReceiverRejectsChunksPastTheFile(t *testing.T) {
+	for name, chunkIndex := range map[string]uint32{
+		"index past the last chunk": 1 << 20,
+		"last chunk too long":       3,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			_, addr, errs := startReceiver(t, nil)
+
+			conn, err := network.TCP.Dial(context.Background(), addr)
+			if err != nil {
+				t.Fatalf("failed to dial receiver: %v", err)
+			}
+			defer conn.Close()
+
+			sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+			if _, err := sender.handshake(conn); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			size := uint64(3*protocol.TCPChunkSize + 10)
+			if err := sender.sendTransferStart(conn, 9, "bounded.bin", size, 4,
+				protocol.TransferLayout{ChunkSize: protocol.TCPChunkSize, Streams: 1},
+				protocol.TransferMeta{}); err != nil {
+				t.Fatalf("failed to start transfer: %v", err)
+			}
+
+			buf := make([]byte, protocol.MessageHeaderSize+protocol.TotalTCPSize)
+			n, err := protocol.CreateFileTransferDataRequest(9, chunkIndex, randomData(1024), buf)
+			if err != nil {
+				t.Fatalf("failed to create chunk: %v", err)
+			}
+			if err := conn.WriteMessage(buf[:n]); err != nil {
+				t.Fatalf("failed to send chunk: %v", err)
+			}
+
+			var failure *protocol.TransferError
+			if err := <-errs; !errors.As(err, &failure) || failure.Code != protocol.CodeCorrupt {
+				t.Fatalf("receiver error = %v, want a corruption error", err)
+			}
+			if info, err := os.Stat("bounded.bin"); err == nil && uint64(info.Size()) > size {
+				t.Fatalf("file grew to %d bytes past its %d byte size", info.Size(), size)
+			}
+		})
+	}
+}
+
+func TestReceiverRefusesIncompleteFiles(t *testing.T) {
+	for name, tc := range map[string]struct {
+		streams uint8
+		chunks  []uint32
+	}{
+		"missing chunk":  {streams: 1, chunks: []uint32{0}},
+		"missing stream": {streams: 2, chunks: []uint32{0}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			_, addr, errs := startReceiver(t, nil)
+
+			conn, err := network.TCP.Dial(context.Background(), addr)
+			if err != nil {
+				t.Fatalf("failed to dial receiver: %v", err)
+			}
+			defer conn.Close()
+
+			sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+			if _, err := sender.handshake(conn); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if err := sender.sendTransferStart(conn, 9, "short.bin", 2*protocol.TCPChunkSize, 2,
+				protocol.TransferLayout{ChunkSize: protocol.TCPChunkSize, Streams: tc.streams},
+				protocol.TransferMeta{}); err != nil {
+				t.Fatalf("failed to start transfer: %v", err)
+			}
+
+			buf := make([]byte, protocol.MessageHeaderSize+protocol.TotalTCPSize)
+			for _, chunkIndex := range tc.chunks {
+				n, err := protocol.CreateFileTransferDataRequest(9, chunkIndex,
+					randomData(protocol.TCPChunkSize), buf)
+				if err != nil {
+					t.Fatalf("failed to create chunk: %v", err)
+				}
+				if err := conn.WriteMessage(buf[:n]); err != nil {
+					t.Fatalf("failed to send chunk: %v", err)
+				}
+			}
+			if err := sender.sendTransferEnd(conn, 9, nil, buf); err != nil {
+				t.Fatalf("failed to send end: %v", err)
+			}
+			// The other stream ends without sending its chunk.
+			if tc.streams > 1 {
+				if err := <-errs; err != nil {
+					t.Fatalf("first stream failed: %v", err)
+				}
+				other, err := network.TCP.Dial(context.Background(), addr)
+				if err != nil {
+					t.Fatalf("failed to dial receiver: %v", err)
+				}
+				defer other.Close()
+				if err := sender.sendTransferEnd(other, 9, nil, buf); err != nil {
+					t.Fatalf("failed to send end: %v", err)
+				}
+			}
+
+			var failure *protocol.TransferError
+			if err := <-errs; !errors.As(err, &failure) || failure.Code != protocol.CodeCorrupt {
+				t.Fatalf("receiver error = %v, want a corruption error", err)
+			}
+			if _, err := os.Stat("short.bin"); !os.IsNotExist(err) {
+				t.Fatalf("incomplete file kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestReceiverCountsEachStreamEndOnce(t *testing.T) {
+	t.Chdir(t.TempDir())
+	listener, err := network.TCP.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := network.TCP.Dial(context.Background(), listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	peerConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer peerConn.Close()
+
+	sender := &Client{Config: &config.Config{}}
+	if err := sender.sendTransferStart(conn, 9, "twice.bin", protocol.TCPChunkSize, 1,
+		protocol.TransferLayout{ChunkSize: protocol.TCPChunkSize, Streams: 2},
+		protocol.TransferMeta{}); err != nil {
+		t.Fatalf("failed to start transfer: %v", err)
+	}
+	buf := make([]byte, protocol.MessageHeaderSize+protocol.TotalTCPSize)
+	n, err := protocol.CreateFileTransferDataRequest(9, 0, randomData(protocol.TCPChunkSize), buf)
+	if err != nil {
+		t.Fatalf("failed to create chunk: %v", err)
+	}
+	if err := conn.WriteMessage(buf[:n]); err != nil {
+		t.Fatalf("failed to send chunk: %v", err)
+	}
+	for range 2 {
+		if err := sender.sendTransferEnd(conn, 9, nil, buf); err != nil {
+			t.Fatalf("failed to send end: %v", err)
+		}
+	}
+
+	// Keep reading the one stream past its first end, as a replay would.
+	receiver := &Client{Config: &config.Config{}}
+	var stream peerStream
+	for range 4 {
+		if _, err = handleMessages(peerConn, receiver, &stream); err != nil {
+			break
+		}
+	}
+	var failure *protocol.TransferError
+	if !errors.As(err, &failure) || failure.Code != protocol.CodeBadRequest {
+		t.Fatalf("receiver error = %v, want a bad request", err)
+	}
+	if _, err := os.Stat("twice.bin"); !os.IsNotExist(err) {
+		t.Fatalf("file committed from one stream: %v", err)
+	}
+}
+
+func TestReceiverCancelStopsSender(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	src := filepath.Join(t.TempDir(), "slow.bin")
+	if err := os.WriteFile(src, randomData(8*protocol.TCPChunkSize), 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	receiver, addr, _ := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		Limiter:   ratelimit.NewLimiter(protocol.TotalTCPSize),
+	}
+	done := make(chan error, 1)
+	go func() { done <- sender.transferFile(context.Background(), src, conn) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var id uint32
+		receiver.Transfers.Range(func(key, _ any) bool {
+			id = key.(uint32)
+			return false
+		})
+		if id != 0 && receiver.CancelTransfer(id, "changed my mind") == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transfer never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-done; !errors.Is(err, protocol.ErrCancelled) {
+		t.Fatalf("sender error = %v, want ErrCancelled", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.bin")); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+}
+
+func TestServeShutdownCancelsTransfers(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "slow.bin")
+	if err := os.WriteFile(src, randomData(8*protocol.TCPChunkSize), 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to pick a port: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(probe.Addr().String())
+	probe.Close()
+
+	receiver := &Client{Config: &config.Config{TCPPort: port, ReceiveDir: dir}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- receiver.Serve(ctx) }()
+
+	var conn network.MessageConn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = network.TCP.Dial(context.Background(), "127.0.0.1:"+port); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver never listened: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		Limiter:   ratelimit.NewLimiter(protocol.TotalTCPSize),
+	}
+	done := make(chan error, 1)
+	go func() { done <- sender.transferFile(context.Background(), src, conn) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		started := false
+		receiver.Transfers.Range(func(_, _ any) bool {
+			started = true
+			return false
+		})
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transfer never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if err := <-done; !errors.Is(err, protocol.ErrCancelled) {
+		t.Fatalf("sender error = %v, want ErrCancelled", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.bin")); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+}
+
+func TestSenderContextCancelsTransfer(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	src := filepath.Join(t.TempDir(), "slow.bin")
+	if err := os.WriteFile(src, randomData(8*protocol.TCPChunkSize), 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, _ := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		Limiter:   ratelimit.NewLimiter(protocol.TotalTCPSize),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sender.transferFile(ctx, src, conn) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		started := false
+		sender.Transfers.Range(func(_, _ any) bool {
+			started = true
+			return false
+		})
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transfer never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, protocol.ErrCancelled) {
+		t.Fatalf("sender error = %v, want ErrCancelled", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, err := os.Stat(filepath.Join(dir, "slow.bin"))
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("partial file left behind: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamWindowBlocksUntilAcked(t *testing.T) {
+	stop := newStreamStop(nil)
+	window := newStreamWindow(2, stop)
+
+	for range 2 {
+		if err := window.acquire(); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- window.acquire() }()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire did not wait for a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if written := window.ack(1, 100); written != 100 {
+		t.Fatalf("ack reported %d new bytes, want 100", written)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire failed after ack: %v", err)
+	}
+
+	go func() { acquired <- window.acquire() }()
+	stop.stop(protocol.ErrCancelled)
+	if err := <-acquired; !errors.Is(err, protocol.ErrCancelled) {
+		t.Fatalf("acquire after stop = %v, want ErrCancelled", err)
+	}
+}
+
+func TestAckedTransferWaitsForConfirmation(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	data := randomData(10*protocol.TCPChunkSize + 99)
+	src := filepath.Join(t.TempDir(), "acked.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, errs := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	source, err := storage.OpenFile(src)
+	if err != nil {
+		t.Fatalf("failed to open source: %v", err)
+	}
+	defer source.Close()
+
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+	if err := sender.transferStriped(context.Background(), source, []network.MessageConn{conn},
+		protocol.TCPChunkSize, nil, 2); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	// The receiver confirms only after flushing, so the file is complete
+	// as soon as the sender returns.
+	got, err := os.ReadFile(filepath.Join(dir, "acked.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("receiver failed: %v", err)
+	}
+}
+
+// startSlowSend begins sending src at one chunk per second and returns once
+// the sender has registered the transfer.
+func startSlowSend(t *testing.T, sender *Client, src string, addr string) (uint32, chan error) {
+	t.Helper()
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	done := make(chan error, 1)
+	go func() { done <- sender.transferFile(context.Background(), src, conn) }()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		var id uint32
+		sender.Transfers.Range(func(key, _ any) bool {
+			id = key.(uint32)
+			return false
+		})
+		if id != 0 {
+			return id, done
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("transfer never started")
+	return 0, nil
+}
+
+func TestPauseHoldsSenderUntilResumed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	src := filepath.Join(t.TempDir(), "paused.bin")
+	if err := os.WriteFile(src, randomData(3*protocol.TCPChunkSize), 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, _ := startReceiver(t, nil)
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		Limiter:   ratelimit.NewLimiter(4 * protocol.TotalTCPSize),
+	}
+	id, done := startSlowSend(t, sender, src, addr)
+
+	if err := sender.PauseTransfer(id); err != nil {
+		t.Fatalf("pause failed: %v", err)
+	}
+	ft, _ := sender.Transfer(id)
+	// Let a chunk already past the gate finish before sampling.
+	time.Sleep(600 * time.Millisecond)
+	held := ft.Transferred.Load()
+	time.Sleep(400 * time.Millisecond)
+	if sent := ft.Transferred.Load(); sent != held {
+		t.Fatalf("sender kept sending while paused: %d -> %d bytes", held, sent)
+	}
+
+	if err := sender.ResumeTransfer(id); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("transfer failed after resume: %v", err)
+	}
+}
+
+func TestPauseTimeoutSuspendsForResume(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	data := randomData(6*protocol.TCPChunkSize + 5)
+	src := filepath.Join(t.TempDir(), "suspended.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	addr := sendUntilSuspended(t, src)
+	partial := filepath.Join(dir, "suspended.bin")
+
+	resumer := &Client{Config: &config.Config{}, Transport: network.TCP}
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+	if err := resumer.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("resumed transfer failed: %v", err)
+	}
+
+	got, err := os.ReadFile(partial)
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("resumed file differs from the source")
+	}
+	if _, err := os.Stat(partial + resumeSuffix); !os.IsNotExist(err) {
+		t.Fatalf("resume point left behind: %v", err)
+	}
+}
+
+// sendUntilSuspended starts sending src to a new receiver in the current
+// directory, pauses it until it is suspended and returns the receiver's
+// address.
+func sendUntilSuspended(t *testing.T, src string) string {
+	t.Helper()
+
+	_, addr, _ := startReceiver(t, nil)
+	sender := &Client{
+		Config:    &config.Config{PauseTimeout: 100 * time.Millisecond},
+		Transport: network.TCP,
+		Limiter:   ratelimit.NewLimiter(2 * protocol.TotalTCPSize),
+	}
+	id, done := startSlowSend(t, sender, src, addr)
+	time.Sleep(300 * time.Millisecond)
+	if err := sender.PauseTransfer(id); err != nil {
+		t.Fatalf("pause failed: %v", err)
+	}
+
+	err := <-done
+	var suspended *protocol.TransferError
+	if !errors.As(err, &suspended) || suspended.Code != protocol.CodeSuspended {
+		t.Fatalf("sender error = %v, want a suspended transfer", err)
+	}
+
+	partial := filepath.Base(src)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(partial + resumeSuffix); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("receiver did not keep a resume point")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr
+}
+
+func TestSuspendedTransferOnlyResumesSameFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	src := filepath.Join(t.TempDir(), "replaced.bin")
+	if err := os.WriteFile(src, randomData(6*protocol.TCPChunkSize+5), 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	addr := sendUntilSuspended(t, src)
+
+	// A different file under the same name and size must not be spliced
+	// onto the chunks the first one left behind.
+	data := randomData(6*protocol.TCPChunkSize + 5)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to replace source: %v", err)
+	}
+
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "replaced.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received file mixes the old and new contents")
+	}
+}
+
+func TestProgressMeterRateAndETA(t *testing.T) {
+	start := time.Now()
+	ft := &FileTransfer{TransferID: 1, Filesize: 1000, Direction: Sending, StartTime: start}
+	var meter progressMeter
+
+	ft.Transferred.Store(100)
+	event := meter.sample(ft, start.Add(time.Second))
+	if event.Rate != 100 || event.AverageRate != 100 {
+		t.Fatalf("rate %.1f, average %.1f; want 100 B/s", event.Rate, event.AverageRate)
+	}
+	if event.ETA != 9*time.Second {
+		t.Fatalf("ETA %s, want 9s", event.ETA)
+	}
+
+	ft.paused.Store(true)
+	event = meter.sample(ft, start.Add(2*time.Second))
+	if event.State != ProgressPaused || event.ETA != 0 {
+		t.Fatalf("paused sample = %+v", event)
+	}
+}
+
+func TestProgressReportsCompletion(t *testing.T) {
+	var mu sync.Mutex
+	var events []ProgressEvent
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	src := filepath.Join(t.TempDir(), "progress.bin")
+	data := randomData(3*protocol.TCPChunkSize + 11)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, _ := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		OnProgress: func(e ProgressEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		},
+	}
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		t.Fatal("no progress events")
+	}
+	last := events[len(events)-1]
+	if last.State != ProgressCompleted || last.Bytes != uint64(len(data)) ||
+		last.Acked != uint64(len(data)) || last.Direction != Sending {
+		t.Fatalf("final event = %+v", last)
+	}
+}
+
+func TestCompletedEventCarriesHash(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	src := filepath.Join(t.TempDir(), "hashed.bin")
+	data := randomData(2*protocol.TCPChunkSize + 5)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	_, addr, _ := startReceiver(t, nil)
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	var events []Event
+	sender := &Client{
+		Config:    &config.Config{},
+		Transport: network.TCP,
+		OnEvent:   func(e Event) { events = append(events, e) },
+	}
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Type != EventCompleted {
+		t.Fatalf("events = %+v", events)
+	}
+	sum := sha256.Sum256(data)
+	if got := events[0]; got.SHA256 != hex.EncodeToString(sum[:]) ||
+		got.Bytes != uint64(len(data)) || got.File != "hashed.bin" {
+		t.Fatalf("completed event = %+v", got)
+	}
+}
+
+func TestUnknownSizeStreamTransfer(t *testing.T) {
+	data := randomData(3*protocol.TCPChunkSize + 7)
+
+	receiver, addr, errs := startReceiver(t, nil)
+	var out bytes.Buffer
+	receiver.Sink = storage.NewWriterSink(&out)
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	// A pipe hands over short reads and has no length, like stdin.
+	pr, pw := io.Pipe()
+	go func() {
+		for off := 0; off < len(data); off += 10_000 {
+			pw.Write(data[off:min(off+10_000, len(data))])
+		}
+		pw.Close()
+	}()
+
+	var events []Event
+	sender := &Client{
+		Config:    &config.Config{Streams: 3},
+		Transport: network.TCP,
+		OnEvent:   func(e Event) { events = append(events, e) },
+	}
+	if err := sender.transferSource(context.Background(),
+		storage.StreamSource("piped.bin", pr), conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("receiver failed: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("sink got %d bytes that differ from the %d sent", out.Len(), len(data))
+	}
+	sum := sha256.Sum256(data)
+	if len(events) != 1 || events[0].SHA256 != hex.EncodeToString(sum[:]) ||
+		events[0].Total != uint64(len(data)) {
+		t.Fatalf("events = %+v", events)
+	}
+}
+
+func TestStreamDigestRejectsMismatch(t *testing.T) {
+	sent := newStreamDigest()
+	got := newStreamDigest()
+	for _, chunk := range []string{"first chunk", "second"} {
+		sent.add([]byte(chunk))
+		got.add([]byte(chunk))
+	}
+	if err := got.check(sent.summary()); err != nil {
+		t.Fatalf("matching stream rejected: %v", err)
+	}
+
+	short := sent.summary()
+	short.Chunks++
+	if err := got.check(short); err == nil {
+		t.Fatal("stream missing a chunk accepted")
+	}
+	corrupt := sent.summary()
+	corrupt.SHA256[0] ^= 1
+	if err := got.check(corrupt); err == nil {
+		t.Fatal("stream with a different hash accepted")
+	}
+	if err := got.check(nil); err == nil {
+		t.Fatal("stream without a summary accepted")
+	}
+}
+
+func TestTextMessageDelivered(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	receiver, addr, errs := startReceiver(t, nil)
+	messages := make(chan Message, 1)
+	receiver.OnMessage = func(m Message) { messages <- m }
+	events := make(chan Event, 1)
+	receiver.OnEvent = func(e Event) { events <- e }
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	text := "deploy key rotated, see #ops"
+	src := messageSource{Source: storage.BytesSource(messageName, []byte(text)),
+		contentType: protocol.ContentTypeText}
+	sender := &Client{Config: &config.Config{}, Transport: network.TCP}
+	if err := sender.transferSource(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("receiver failed: %v", err)
+	}
+
+	if m := <-messages; string(m.Data) != text || m.ContentType != protocol.ContentTypeText {
+		t.Fatalf("message = %+v", m)
+	}
+	if e := <-events; e.Type != EventCompleted || e.Text != text || e.Path != "" {
+		t.Fatalf("completed event = %+v", e)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("message written to disk as %s", entries[0].Name())
+	}
+}
+
+func TestReceivedFileKeepsModeAndTimes(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	src := filepath.Join(t.TempDir(), "build.sh")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\necho ok\n"), 0o755); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	if err := os.Chmod(src, 0o755); err != nil {
+		t.Fatalf("failed to chmod source: %v", err)
+	}
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("failed to set source times: %v", err)
+	}
+
+	receiver, addr, errs := startReceiver(t, nil)
+	receiver.Config.Preserve = fileattr.Default
+
+	conn, err := network.TCP.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to dial receiver: %v", err)
+	}
+	defer conn.Close()
+
+	sender := &Client{Config: &config.Config{Preserve: fileattr.Default}, Transport: network.TCP}
+	if err := sender.transferFile(context.Background(), src, conn); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("receiver failed: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "build.sh"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o755 {
+		t.Errorf("received mode %v, want 0755", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("received mtime %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+// startSignallingServer runs a signalling server with a mailbox on a free
+// localhost port and returns the port.
+func startSignallingServer(t *testing.T) string {
+	t.Helper()
+
+	ss, err := signallingserver.NewSignallingServer(&config.Config{
+		SignallingServerPort: "0",
+		MailboxDir:           t.TempDir(),
+		MailboxQuota:         1 << 20,
+		MailboxTTL:           time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to start signalling server: %v", err)
+	}
+	t.Cleanup(func() { ss.TCPListener.Close() })
+	go ss.Start()
+
+	_, port, _ := net.SplitHostPort(ss.TCPListener.Addr().String())
+	return port
+}
+
+func registeredClient(t *testing.T, port string, passphrase string) *Client {
+	t.Helper()
+
+	client := NewClientWithConfig(&config.Config{
+		SignallingServerHost: "127.0.0.1",
+		SignallingServerPort: port,
+		TCPPort:              "0",
+		IdentityFile:         filepath.Join(t.TempDir(), "identity"),
+		CandidateHistory:     "none",
+	})
+	ctx := context.Background()
+	if err := client.ConnectServer(ctx); err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { client.SignalConn.Close() })
+	if _, err := client.RegisterWithServer(ctx, passphrase); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	return client
+}
+
+func TestMailboxSendAndFetch(t *testing.T) {
+	port := startSignallingServer(t)
+	data := randomData(3*protocol.MailboxChunkSize + 17)
+	src := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+
+	recipient := registeredClient(t, port, "")
+	sender := registeredClient(t, port, "")
+
+	// The upload only succeeds once the server's MailboxAck is read.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sender.HandleMailboxSendCommand(ctx, recipient.Identity, src,
+		"secret"); err != nil {
+		t.Fatalf("mailbox upload failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	recipient.Config.ReceiveDir = dir
+	if err := recipient.CheckMailbox(ctx, "secret"); err != nil {
+		t.Fatalf("mailbox fetch failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "report.pdf"))
+	if err != nil {
+		t.Fatalf("fetched file missing: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("fetched %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestMailboxFetchUsesSink(t *testing.T) {
+	port := startSignallingServer(t)
+	recipient := registeredClient(t, port, "")
+	sender := registeredClient(t, port, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data := []byte("left for later")
+	src := filepath.Join(t.TempDir(), "note.txt")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	if err := sender.HandleMailboxSendCommand(ctx, recipient.Identity, src,
+		"secret"); err != nil {
+		t.Fatalf("mailbox upload failed: %v", err)
+	}
+
+	sink := storage.NewMemorySink()
+	recipient.Sink = sink
+	if err := recipient.CheckMailbox(ctx, "secret"); err != nil {
+		t.Fatalf("mailbox fetch failed: %v", err)
+	}
+	if got, ok := sink.File("note.txt"); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("sink holds %q, want the mailbox entry %q", got, data)
+	}
+}
@@ -0,0 +1,461 @@
+"use strict";
+
+// Opcodes mirror internal/protocol.
+const Op = {
+  ServerHello: 1,
+  ServerAck: 2,
+  PeerInfoLookup: 3,
+  PeerLookupAck: 4,
+  Bye: 5,
+  Error: 6,
+  FileTransferStart: 7,
+  FileTransferData: 8,
+  FileTransferEnd: 9,
+  PeerInfoForward: 10,
+  Heartbeat: 11,
+  HeartbeatAck: 12,
+  PeerSignal: 13,
+};
+
+const TotalWebRTCSize = 16 * 1024;
+const TransferHeaderSize = 8;
+const WebRTCChunkSize = TotalWebRTCSize - TransferHeaderSize;
+// Leave room for the AES-GCM nonce and tag when encrypting a chunk.
+const EncryptedChunkSize = WebRTCChunkSize - 28;
+const MaxBuffered = 1024 * 1024;
+const ICEServers = [{ urls: "stun:stun.l.google.com:19302" }];
+
+const enc = new TextEncoder();
+const dec = new TextDecoder();
+
+const state = {
+  ws: null,
+  id: null,
+  passphrase: "",
+  saltData: "",
+  key: null,
+  pending: [],
+  peers: new Map(),
+  incoming: new Map(),
+};
+
+function log(msg) {
+  const el = document.getElementById("log");
+  el.textContent = `${new Date().toLocaleTimeString()} ${msg}\n` + el.textContent;
+}
+
+// --- framing ---------------------------------------------------------------
+
+function frame(op, payload) {
+  payload = payload || new Uint8Array(0);
+  const buf = new Uint8Array(5 + payload.length);
+  buf[0] = op;
+  new DataView(buf.buffer).setUint32(1, payload.length);
+  buf.set(payload, 5);
+  return buf;
+}
+
+function parse(data) {
+  const u8 = new Uint8Array(data);
+  const len = new DataView(u8.buffer, u8.byteOffset).getUint32(1);
+  return { op: u8[0], payload: u8.subarray(5, 5 + len) };
+}
+
+function startPayload(transferID, name, size, nChunks, chunkSize) {
+  const nameBytes = enc.encode(name);
+  const buf = new Uint8Array(6 + nameBytes.length + 8 + 4 + 5);
+  const dv = new DataView(buf.buffer);
+  dv.setUint32(0, transferID);
+  dv.setUint16(4, nameBytes.length);
+  buf.set(nameBytes, 6);
+  dv.setBigUint64(6 + nameBytes.length, BigInt(size));
+  dv.setUint32(14 + nameBytes.length, nChunks);
+  // Transfer layout: chunk size for offsets, and a single stream.
+  dv.setUint32(18 + nameBytes.length, chunkSize);
+  buf[22 + nameBytes.length] = 1;
+  return buf;
+}
+
+function parseStartPayload(buf) {
+  const dv = new DataView(buf.buffer, buf.byteOffset, buf.length);
+  const nameLen = dv.getUint16(4);
+  return {
+    transferID: dv.getUint32(0),
+    name: dec.decode(buf.subarray(6, 6 + nameLen)),
+    size: Number(dv.getBigUint64(6 + nameLen)),
+    nChunks: dv.getUint32(14 + nameLen),
+  };
+}
+
+function dataMessage(transferID, chunkIndex, chunk) {
+  const payload = new Uint8Array(TransferHeaderSize + chunk.length);
+  const dv = new DataView(payload.buffer);
+  dv.setUint32(0, transferID);
+  dv.setUint32(4, chunkIndex);
+  payload.set(chunk, TransferHeaderSize);
+  return frame(Op.FileTransferData, payload);
+}
+
+function uint32(value) {
+  const buf = new Uint8Array(4);
+  new DataView(buf.buffer).setUint32(0, value);
+  return buf;
+}
+
+// --- crypto (matches internal/crypto: PBKDF2-SHA256 + AES-256-GCM) ---------
+
+async function deriveKey(passphrase, saltData) {
+  const salt = await crypto.subtle.digest("SHA-256", enc.encode(saltData));
+  const base = await crypto.subtle.importKey("raw", enc.encode(passphrase),
+    "PBKDF2", false, ["deriveKey"]);
+  return crypto.subtle.deriveKey(
+    { name: "PBKDF2", hash: "SHA-256", salt, iterations: 100000 },
+    base, { name: "AES-GCM", length: 256 }, false, ["encrypt", "decrypt"]);
+}
+
+async function seal(key, data) {
+  if (!key) return data;
+  const iv = crypto.getRandomValues(new Uint8Array(12));
+  const ct = new Uint8Array(await crypto.subtle.encrypt({ name: "AES-GCM", iv }, key, data));
+  const out = new Uint8Array(iv.length + ct.length);
+  out.set(iv);
+  out.set(ct, iv.length);
+  return out;
+}
+
+async function unseal(key, data) {
+  if (!key) return data;
+  return new Uint8Array(await crypto.subtle.decrypt(
+    { name: "AES-GCM", iv: data.subarray(0, 12) }, key, data.subarray(12)));
+}
+
+function randomSalt() {
+  const bytes = crypto.getRandomValues(new Uint8Array(16));
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+// --- signalling ------------------------------------------------------------
+
+function sendSignal(op, obj) {
+  state.ws.send(frame(op, enc.encode(JSON.stringify(obj))));
+}
+
+function request(op, obj) {
+  return new Promise((resolve, reject) => {
+    state.pending.push({ resolve, reject });
+    sendSignal(op, obj);
+  });
+}
+
+function connect() {
+  state.passphrase = document.getElementById("passphrase").value;
+  const proto = location.protocol === "https:" ? "wss:" : "ws:";
+  const ws = new WebSocket(`${proto}//${location.host}/ws`);
+  ws.binaryType = "arraybuffer";
+  state.ws = ws;
+
+  ws.onopen = async () => {
+    const info = { Type: "browser", LocalAddr: [], PublicAddr: "" };
+    if (state.passphrase) {
+      if (!crypto.subtle) {
+        log("E2EE needs a secure context (https or localhost)");
+        ws.close();
+        return;
+      }
+      state.saltData = randomSalt();
+      state.key = await deriveKey(state.passphrase, state.saltData);
+      info.SaltData = state.saltData;
+    }
+    sendSignal(Op.ServerHello, info);
+  };
+
+  ws.onmessage = (ev) => onSignal(parse(ev.data));
+  ws.onclose = () => {
+    document.getElementById("peer-id").textContent = "disconnected";
+    log("signalling connection closed");
+  };
+}
+
+function onSignal(msg) {
+  switch (msg.op) {
+    case Op.ServerAck:
+      state.id = dec.decode(msg.payload);
+      document.getElementById("peer-id").textContent = state.id;
+      log(`registered as ${state.id}`);
+      break;
+    case Op.PeerLookupAck: {
+      const p = state.pending.shift();
+      if (p) p.resolve(JSON.parse(dec.decode(msg.payload)));
+      break;
+    }
+    case Op.Error: {
+      const err = new Error(dec.decode(msg.payload));
+      const p = state.pending.shift();
+      if (p) p.reject(err);
+      else log(`server error: ${err.message}`);
+      break;
+    }
+    case Op.PeerInfoForward:
+      log("a peer looked us up");
+      break;
+    case Op.PeerSignal:
+      onPeerSignal(JSON.parse(dec.decode(msg.payload)));
+      break;
+  }
+}
+
+// --- WebRTC ----------------------------------------------------------------
+
+function newPeerConnection(peerID) {
+  const pc = new RTCPeerConnection({ iceServers: ICEServers });
+  pc.onicecandidate = (ev) => {
+    if (ev.candidate) {
+      sendSignal(Op.PeerSignal, { PeerID: peerID, Data: { kind: "candidate", candidate: ev.candidate } });
+    }
+  };
+  state.peers.set(peerID, pc);
+  return pc;
+}
+
+async function onPeerSignal(signal) {
+  const from = signal.PeerID;
+  const data = signal.Data;
+
+  if (data.kind === "offer") {
+    const pc = newPeerConnection(from);
+    pc.ondatachannel = (ev) => receiveOn(ev.channel);
+    await pc.setRemoteDescription({ type: "offer", sdp: data.sdp });
+    const answer = await pc.createAnswer();
+    await pc.setLocalDescription(answer);
+    sendSignal(Op.PeerSignal, { PeerID: from, Data: { kind: "answer", sdp: answer.sdp } });
+    return;
+  }
+
+  const pc = state.peers.get(from);
+  if (!pc) return;
+
+  if (data.kind === "answer") {
+    await pc.setRemoteDescription({ type: "answer", sdp: data.sdp });
+  } else if (data.kind === "candidate") {
+    await pc.addIceCandidate(data.candidate);
+  }
+}
+
+function openDataChannel(peerID) {
+  return new Promise(async (resolve, reject) => {
+    const pc = newPeerConnection(peerID);
+    const channel = pc.createDataChannel("kdtransfer", { ordered: true });
+    channel.binaryType = "arraybuffer";
+    channel.bufferedAmountLowThreshold = MaxBuffered / 2;
+    channel.onopen = () => resolve({
+      send: (buf) => channel.send(buf),
+      buffered: () => channel.bufferedAmount,
+      close: () => { channel.close(); pc.close(); state.peers.delete(peerID); },
+      kind: "webrtc",
+    });
+    channel.onerror = (ev) => reject(ev.error || new Error("data channel failed"));
+
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    sendSignal(Op.PeerSignal, { PeerID: peerID, Data: { kind: "offer", sdp: offer.sdp } });
+  });
+}
+
+// Native peers have no WebRTC stack; they accept the same framing over a
+// WebSocket on their WS port, if they set one. Race every advertised address.
+function openNativeChannel(info) {
+  if (!info.WSPort) {
+    return Promise.reject(new Error("peer does not accept browser senders (no WS_PORT)"));
+  }
+  const hosts = info.LocalAddr.map((addr) => addr.slice(0, addr.lastIndexOf(":")));
+  return new Promise((resolve, reject) => {
+    let failures = 0;
+    let done = false;
+    for (const host of hosts) {
+      const ws = new WebSocket(`ws://${host}:${info.WSPort}/`);
+      ws.binaryType = "arraybuffer";
+      ws.onopen = () => {
+        if (done) { ws.close(); return; }
+        done = true;
+        resolve({
+          send: (buf) => ws.send(buf),
+          buffered: () => ws.bufferedAmount,
+          close: () => ws.close(),
+          kind: "websocket",
+        });
+      };
+      ws.onerror = () => {
+        failures++;
+        if (failures === hosts.length && !done) {
+          reject(new Error("peer not reachable"));
+        }
+      };
+    }
+    if (hosts.length === 0) reject(new Error("no addresses to try"));
+  });
+}
+
+// --- sending ---------------------------------------------------------------
+
+async function waitForDrain(channel) {
+  while (channel.buffered() > MaxBuffered) {
+    await new Promise((r) => setTimeout(r, 20));
+  }
+}
+
+async function sendFiles(files) {
+  const target = document.getElementById("target").value.trim();
+  if (!state.id) { log("connect first"); return; }
+  if (!target) { log("enter a peer ID"); return; }
+
+  let info;
+  try {
+    info = await request(Op.PeerInfoLookup, {
+      PeerID: target,
+      Info: { Type: "browser", LocalAddr: [], PublicAddr: "" },
+    });
+  } catch (err) {
+    log(`lookup failed: ${err.message}`);
+    return;
+  }
+
+  let key = null;
+  if (state.passphrase && info.SaltData) {
+    key = await deriveKey(state.passphrase, info.SaltData);
+    for (let i = 0; i < info.LocalAddr.length; i++) {
+      const raw = Uint8Array.from(atob(info.LocalAddr[i]), (c) => c.charCodeAt(0));
+      info.LocalAddr[i] = dec.decode(await unseal(key, raw));
+    }
+  }
+
+  let channel;
+  try {
+    channel = info.Type === "browser" ? await openDataChannel(target) : await openNativeChannel(info);
+  } catch (err) {
+    log(`failed to connect to peer: ${err.message}`);
+    return;
+  }
+  log(`connected to ${target} via ${channel.kind}`);
+
+  for (const file of files) {
+    await sendFile(channel, file, key);
+  }
+  channel.close();
+}
+
+async function sendFile(channel, file, key) {
+  const chunkSize = key ? EncryptedChunkSize : WebRTCChunkSize;
+  const nChunks = Math.ceil(file.size / chunkSize);
+  const transferID = crypto.getRandomValues(new Uint32Array(1))[0];
+  const row = addTransferRow(`↑ ${file.name}`, file.size);
+  const started = performance.now();
+
+  channel.send(frame(Op.FileTransferStart,
+    await seal(key, startPayload(transferID, file.name, file.size, nChunks, chunkSize))));
+
+  for (let i = 0; i < nChunks; i++) {
+    const slice = file.slice(i * chunkSize, (i + 1) * chunkSize);
+    const chunk = new Uint8Array(await slice.arrayBuffer());
+    await waitForDrain(channel);
+    channel.send(dataMessage(transferID, i, await seal(key, chunk)));
+    row.value = Math.min(file.size, (i + 1) * chunkSize);
+  }
+
+  channel.send(frame(Op.FileTransferEnd, await seal(key, uint32(transferID))));
+  await waitForDrain(channel);
+  log(`Transfer ${transferID}: sent successfully in ${((performance.now() - started) / 1000).toFixed(2)}s`);
+}
+
+// --- receiving -------------------------------------------------------------
+
+function receiveOn(channel) {
+  channel.binaryType = "arraybuffer";
+  // Decryption is async; serialise handling so chunks stay in order.
+  let queue = Promise.resolve();
+  channel.onmessage = (ev) => {
+    queue = queue.then(() => onPeerMessage(parse(ev.data))).catch((err) => {
+      log(`receive failed: ${err.message}`);
+      channel.close();
+    });
+  };
+}
+
+async function onPeerMessage(msg) {
+  switch (msg.op) {
+    case Op.FileTransferStart: {
+      const start = parseStartPayload(await unseal(state.key, msg.payload));
+      start.chunks = [];
+      start.started = performance.now();
+      start.row = addTransferRow(`↓ ${start.name}`, start.size);
+      start.received = 0;
+      state.incoming.set(start.transferID, start);
+      log(`Receiving file: ${start.name} (ID: ${start.transferID}, Size: ${start.size} bytes, Chunks: ${start.nChunks})`);
+      break;
+    }
+    case Op.FileTransferData: {
+      const dv = new DataView(msg.payload.buffer, msg.payload.byteOffset);
+      const transferID = dv.getUint32(0);
+      const chunkIndex = dv.getUint32(4);
+      const ft = state.incoming.get(transferID);
+      if (!ft) throw new Error(`chunk received for invalid transfer id: ${transferID}`);
+      const chunk = await unseal(state.key, msg.payload.subarray(TransferHeaderSize));
+      ft.chunks[chunkIndex] = chunk;
+      ft.received += chunk.length;
+      ft.row.value = ft.received;
+      break;
+    }
+    case Op.FileTransferEnd: {
+      const payload = await unseal(state.key, msg.payload);
+      const transferID = new DataView(payload.buffer, payload.byteOffset).getUint32(0);
+      const ft = state.incoming.get(transferID);
+      if (!ft) throw new Error("invalid ID for FILE_TRANSFER_END message");
+      state.incoming.delete(transferID);
+      offerDownload(ft);
+      log(`Transfer ${transferID}: received successfully in ${((performance.now() - ft.started) / 1000).toFixed(2)}s`);
+      break;
+    }
+  }
+}
+
+function offerDownload(ft) {
+  const url = URL.createObjectURL(new Blob(ft.chunks));
+  const link = document.createElement("a");
+  link.href = url;
+  link.download = ft.name;
+  link.textContent = `save ${ft.name}`;
+  ft.row.parentElement.appendChild(link);
+}
+
+// --- UI --------------------------------------------------------------------
+
+function addTransferRow(label, size) {
+  const li = document.createElement("li");
+  li.textContent = label;
+  const bar = document.createElement("progress");
+  bar.max = size || 1;
+  bar.value = 0;
+  li.appendChild(bar);
+  document.getElementById("transfers").appendChild(li);
+  return bar;
+}
+
+function setupDropzone() {
+  const zone = document.getElementById("dropzone");
+  const input = document.getElementById("file-input");
+
+  zone.addEventListener("click", () => input.click());
+  input.addEventListener("change", () => sendFiles(Array.from(input.files)));
+  zone.addEventListener("dragover", (ev) => {
+    ev.preventDefault();
+    zone.classList.add("active");
+  });
+  zone.addEventListener("dragleave", () => zone.classList.remove("active"));
+  zone.addEventListener("drop", (ev) => {
+    ev.preventDefault();
+    zone.classList.remove("active");
+    sendFiles(Array.from(ev.dataTransfer.files));
+  });
+}
+
+document.getElementById("connect").addEventListener("click", connect);
+setupDropzone();
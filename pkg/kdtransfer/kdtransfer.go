@@ -0,0 +1,273 @@
+// Package kdtransfer embeds KDTransfer peers in other programs.
+//
+// A Client registers with a signalling server when it is created, sends
+// any io.Reader to a peer ID with Send and accepts files with Receive. It
+// never reads stdin or prints to stdout; diagnostics go through the
+// standard log package, so log.SetOutput controls them.
+package kdtransfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/KD0S-02/KDTransfer/internal/config"
+	"github.com/KD0S-02/KDTransfer/internal/protocol"
+	"github.com/KD0S-02/KDTransfer/internal/storage"
+	"github.com/KD0S-02/KDTransfer/internal/transfer"
+)
+
+type (
+	Event         = transfer.Event
+	EventType     = transfer.EventType
+	Progress      = transfer.ProgressEvent
+	ProgressState = transfer.ProgressState
+	Direction     = transfer.Direction
+
+	// Source, Sink and SinkFile let programs send from and receive into
+	// other storage than files.
+	Source   = storage.Source
+	Sink     = storage.Sink
+	SinkFile = storage.SinkFile
+)
+
+const (
+	EventRegistered = transfer.EventRegistered
+	EventPeerFound  = transfer.EventPeerFound
+	EventConnected  = transfer.EventConnected
+	EventProgress   = transfer.EventProgress
+	EventCompleted  = transfer.EventCompleted
+	EventFailed     = transfer.EventFailed
+
+	ProgressRunning   = transfer.ProgressRunning
+	ProgressPaused    = transfer.ProgressPaused
+	ProgressCompleted = transfer.ProgressCompleted
+	ProgressFailed    = transfer.ProgressFailed
+	ProgressSuspended = transfer.ProgressSuspended
+
+	Sending   = transfer.Sending
+	Receiving = transfer.Receiving
+
+	// UnknownSize as Meta.Size sends a reader until it ends, checking the
+	// stream's length and SHA-256 on arrival.
+	UnknownSize = storage.UnknownSize
+)
+
+// Errors returned by Send and Receive can be matched with errors.Is.
+var (
+	ErrPeerNotFound   = transfer.ErrPeerNotFound
+	ErrUnreachable    = transfer.ErrUnreachable
+	ErrTransferFailed = transfer.ErrTransferFailed
+	ErrIncompatible   = protocol.ErrIncompatible
+	ErrCancelled      = protocol.ErrCancelled
+	ErrSuspended      = protocol.ErrSuspended
+
+	ErrAlreadyReceiving = errors.New("kdtransfer: already receiving")
+)
+
+// Meta describes what Send is sending.
+type Meta struct {
+	// Name is the file name the receiver writes; only its base is used.
+	Name string
+	Size uint64
+}
+
+// File is a completed incoming transfer.
+type File struct {
+	TransferID uint32
+	Name       string
+	// Path is where the file was written, inside the receive directory;
+	// it is empty for files handed to a Sink.
+	Path   string
+	Size   uint64
+	SHA256 string
+	// ContentType and Text are set for text messages sent with SendText,
+	// which are not stored anywhere.
+	ContentType string
+	Text        string
+}
+
+// Handler is called once for every file Receive finishes. Returning an
+// error stops Receive, which returns it.
+type Handler func(ctx context.Context, file File) error
+
+type Client struct {
+	engine     *transfer.Client
+	passphrase string
+	onEvent    func(Event)
+
+	mu       sync.Mutex
+	received func(File)
+	// sendMu serialises sends: lookups share the signalling connection.
+	sendMu sync.Mutex
+}
+
+// New creates a client and registers it with the signalling server. Only
+// the options given, on top of the built-in defaults, are used.
+func New(ctx context.Context, opts ...Option) (*Client, error) {
+	o := options{cfg: config.Default()}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{
+		engine:     transfer.NewClientWithConfig(o.cfg),
+		passphrase: o.passphrase,
+		onEvent:    o.onEvent,
+	}
+	c.engine.OnEvent = c.dispatch
+	c.engine.OnProgress = o.onProgress
+	c.engine.Sink = o.sink
+
+	if err := c.engine.ConnectServer(ctx); err != nil {
+		return nil, fmt.Errorf("failed to reach signalling server: %w", err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.engine.SignalConn.Close() })
+	defer stop()
+
+	if _, err := c.engine.RegisterWithServer(ctx, o.passphrase); err != nil {
+		c.engine.SignalConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ID is the peer ID senders use to reach this client.
+func (c *Client) ID() string {
+	return c.engine.ID
+}
+
+// Identity is the persistent identity used for mailbox delivery.
+func (c *Client) Identity() string {
+	return c.engine.Identity
+}
+
+// Send streams meta.Size bytes from r to peer. Readers implementing
+// io.ReaderAt, such as *os.File or *bytes.Reader, are striped over the
+// configured streams and can resume after a suspend; other readers are
+// sent in order over one stream, as are readers of UnknownSize. Cancelling
+// ctx cancels the transfer on both sides.
+func (c *Client) Send(ctx context.Context, peer string, r io.Reader, meta Meta) error {
+	if meta.Name == "" {
+		return errors.New("kdtransfer: Meta.Name is required")
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.engine.SendReader(ctx, peer, meta.Name, meta.Size, r, c.passphrase)
+}
+
+// SendSource sends src to peer, like Send. Sequential sources go over one
+// stream; others are striped.
+func (c *Client) SendSource(ctx context.Context, peer string, src Source) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.engine.SendSource(ctx, peer, src, c.passphrase)
+}
+
+// SendText sends text to peer as a message rather than a file. The
+// receiver's handler gets it in File.Text.
+func (c *Client) SendText(ctx context.Context, peer string, text string) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.engine.SendMessage(ctx, peer, protocol.ContentTypeText, []byte(text), c.passphrase)
+}
+
+// Receive accepts transfers until ctx is done or handler returns an
+// error, then cancels any still in flight and removes their partial files.
+// It returns the handler's error, or ctx's.
+func (c *Client) Receive(ctx context.Context, handler Handler) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	c.mu.Lock()
+	if c.received != nil {
+		c.mu.Unlock()
+		return ErrAlreadyReceiving
+	}
+	c.received = func(file File) {
+		if err := handler(ctx, file); err != nil {
+			cancel(err)
+		}
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.received = nil
+		c.mu.Unlock()
+	}()
+
+	if err := c.engine.Serve(ctx); err != nil {
+		return err
+	}
+	return context.Cause(ctx)
+}
+
+// Pause, Resume and Cancel control an in-flight transfer by the
+// TransferID reported in events.
+func (c *Client) Pause(transferID uint32) error {
+	return c.engine.PauseTransfer(transferID)
+}
+
+func (c *Client) Resume(transferID uint32) error {
+	return c.engine.ResumeTransfer(transferID)
+}
+
+func (c *Client) Cancel(transferID uint32) error {
+	return c.engine.CancelTransfer(transferID, "cancelled")
+}
+
+// Close cancels every transfer and disconnects from the signalling
+// server.
+func (c *Client) Close() error {
+	c.engine.CancelTransfers("client closed")
+	return c.engine.SignalConn.Close()
+}
+
+// dispatch hands completed incoming files to the running Receive before
+// passing every event on.
+func (c *Client) dispatch(e Event) {
+	if e.Type == EventCompleted && e.Direction == Receiving {
+		c.mu.Lock()
+		received := c.received
+		c.mu.Unlock()
+
+		if received != nil {
+			received(File{
+				TransferID:  e.TransferID,
+				Name:        e.File,
+				Path:        e.Path,
+				Size:        e.Total,
+				SHA256:      e.SHA256,
+				ContentType: e.ContentType,
+				Text:        e.Text,
+			})
+		}
+	}
+
+	if c.onEvent != nil {
+		c.onEvent(e)
+	}
+}
@@ -0,0 +1,131 @@
+package kdtransfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/config"
+	"github.com/KD0S-02/KDTransfer/internal/network"
+	"github.com/KD0S-02/KDTransfer/internal/signallingserver"
+	"github.com/KD0S-02/KDTransfer/pkg/kdtransfer"
+)
+
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	ss, err := signallingserver.NewSignallingServer(&config.Config{SignallingServerPort: "0"})
+	if err != nil {
+		t.Fatalf("failed to start signalling server: %v", err)
+	}
+	t.Cleanup(func() { ss.TCPListener.Close() })
+	go ss.Start()
+
+	_, port, _ := net.SplitHostPort(ss.TCPListener.Addr().String())
+	return port
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func newClient(t *testing.T, server string, opts ...kdtransfer.Option) *kdtransfer.Client {
+	t.Helper()
+
+	opts = append([]kdtransfer.Option{
+		kdtransfer.WithServer("127.0.0.1", server),
+		kdtransfer.WithPorts(freePort(t), ""),
+		kdtransfer.WithIdentityFile(filepath.Join(t.TempDir(), "identity")),
+		kdtransfer.WithSTUNServers(),
+	}, opts...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := kdtransfer.New(ctx, opts...)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSendReaderToReceiveHandler(t *testing.T) {
+	if addrs, _ := network.LocalAddresses("0"); len(addrs) == 0 {
+		t.Skip("no non-loopback address to receive on")
+	}
+
+	server := startServer(t)
+	dir := t.TempDir()
+	port := freePort(t)
+	receiver := newClient(t, server, kdtransfer.WithPorts(port, ""),
+		kdtransfer.WithReceiveDir(dir), kdtransfer.WithPassphrase("secret"))
+	sender := newClient(t, server, kdtransfer.WithPassphrase("secret"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	errDone := errors.New("done")
+	files := make(chan kdtransfer.File, 1)
+	received := make(chan error, 1)
+	go func() {
+		received <- receiver.Receive(ctx, func(_ context.Context, file kdtransfer.File) error {
+			files <- file
+			return errDone
+		})
+	}()
+
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data := make([]byte, 300*1024+7)
+	rand.Read(data)
+	// Hide ReadAt so the in-order path is used.
+	reader := struct{ io.Reader }{bytes.NewReader(data)}
+	if err := sender.Send(ctx, receiver.ID(), reader, kdtransfer.Meta{
+		Name: "../escape.bin",
+		Size: uint64(len(data)),
+	}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	file := <-files
+	if err := <-received; !errors.Is(err, errDone) {
+		t.Fatalf("Receive returned %v, want the handler's error", err)
+	}
+
+	want := filepath.Join(dir, "escape.bin")
+	sum := sha256.Sum256(data)
+	if file.Path != want || file.Size != uint64(len(data)) ||
+		file.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("received file = %+v", file)
+	}
+	got, err := os.ReadFile(want)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received content differs (err %v)", err)
+	}
+}
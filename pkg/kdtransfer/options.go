@@ -0,0 +1,156 @@
+package kdtransfer
+
+import (
+	"time"
+
+	"github.com/KD0S-02/KDTransfer/internal/codec"
+	"github.com/KD0S-02/KDTransfer/internal/config"
+	"github.com/KD0S-02/KDTransfer/internal/fileattr"
+)
+
+// Option configures a Client. Anything not set keeps the same default the
+// kdtransfer command uses, but nothing is read from .env or the
+// environment.
+type Option func(*options) error
+
+type options struct {
+	cfg        *config.Config
+	passphrase string
+	onEvent    func(Event)
+	onProgress func(Progress)
+	sink       Sink
+}
+
+// WithServer sets the signalling server address.
+func WithServer(host string, port string) Option {
+	return func(o *options) error {
+		o.cfg.SignallingServerHost = host
+		o.cfg.SignallingServerPort = port
+		return nil
+	}
+}
+
+// WithPorts sets the ports Receive listens on for native peers and for
+// browsers. An empty wsPort disables browser senders.
+func WithPorts(tcpPort string, wsPort string) Option {
+	return func(o *options) error {
+		o.cfg.TCPPort = tcpPort
+		o.cfg.WSPort = wsPort
+		return nil
+	}
+}
+
+// WithPassphrase enables end-to-end encryption for both directions.
+func WithPassphrase(passphrase string) Option {
+	return func(o *options) error {
+		o.passphrase = passphrase
+		return nil
+	}
+}
+
+// WithReceiveDir sets where Receive writes incoming files (default the
+// working directory).
+func WithReceiveDir(dir string) Option {
+	return func(o *options) error {
+		o.cfg.ReceiveDir = dir
+		return nil
+	}
+}
+
+// WithSink makes Receive hand incoming files to sink instead of writing
+// them into the receive directory. Only files in the receive directory
+// can resume after a suspend.
+func WithSink(sink Sink) Option {
+	return func(o *options) error {
+		o.sink = sink
+		return nil
+	}
+}
+
+// WithIdentityFile sets where the persistent identity secret is kept.
+func WithIdentityFile(path string) Option {
+	return func(o *options) error {
+		o.cfg.IdentityFile = path
+		return nil
+	}
+}
+
+// WithStreams sets how many parallel connections each send may use.
+func WithStreams(n int) Option {
+	return func(o *options) error {
+		o.cfg.Streams = n
+		return nil
+	}
+}
+
+// WithCompression sets the codecs to offer, e.g. "zstd,s2" or "off". S2 is
+// the fast codec; LZ4 is not supported.
+func WithCompression(list string) Option {
+	return func(o *options) error {
+		codecs, err := codec.ParseList(list)
+		if err != nil {
+			return err
+		}
+		o.cfg.Compression = codecs
+		return nil
+	}
+}
+
+// WithPreserve sets which file attributes to send and apply, e.g.
+// "mode,times", "all" or "none".
+func WithPreserve(list string) Option {
+	return func(o *options) error {
+		set, err := fileattr.Parse(list)
+		if err != nil {
+			return err
+		}
+		o.cfg.Preserve = set
+		return nil
+	}
+}
+
+// WithRateLimit caps outgoing bandwidth in bytes per second; 0 is
+// unlimited.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(o *options) error {
+		o.cfg.RateLimit = bytesPerSecond
+		return nil
+	}
+}
+
+// WithPauseTimeout sets how long a paused transfer waits before it is
+// suspended.
+func WithPauseTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.cfg.PauseTimeout = timeout
+		return nil
+	}
+}
+
+// WithSTUNServers replaces the STUN servers used to learn the public
+// address; none disables STUN.
+func WithSTUNServers(servers ...string) Option {
+	return func(o *options) error {
+		o.cfg.STUNServers = servers
+		return nil
+	}
+}
+
+// WithEvents registers a callback for registration, lookup, connection,
+// completion and failure events. It may be called from several goroutines
+// at once.
+func WithEvents(fn func(Event)) Option {
+	return func(o *options) error {
+		o.onEvent = fn
+		return nil
+	}
+}
+
+// WithProgress registers a callback receiving each transfer's progress
+// about four times a second and once when it ends.
+func WithProgress(fn func(Progress)) Option {
+	return func(o *options) error {
+		o.onProgress = fn
+		return nil
+	}
+}